@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/sbldevnet/cloudflared-proxy/internal"
 	"github.com/sbldevnet/cloudflared-proxy/internal/config"
 	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/tracing"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -21,6 +24,7 @@ func Execute() *cobra.Command {
 	}
 
 	cmd.AddCommand(Run())
+	cmd.AddCommand(Config())
 	cmd.AddCommand(Version())
 
 	return cmd
@@ -28,9 +32,9 @@ func Execute() *cobra.Command {
 
 func Run() *cobra.Command {
 	var (
-		endpoints []string
-		skipTLS   bool
-		cfgFile   string
+		opts    configOptions
+		profile string
+		only    []string
 	)
 
 	cmd := &cobra.Command{
@@ -38,86 +42,192 @@ func Run() *cobra.Command {
 		Short: "Start reverse proxies",
 		Long:  "Start reverse proxies to Cloudflare Access applications",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			hasEndpoints := cmd.Flags().Changed("endpoints")
-			hasConfig := cmd.Flags().Changed("config")
-
 			// Check for conflicting flags
-			if hasConfig && hasEndpoints {
-				return fmt.Errorf("cannot specify both --config and --endpoints flags")
+			if cmd.Flags().Changed("endpoints") && cmd.Flags().Changed("profile") {
+				return fmt.Errorf("cannot specify both --profile and --endpoints flags")
 			}
 
-			var proxyConfigs []config.ProxyConfig
-
-			// If endpoints provided
-			if hasEndpoints {
-				proxyConfigs = make([]config.ProxyConfig, len(endpoints))
-				for i, endpoint := range endpoints {
-					proxy, err := config.ParseEndpointString(endpoint)
-					if err != nil {
-						return err
-					}
-					proxy.SkipTLS = skipTLS
-					proxyConfigs[i] = *proxy
-				}
-			} else {
-				// If config or default provided
-				if err := initConfig(cfgFile); err != nil {
-					return err
-				}
+			cfg, _, err := loadConfig(cmd, opts)
+			if err != nil {
+				return err
+			}
 
-				if !viper.IsSet("proxies") {
-					return fmt.Errorf("no proxies defined in config file")
-				}
+			proxyConfigs, err := cfg.SelectProxies(profile, only)
+			if err != nil {
+				return err
+			}
 
-				var cfg config.Config
-				if err := viper.Unmarshal(&cfg); err != nil {
-					return fmt.Errorf("unable to decode into struct, %v", err)
-				}
-				config.SetDefaults(cfg.Proxies)
-				proxyConfigs = cfg.Proxies
+			shutdownTracing, err := tracing.Setup(cmd.Context(), tracing.Config{
+				Endpoint:    cfg.Tracing.Endpoint,
+				Insecure:    cfg.Tracing.Insecure,
+				ServiceName: cfg.Tracing.ServiceName,
+			})
+			if err != nil {
+				return fmt.Errorf("unable to set up tracing, %v", err)
 			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					logger.Error("cmd.Run", err, "Failed to flush traces and metrics")
+				}
+			}()
 
 			logger.Debug("cmd.Run", "Starting %d proxies", len(proxyConfigs))
 			logger.Debug("cmd.Run", "Proxy configs: %v", proxyConfigs)
 
-			return internal.ProxyCFAccess(cmd.Context(), proxyConfigs, internal.NewLiveProxyService())
+			return internal.ProxyCFAccess(cmd.Context(), proxyConfigs, cfg.Probes, internal.NewLiveProxyService())
 		},
 	}
 
-	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
-	cmd.Flags().StringSliceVarP(&endpoints, "endpoints", "e", []string{}, "List of endpoints to proxy in format [LOCAL_PORT:]HOSTNAME[:DEST_PORT]")
-	cmd.Flags().BoolVarP(&skipTLS, "skip-tls", "s", false, "Skip TLS verification")
+	opts.addFlags(cmd)
+	cmd.Flags().StringVarP(&profile, "profile", "p", "", "Start only the proxies of the given profile")
+	cmd.Flags().StringSliceVar(&only, "only", []string{}, "Start only the proxies with the given names")
 
 	return cmd
 }
 
-func initConfig(cfgFile string) error {
-	if cfgFile != "" {
-		// Explicit config file
-		logger.Debug("cmd.initConfig", "Explicit config file: %s", cfgFile)
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Try default config location
-		logger.Debug("cmd.initConfig", "No explicit config file, using default location")
-		home, err := os.UserHomeDir()
+// configOptions are the command-line flags layered over the config files.
+type configOptions struct {
+	cfgFile      string
+	endpoints    []string
+	skipTLS      bool
+	otlpEndpoint string
+}
+
+func (o *configOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&o.cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+	cmd.Flags().StringSliceVarP(&o.endpoints, "endpoints", "e", []string{}, "List of endpoints to proxy in format [LOCAL_PORT:]HOSTNAME[:DEST_PORT] or "+config.EndpointFormat)
+	cmd.Flags().BoolVarP(&o.skipTLS, "skip-tls", "s", false, "Skip TLS verification of the endpoints")
+	cmd.Flags().StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export traces and metrics to, e.g. http://localhost:4318")
+}
+
+// loadLayers merges, in increasing order of precedence, the global config
+// file (or the one given with --config), the project config file, the
+// CFPROXY_* environment variables and the command-line flags.
+func loadLayers(cmd *cobra.Command, opts configOptions) (*config.Merged, error) {
+	var layers []config.Layer
+
+	globalFile, err := findGlobalConfig(opts.cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	if globalFile != "" {
+		logger.Debug("cmd.loadLayers", "Global config file: %s", globalFile)
+		layer, err := config.FileLayer("global file", globalFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		viper.AddConfigPath(filepath.Join(home, ".config", "cloudflared-proxy"))
-		viper.SetConfigName("config")
+		layers = append(layers, layer)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	projectFile, err := config.FindProjectFile(cwd)
+	if err != nil {
+		return nil, err
+	}
+	if projectFile != "" {
+		logger.Debug("cmd.loadLayers", "Project config file: %s", projectFile)
+		layer, err := config.FileLayer("project file", projectFile)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	envLayer, err := config.EnvLayer(os.Environ(), config.Merge(layers...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment variables:\n%v", err)
 	}
+	layers = append(layers, envLayer)
 
-	if err := viper.ReadInConfig(); err != nil {
+	flagLayer := config.Layer{Name: "flags", Settings: make(map[string]any)}
+	if flags := cmd.Flags(); flags.Changed("endpoints") {
+		// Endpoints replace the proxies of the config files, and so the
+		// profiles referring to them.
+		endpoints, err := config.ParseEndpoints(opts.endpoints)
+		if err != nil {
+			return nil, err
+		}
+		proxies := make([]any, len(endpoints))
+		for i, proxy := range endpoints {
+			proxy.SkipTLS = proxy.SkipTLS || opts.skipTLS
+			proxies[i] = config.ProxySettings(proxy)
+		}
+		flagLayer.Settings["proxies"] = proxies
+		flagLayer.Settings["profiles"] = map[string]any{}
+		flagLayer.Replace = []string{"proxies", "profiles"}
+	}
+	if cmd.Flags().Changed("otlp-endpoint") {
+		flagLayer.Settings["tracing"] = map[string]any{"endpoint": opts.otlpEndpoint}
+	}
+	layers = append(layers, flagLayer)
+
+	merged := config.Merge(layers...)
+	if _, ok := merged.Settings["proxies"]; !ok {
+		return nil, fmt.Errorf("no config file or endpoints provided")
+	}
+	return merged, nil
+}
+
+// findGlobalConfig returns the explicit config file, which must exist, or
+// the default one if found.
+func findGlobalConfig(cfgFile string) (string, error) {
+	if cfgFile != "" {
+		if _, err := os.Stat(cfgFile); err != nil {
+			return "", fmt.Errorf("config file not found: %s", cfgFile)
+		}
+		return cfgFile, nil
+	}
+
+	dir, err := config.DefaultConfigDir()
+	if err != nil {
+		return "", err
+	}
+	v := viper.New()
+	v.AddConfigPath(dir)
+	v.SetConfigName("config")
+	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			if cfgFile != "" {
-				return fmt.Errorf("config file not found: %s", cfgFile)
+			logger.Debug("cmd.findGlobalConfig", "default config file not found")
+			return "", nil
+		}
+		return "", err
+	}
+	return v.ConfigFileUsed(), nil
+}
+
+// loadConfig merges the config layers, decodes the result rejecting unknown
+// keys, applies the defaults and validates it.
+func loadConfig(cmd *cobra.Command, opts configOptions) (*config.Config, *config.Merged, error) {
+	merged, err := loadLayers(cmd, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decoding errors do not stop validation, so every problem is reported at once.
+	cfg, decodeErr := merged.Decode()
+	if cfg == nil {
+		return nil, nil, decodeErr
+	}
+	config.SetDefaults(cfg.Proxies)
+	validateErr := config.Validate(cfg)
+
+	if decodeErr != nil || validateErr != nil {
+		var problems []string
+		if decodeErr != nil {
+			// Drop the decoder's summary line, keeping one line per problem.
+			if inner := errors.Unwrap(decodeErr); inner != nil {
+				decodeErr = inner
 			}
-			logger.Debug("cmd.initConfig", "default config file not found")
-			return fmt.Errorf("no config file or endpoints provided")
+			problems = append(problems, decodeErr.Error())
+		}
+		if validateErr != nil {
+			problems = append(problems, validateErr.Error())
 		}
-		return err
+		return nil, nil, fmt.Errorf("invalid configuration:\n%s", strings.Join(problems, "\n"))
 	}
 
-	logger.Debug("cmd.initConfig", "Config file loaded: %s", viper.ConfigFileUsed())
-	return nil
+	return cfg, merged, nil
 }
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/sbldevnet/cloudflared-proxy/internal/config"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+func Config() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the configuration file",
+	}
+
+	cmd.AddCommand(ConfigInit())
+	cmd.AddCommand(ConfigAdd())
+	cmd.AddCommand(ConfigRemove())
+	cmd.AddCommand(ConfigList())
+	cmd.AddCommand(ConfigShow())
+	cmd.AddCommand(ConfigValidate())
+	cmd.AddCommand(ConfigSchema())
+
+	return cmd
+}
+
+func ConfigInit() *cobra.Command {
+	var (
+		cfgFile string
+		force   bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a commented configuration file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := cfgFile
+			if path == "" {
+				dir, err := config.DefaultConfigDir()
+				if err != nil {
+					return err
+				}
+				path = filepath.Join(dir, "config.yaml")
+			}
+
+			if err := config.WriteInitFile(path, force); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Config file written to %s\n", path)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Overwrite an existing config file")
+
+	return cmd
+}
+
+func ConfigAdd() *cobra.Command {
+	var (
+		cfgFile string
+		name    string
+		skipTLS bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "add ENDPOINT",
+		Short: "Add a proxy to the configuration file",
+		Long:  "Add a proxy to the configuration file. The endpoint format is [LOCAL_PORT:]HOSTNAME[:DEST_PORT] or " + config.EndpointFormat,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			proxy, err := config.ParseEndpointString(args[0])
+			if err != nil {
+				return err
+			}
+			if name != "" {
+				proxy.Name = name
+			}
+			proxy.SkipTLS = proxy.SkipTLS || skipTLS
+
+			f, err := loadConfigFile(cfgFile)
+			if err != nil {
+				return err
+			}
+			if err := f.AddProxy(*proxy); err != nil {
+				return err
+			}
+			if err := f.Save(); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Added proxy %s on port %d to %s\n", proxy.GetName(), proxy.LocalPort, f.Path)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+	cmd.Flags().StringVarP(&name, "name", "n", "", "Name of the proxy (default is the hostname)")
+	cmd.Flags().BoolVarP(&skipTLS, "skip-tls", "s", false, "Skip TLS verification")
+
+	return cmd
+}
+
+func ConfigRemove() *cobra.Command {
+	var cfgFile string
+
+	cmd := &cobra.Command{
+		Use:   "remove NAME|LOCAL_PORT",
+		Short: "Remove a proxy from the configuration file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := loadConfigFile(cfgFile)
+			if err != nil {
+				return err
+			}
+			proxy, err := f.RemoveProxy(args[0])
+			if err != nil {
+				return err
+			}
+			if err := f.Save(); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed proxy %s on port %d from %s\n", proxy.GetName(), proxy.LocalPort, f.Path)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+
+	return cmd
+}
+
+func ConfigList() *cobra.Command {
+	var cfgFile string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the proxies of the configuration file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := loadConfigFile(cfgFile)
+			if err != nil {
+				return err
+			}
+			cfg, err := f.Config()
+			if err != nil {
+				return err
+			}
+			config.SetDefaults(cfg.Proxies)
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tLOCAL PORT\tHOSTNAME\tDEST PORT\tSKIP TLS")
+			for _, proxy := range cfg.Proxies {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%t\n", proxy.GetName(), proxy.LocalPort, proxy.Hostname, proxy.DestinationPort, proxy.SkipTLS)
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+
+	return cmd
+}
+
+func ConfigValidate() *cobra.Command {
+	var opts configOptions
+
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the configuration",
+		Long:  "Validate the configuration, reporting unknown keys, duplicate ports and names, invalid hostnames and conflicting options",
+		Args:  cobra.NoArgs,
+		// The problems found are the output, the usage would only hide them.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, err := loadConfig(cmd, opts)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Configuration is valid: %d proxies, %d profiles\n", len(cfg.Proxies), len(cfg.Profiles))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.cfgFile, "config", "c", "", "config file (default is $HOME/.config/cloudflared-proxy/config.yaml)")
+
+	return cmd
+}
+
+func ConfigShow() *cobra.Command {
+	var (
+		opts      configOptions
+		effective bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the configuration merged from all sources",
+		Long: `Print the configuration merged from, in increasing order of precedence, the global
+config file, the project .cloudflared-proxy.yaml file, the CFPROXY_* environment
+variables and the command-line flags.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, merged, err := loadConfig(cmd, opts)
+			if err != nil {
+				return err
+			}
+
+			enc := yaml.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent(2)
+			if effective {
+				err = enc.Encode(merged.Annotate(cfg))
+			} else {
+				err = enc.Encode(merged.Settings)
+			}
+			if err != nil {
+				return err
+			}
+			return enc.Close()
+		},
+	}
+
+	opts.addFlags(cmd)
+	cmd.Flags().BoolVar(&effective, "effective", false, "Print the effective configuration, with defaults and the source of each value")
+
+	return cmd
+}
+
+func ConfigSchema() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the configuration file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := config.Schema()
+			if err != nil {
+				return err
+			}
+
+			_, err = cmd.OutOrStdout().Write(schema)
+			return err
+		},
+	}
+
+	return cmd
+}
+
+// loadConfigFile opens the config file for editing, looking for config.yaml
+// or config.yml in the default directory if no file is given.
+func loadConfigFile(cfgFile string) (*config.File, error) {
+	if cfgFile != "" {
+		return config.LoadFile(cfgFile)
+	}
+
+	dir, err := config.DefaultConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return config.LoadFile(path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no config file found in %s, create one with 'cloudflared-proxy config init'", dir)
+}
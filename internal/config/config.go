@@ -2,39 +2,206 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	DefaultLocalPort       uint16 = 8888
 	DefaultDestinationPort uint16 = 443
+	DefaultScheme                 = "https"
 )
 
+// The description tags are published in the JSON Schema of the config file.
 type ProxyConfig struct {
-	Hostname        string `mapstructure:"hostname"`
-	DestinationPort uint16 `mapstructure:"destinationPort"`
-	LocalPort       uint16 `mapstructure:"localPort"`
-	SkipTLS         bool   `mapstructure:"skipTLS"`
+	Name             string              `mapstructure:"name" description:"Name of the proxy, used in logs and by profiles. Defaults to the hostname."`
+	Hostname         string              `mapstructure:"hostname" description:"Destination hostname of the Cloudflare Access application."`
+	Upstreams        []string            `mapstructure:"upstreams" description:"Further hostnames of the application, e.g. regional ones, balanced with the hostname as set by loadBalancing. Each gets its own Access token."`
+	LocalPort        uint16              `mapstructure:"localPort" description:"Local port the proxy listens on."`
+	DestinationPort  uint16              `mapstructure:"destinationPort" description:"Destination port of the application."`
+	SkipTLS          bool                `mapstructure:"skipTLS" description:"Skip TLS verification of the destination."`
+	BindAddress      string              `mapstructure:"bindAddress" description:"Local address the proxy listens on. Defaults to all interfaces."`
+	Scheme           string              `mapstructure:"scheme" description:"Scheme used to reach the application, https or http."`
+	UpstreamPath     string              `mapstructure:"upstreamPath" description:"Base path of the application, prepended to the path of every request."`
+	StripPrefix      string              `mapstructure:"stripPrefix" description:"Local path prefix removed from requests before the upstream path is prepended."`
+	TokenTransport   string              `mapstructure:"tokenTransport" description:"How the Access token is passed to the application: header, cookie (CF_Authorization) or both."`
+	TokenHeader      string              `mapstructure:"tokenHeader" description:"Header carrying the Access token when passed as a header."`
+	ForwardedHeaders string              `mapstructure:"forwardedHeaders" description:"Policy for the X-Forwarded-* and Forwarded headers: preserve, set, strip or rfc7239."`
+	TrustedProxies   []string            `mapstructure:"trustedProxies" description:"IP addresses or CIDR ranges of proxies in front of this one whose forwarding headers are trusted."`
+	UpstreamProxy    string              `mapstructure:"upstreamProxy" description:"Outbound proxy to the application and cloudflared: an http, https, socks5 or socks5h URL, possibly with credentials, or direct. Defaults to HTTPS_PROXY, HTTP_PROXY and NO_PROXY."`
+	Resolve          []ResolveConfig     `mapstructure:"resolve" description:"Addresses dialed for hostnames instead of resolving them, as /etc/hosts would. SNI and the Host header keep the hostname."`
+	DNSServer        string              `mapstructure:"dnsServer" description:"DNS server resolving the application: an IP address with an optional port, a udp:// or tcp:// URL, or an https:// DNS over HTTPS URL. Defaults to the system resolver."`
+	RequestHeaders   HeaderRules         `mapstructure:"requestHeaders" description:"Headers changed in the requests sent to the application."`
+	ResponseHeaders  HeaderRules         `mapstructure:"responseHeaders" description:"Headers changed in the responses of the application."`
+	Transport        TransportConfig     `mapstructure:"transport" description:"Timeouts and connection limits of the connections to the application."`
+	TLS              TLSConfig           `mapstructure:"tls" description:"TLS settings of the connections to the application: CA bundle, server name, client certificate, version and cipher suites."`
+	Server           ServerConfig        `mapstructure:"server" description:"Timeouts of the local listener."`
+	Retry            RetryConfig         `mapstructure:"retry" description:"Retries of idempotent requests failing with a connection error or a 502, 503 or 504 response."`
+	LoadBalancing    LoadBalancingConfig `mapstructure:"loadBalancing" description:"How requests are spread over the hostname and upstreams, and when a failing one is skipped."`
+	HealthCheck      HealthCheckConfig   `mapstructure:"healthCheck" description:"Checks of the hostname and upstreams run in the background with their Access token. Disabled unless path is set."`
+	Cache            CacheConfig         `mapstructure:"cache" description:"Cache of the responses of the application, scoped to the identity of the Access token. Disabled unless enabled is set."`
+	Compression      CompressionConfig   `mapstructure:"compression" description:"Compression of the responses negotiated with the local clients: the application is asked for compressed responses, decoded for clients not accepting their coding. Disabled unless enabled is set."`
+	Optional         bool                `mapstructure:"optional" description:"Not required for readiness: /readyz ignores this proxy."`
+}
+
+// TransportConfig tunes the connections of a proxy to its application. Unset
+// values select the defaults, or no limit if there is none.
+type TransportConfig struct {
+	DialTimeout           time.Duration `mapstructure:"dialTimeout" description:"Timeout of establishing a connection."`
+	KeepAlive             time.Duration `mapstructure:"keepAlive" description:"Interval of TCP keep-alive probes."`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tlsHandshakeTimeout" description:"Timeout of the TLS handshake."`
+	ResponseHeaderTimeout time.Duration `mapstructure:"responseHeaderTimeout" description:"Timeout of waiting for the response headers once the request is sent. Unset means no timeout."`
+	IdleConnTimeout       time.Duration `mapstructure:"idleConnTimeout" description:"Time an idle connection is kept open for reuse."`
+	MaxIdleConns          int           `mapstructure:"maxIdleConns" description:"Maximum number of idle connections."`
+	MaxIdleConnsPerHost   int           `mapstructure:"maxIdleConnsPerHost" description:"Maximum number of idle connections to the application. Unset means 2."`
+	MaxConnsPerHost       int           `mapstructure:"maxConnsPerHost" description:"Maximum number of connections to the application. Unset means no limit."`
+	HTTP2                 bool          `mapstructure:"http2" description:"Attempt HTTP/2 to the application."`
+	DisableKeepAlives     bool          `mapstructure:"disableKeepAlives" description:"Use each connection for a single request."`
+}
+
+// TLSConfig configures the TLS connections of a proxy to its application, so
+// that internal CAs and mTLS origins work without skipTLS.
+type TLSConfig struct {
+	CAFile       string   `mapstructure:"caFile" description:"PEM bundle of CAs trusted in addition to the system ones. Conflicts with skipTLS."`
+	ServerName   string   `mapstructure:"serverName" description:"Server name sent in the SNI extension and verified, instead of the hostname."`
+	ClientCert   string   `mapstructure:"clientCert" description:"PEM client certificate presented to mTLS origins."`
+	ClientKey    string   `mapstructure:"clientKey" description:"PEM private key of the client certificate."`
+	MinVersion   string   `mapstructure:"minVersion" description:"Minimum TLS version: 1.0, 1.1, 1.2 or 1.3."`
+	CipherSuites []string `mapstructure:"cipherSuites" description:"Names of the allowed TLS 1.0-1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256."`
+	Pins         []string `mapstructure:"pins" description:"Accepted certificate pins, spki-sha256:BASE64 for a public key of the verified chain or cert-sha256:HEX for the leaf certificate. Several pins allow rotation."`
+}
+
+// ResolveConfig overrides the addresses of a hostname.
+type ResolveConfig struct {
+	Host      string   `mapstructure:"host" description:"Hostname whose addresses are overridden."`
+	Addresses []string `mapstructure:"addresses" description:"IP addresses dialed for the hostname, tried in order."`
+}
+
+// RetryConfig configures the retries of idempotent requests: GET, HEAD,
+// OPTIONS and those with an Idempotency-Key header. Retries are disabled
+// unless maxRetries is set.
+type RetryConfig struct {
+	MaxRetries       int           `mapstructure:"maxRetries" description:"Retries of a request after the first attempt. Unset disables retries."`
+	InitialBackoff   time.Duration `mapstructure:"initialBackoff" description:"Delay before the first retry, doubled for each further one, with jitter."`
+	MaxBackoff       time.Duration `mapstructure:"maxBackoff" description:"Maximum delay between retries."`
+	MaxBodySize      int64         `mapstructure:"maxBodySize" description:"Largest request body in bytes buffered so that it can be resent. Larger requests are not retried."`
+	BudgetRatio      float64       `mapstructure:"budgetRatio" description:"Maximum ratio of retries to requests over 10 seconds."`
+	BudgetMinRetries int           `mapstructure:"budgetMinRetries" description:"Retries allowed over 10 seconds regardless of the budget ratio."`
+}
+
+// LoadBalancingConfig chooses the hostname of each request among the
+// hostname and upstreams of a proxy.
+type LoadBalancingConfig struct {
+	Strategy    string        `mapstructure:"strategy" description:"round-robin, least-connections, or primary-backup to use the hostname and then the upstreams in order."`
+	MaxFails    int           `mapstructure:"maxFails" description:"Failed requests in a row, connection errors or 502, 503 and 504 responses, after which a hostname is skipped."`
+	FailTimeout time.Duration `mapstructure:"failTimeout" description:"How long a failing hostname is skipped, unless all of them are."`
+}
+
+// HealthCheckConfig configures the background checks of the hostname and
+// upstreams of a proxy. Health checks are disabled unless path is set.
+type HealthCheckConfig struct {
+	Path           string        `mapstructure:"path" description:"Path requested on the application, below the upstream path, e.g. /healthz."`
+	Interval       time.Duration `mapstructure:"interval" description:"Delay between two checks."`
+	Timeout        time.Duration `mapstructure:"timeout" description:"Timeout of a check."`
+	ExpectedStatus int           `mapstructure:"expectedStatus" description:"Status of a healthy application. Unset accepts any 2xx status."`
+}
+
+// CacheConfig configures the cache of the responses of a proxy, which
+// honors Cache-Control, ETag and Vary as a browser would. Entries are scoped
+// to the subject of the Access token, so they never leak between identities.
+type CacheConfig struct {
+	Enabled      bool   `mapstructure:"enabled" description:"Cache the responses of the application."`
+	MaxSize      int64  `mapstructure:"maxSize" description:"Bytes of responses kept, the least recently used being evicted."`
+	MaxEntrySize int64  `mapstructure:"maxEntrySize" description:"Largest response body in bytes cached."`
+	Dir          string `mapstructure:"dir" description:"Directory keeping the responses on disk, across restarts, instead of in memory."`
+}
+
+// CompressionConfig configures the compression of the responses of a proxy
+// with gzip, brotli or zstd, as accepted by the local clients.
+type CompressionConfig struct {
+	Enabled      bool     `mapstructure:"enabled" description:"Compress the responses served to the local clients."`
+	Encodings    []string `mapstructure:"encodings" description:"Codings offered to the local clients in order of preference: br, zstd and gzip."`
+	ContentTypes []string `mapstructure:"contentTypes" description:"Media types compressed, TYPE/* matching every subtype. Unset compresses text, JSON, JavaScript, XML, SVG and WebAssembly."`
+	MinSize      int64    `mapstructure:"minSize" description:"Smallest response body in bytes compressed, when its length is known."`
+}
+
+// ServerConfig holds the timeouts of the local listener of a proxy. Unset
+// values mean no timeout.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `mapstructure:"readTimeout" description:"Timeout of reading a whole request, including its body."`
+	ReadHeaderTimeout time.Duration `mapstructure:"readHeaderTimeout" description:"Timeout of reading the request headers."`
+	WriteTimeout      time.Duration `mapstructure:"writeTimeout" description:"Timeout of writing the response, from the end of the request headers."`
+	IdleTimeout       time.Duration `mapstructure:"idleTimeout" description:"Time an idle keep-alive connection is kept open."`
+}
+
+// HeaderRules are the headers changed in a request or response. Removals are
+// applied first, then set and add. Values are Go templates with the
+// variables .Name, .ClientIP, .TokenSubject and .TokenEmail.
+type HeaderRules struct {
+	Set    map[string]string `mapstructure:"set" description:"Headers set, replacing any existing value."`
+	Add    map[string]string `mapstructure:"add" description:"Headers added, keeping any existing value."`
+	Remove []string          `mapstructure:"remove" description:"Headers removed."`
+}
+
+// ProxyDefaults are the settings of the defaults block, inherited by every
+// proxy. The keys identifying a proxy are rejected by Validate.
+type ProxyDefaults ProxyConfig
+
+// ProbesConfig serves /healthz, answering while the tool runs, and /readyz,
+// answering 200 once every required proxy listens and holds unexpired tokens.
+type ProbesConfig struct {
+	Port        uint16 `mapstructure:"port" description:"Port of a dedicated listener of /healthz and /readyz. Disabled if unset."`
+	BindAddress string `mapstructure:"bindAddress" description:"Local address of the dedicated listener. Defaults to all interfaces."`
+	OnListeners bool   `mapstructure:"onListeners" description:"Also serve the probes at /__cloudflared-proxy/healthz and /__cloudflared-proxy/readyz on the port of every proxy."`
+}
+
+type TracingConfig struct {
+	Endpoint    string `mapstructure:"endpoint" description:"OTLP/HTTP collector endpoint, HOST:PORT or URL. Tracing is disabled if empty."`
+	Insecure    bool   `mapstructure:"insecure" description:"Use plain HTTP for HOST:PORT endpoints."`
+	ServiceName string `mapstructure:"serviceName" description:"Service name reported to the collector."`
 }
 
 type Config struct {
-	Proxies []ProxyConfig `mapstructure:"proxies"`
+	Defaults ProxyDefaults       `mapstructure:"defaults" description:"Settings inherited by every proxy unless overridden. Maps are merged key by key."`
+	Proxies  []ProxyConfig       `mapstructure:"proxies" description:"Proxies to start."`
+	Profiles map[string][]string `mapstructure:"profiles" description:"Named groups of proxy names, selected with run --profile."`
+	Tracing  TracingConfig       `mapstructure:"tracing" description:"OpenTelemetry tracing settings."`
+	Probes   ProbesConfig        `mapstructure:"probes" description:"Liveness and readiness probes of the tool, /healthz and /readyz."`
 }
 
-// Parses a string representation of a proxy endpoint
-// into a ProxyConfig struct. The format is [LOCAL_PORT:]HOSTNAME[:DEST_PORT].
+// Parses a string representation of a proxy endpoint into a ProxyConfig
+// struct. Two formats are accepted, the URL-like [[BIND:]LOCAL_PORT=]URL
+// described in parseEndpointURL, and the legacy [LOCAL_PORT:]HOSTNAME[:DEST_PORT].
 func ParseEndpointString(endpoint string) (*ProxyConfig, error) {
+	proxy, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.LocalPort == 0 {
+		proxy.LocalPort = DefaultLocalPort
+	}
+	return proxy, nil
+}
+
+// Parses an endpoint as ParseEndpointString, leaving the local port unset
+// if the endpoint has none.
+func parseEndpoint(endpoint string) (*ProxyConfig, error) {
 	if endpoint == "" {
-		return nil, fmt.Errorf("endpoint cannot be empty. Expected format: [LOCAL_PORT:]HOSTNAME[:DEST_PORT]")
+		return nil, fmt.Errorf("endpoint cannot be empty. Expected format: %s or %s", legacyEndpointFormat, EndpointFormat)
+	}
+	if strings.Contains(endpoint, "://") {
+		return parseEndpointURL(endpoint)
 	}
 
-	parts := strings.Split(endpoint, ":")
-	if len(parts) == 0 || len(parts) > 3 {
-		return nil, fmt.Errorf("invalid endpoint format '%s'. Expected format: [LOCAL_PORT:]HOSTNAME[:DEST_PORT]", endpoint)
+	parts, err := splitHostPorts(endpoint)
+	if err != nil || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid endpoint format '%s'. Expected format: %s or %s", endpoint, legacyEndpointFormat, EndpointFormat)
 	}
 
 	var hostname string
-	var localPort = DefaultLocalPort
+	var localPort uint16
 	var destPort = DefaultDestinationPort
 
 	switch len(parts) {
@@ -42,20 +209,21 @@ func ParseEndpointString(endpoint string) (*ProxyConfig, error) {
 		hostname = parts[0]
 	case 2: // Two parts could be either LOCAL_PORT:HOSTNAME or HOSTNAME:DEST_PORT
 		// Try to parse first part as local port
-		if _, err := fmt.Sscanf(parts[0], "%d", &localPort); err == nil {
+		if port, err := parsePort(parts[0]); err == nil {
+			localPort = port
 			hostname = parts[1]
 		} else { // Assume HOSTNAME:DEST_PORT
-			if _, err := fmt.Sscanf(parts[1], "%d", &destPort); err != nil {
+			if destPort, err = parsePort(parts[1]); err != nil {
 				return nil, fmt.Errorf("invalid destination port '%s': %v", parts[1], err)
 			}
 			hostname = parts[0]
 		}
 	case 3: // Full format: LOCAL_PORT:HOSTNAME:DEST_PORT
-		if _, err := fmt.Sscanf(parts[0], "%d", &localPort); err != nil {
+		if localPort, err = parsePort(parts[0]); err != nil {
 			return nil, fmt.Errorf("invalid local port '%s': %v", parts[0], err)
 		}
 		hostname = parts[1]
-		if _, err := fmt.Sscanf(parts[2], "%d", &destPort); err != nil {
+		if destPort, err = parsePort(parts[2]); err != nil {
 			return nil, fmt.Errorf("invalid destination port '%s': %v", parts[2], err)
 		}
 	}
@@ -63,6 +231,16 @@ func ParseEndpointString(endpoint string) (*ProxyConfig, error) {
 	if hostname == "" {
 		return nil, fmt.Errorf("hostname cannot be empty")
 	}
+	if ip, ok := strings.CutPrefix(hostname, "["); ok && strings.HasSuffix(ip, "]") {
+		// IPv6 addresses are bracketed to tell them apart from the ports.
+		hostname = strings.TrimSuffix(ip, "]")
+		if !strings.Contains(hostname, ":") || net.ParseIP(hostname) == nil {
+			return nil, fmt.Errorf("invalid IPv6 address '%s'", hostname)
+		}
+	}
+	if !isValidHostname(hostname) {
+		return nil, fmt.Errorf("invalid hostname '%s'", hostname)
+	}
 
 	return &ProxyConfig{
 		Hostname:        hostname,
@@ -73,7 +251,97 @@ func ParseEndpointString(endpoint string) (*ProxyConfig, error) {
 
 // Returns the full address of the target application.
 func (c *ProxyConfig) GetAddress() string {
-	return fmt.Sprintf("%s:%d", c.Hostname, c.DestinationPort)
+	return net.JoinHostPort(c.Hostname, strconv.Itoa(int(c.DestinationPort)))
+}
+
+// Returns the addresses of the hostname and upstreams of the application.
+func (c *ProxyConfig) GetAddresses() []string {
+	addresses := []string{c.GetAddress()}
+	for _, upstream := range c.Upstreams {
+		addresses = append(addresses, net.JoinHostPort(upstream, strconv.Itoa(int(c.DestinationPort))))
+	}
+	return addresses
+}
+
+// Returns the scheme used to reach the application, https unless set.
+func (c *ProxyConfig) GetScheme() string {
+	if c.Scheme != "" {
+		return c.Scheme
+	}
+	return DefaultScheme
+}
+
+// Returns the local address the proxy listens on.
+func (c *ProxyConfig) GetListenAddress() string {
+	return net.JoinHostPort(c.BindAddress, strconv.Itoa(int(c.LocalPort)))
+}
+
+// Returns the name of the proxy, falling back to its hostname when unnamed.
+func (c *ProxyConfig) GetName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Hostname
+}
+
+// Returns the proxies selected by a profile and/or a list of proxy names.
+// An empty profile selects every proxy, and an empty list of names does not
+// filter the selection further. Proxies keep the order of the config file.
+func (c *Config) SelectProxies(profile string, only []string) ([]ProxyConfig, error) {
+	selected := c.Proxies
+
+	if profile != "" {
+		var names []string
+		found := false
+		for p, members := range c.Profiles {
+			if strings.EqualFold(p, profile) {
+				names, found = members, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("profile '%s' not found", profile)
+		}
+		var err error
+		if selected, err = filterByName(selected, names); err != nil {
+			return nil, fmt.Errorf("profile '%s': %v", profile, err)
+		}
+	}
+
+	if len(only) > 0 {
+		var err error
+		if selected, err = filterByName(selected, only); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no proxies selected")
+	}
+	return selected, nil
+}
+
+// Returns the proxies whose name is in names, failing on unknown names.
+func filterByName(proxies []ProxyConfig, names []string) ([]ProxyConfig, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = false
+	}
+
+	var filtered []ProxyConfig
+	for _, proxy := range proxies {
+		if _, ok := wanted[proxy.GetName()]; ok {
+			wanted[proxy.GetName()] = true
+			filtered = append(filtered, proxy)
+		}
+	}
+
+	for _, name := range names {
+		if !wanted[name] {
+			return nil, fmt.Errorf("proxy '%s' not found", name)
+		}
+	}
+	return filtered, nil
 }
 
 // Sets the default values, if not provided, for the proxy configuration.
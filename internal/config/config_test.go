@@ -50,6 +50,49 @@ func TestParseEndpointString(t *testing.T) {
 				DestinationPort: 8443,
 			},
 		},
+		{
+			name:     "IP address and destination port",
+			endpoint: "10.0.0.1:8443",
+			expectedConfig: &ProxyConfig{
+				Hostname:        "10.0.0.1",
+				LocalPort:       DefaultLocalPort,
+				DestinationPort: 8443,
+			},
+		},
+		{
+			name:     "bracketed IPv6 address",
+			endpoint: "9000:[2001:db8::1]:8443",
+			expectedConfig: &ProxyConfig{
+				Hostname:        "2001:db8::1",
+				LocalPort:       9000,
+				DestinationPort: 8443,
+			},
+		},
+		{
+			name:     "URL format",
+			endpoint: "9000=https://myapp.example.com",
+			expectedConfig: &ProxyConfig{
+				Hostname:        "myapp.example.com",
+				LocalPort:       9000,
+				DestinationPort: DefaultDestinationPort,
+				Scheme:          "https",
+			},
+		},
+		{
+			name:        "local port with trailing characters",
+			endpoint:    "9000abc:host:123",
+			expectedErr: fmt.Errorf("invalid local port '9000abc'"),
+		},
+		{
+			name:        "unbracketed IPv6 address",
+			endpoint:    "2001:db8::1",
+			expectedErr: fmt.Errorf("invalid endpoint format '2001:db8::1'"),
+		},
+		{
+			name:        "invalid hostname",
+			endpoint:    "9000:my_app!",
+			expectedErr: fmt.Errorf("invalid hostname 'my_app!'"),
+		},
 		{
 			name:        "invalid format - too many parts",
 			endpoint:    "1:2:3:4",
@@ -95,6 +138,20 @@ func TestGetAddress(t *testing.T) {
 	}
 	expected := "app.example.com:8080"
 	assert.Equal(t, expected, config.GetAddress())
+
+	ipv6 := &ProxyConfig{Hostname: "2001:db8::1", DestinationPort: 443}
+	assert.Equal(t, "[2001:db8::1]:443", ipv6.GetAddress())
+}
+
+func TestGetAddresses(t *testing.T) {
+	config := &ProxyConfig{Hostname: "app-eu.example.com", Upstreams: []string{"app-us.example.com"}, DestinationPort: 443}
+	assert.Equal(t, []string{"app-eu.example.com:443", "app-us.example.com:443"}, config.GetAddresses())
+}
+
+func TestGetListenAddress(t *testing.T) {
+	assert.Equal(t, ":9000", (&ProxyConfig{LocalPort: 9000}).GetListenAddress())
+	assert.Equal(t, "127.0.0.1:9000", (&ProxyConfig{BindAddress: "127.0.0.1", LocalPort: 9000}).GetListenAddress())
+	assert.Equal(t, "[::1]:9000", (&ProxyConfig{BindAddress: "::1", LocalPort: 9000}).GetListenAddress())
 }
 
 func TestSetDefaults(t *testing.T) {
@@ -127,3 +184,89 @@ func TestSetDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestGetName(t *testing.T) {
+	assert.Equal(t, "grafana", (&ProxyConfig{Name: "grafana", Hostname: "grafana.example.com"}).GetName())
+	assert.Equal(t, "grafana.example.com", (&ProxyConfig{Hostname: "grafana.example.com"}).GetName())
+}
+
+func TestSelectProxies(t *testing.T) {
+	cfg := &Config{
+		Proxies: []ProxyConfig{
+			{Name: "grafana", Hostname: "grafana.example.com"},
+			{Name: "kibana", Hostname: "kibana.example.com"},
+			{Hostname: "jenkins.example.com"},
+		},
+		Profiles: map[string][]string{
+			"staging": {"kibana", "grafana"},
+			"broken":  {"missing"},
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		profile       string
+		only          []string
+		expectedNames []string
+		expectedErr   string
+	}{
+		{
+			name:          "no selection",
+			expectedNames: []string{"grafana", "kibana", "jenkins.example.com"},
+		},
+		{
+			name:          "profile keeps config order",
+			profile:       "staging",
+			expectedNames: []string{"grafana", "kibana"},
+		},
+		{
+			name:          "profile is case insensitive",
+			profile:       "Staging",
+			expectedNames: []string{"grafana", "kibana"},
+		},
+		{
+			name:          "only",
+			only:          []string{"jenkins.example.com"},
+			expectedNames: []string{"jenkins.example.com"},
+		},
+		{
+			name:          "profile and only",
+			profile:       "staging",
+			only:          []string{"kibana"},
+			expectedNames: []string{"kibana"},
+		},
+		{
+			name:        "unknown profile",
+			profile:     "prod",
+			expectedErr: "profile 'prod' not found",
+		},
+		{
+			name:        "profile with unknown proxy",
+			profile:     "broken",
+			expectedErr: "profile 'broken': proxy 'missing' not found",
+		},
+		{
+			name:        "only with proxy outside profile",
+			profile:     "staging",
+			only:        []string{"jenkins.example.com"},
+			expectedErr: "proxy 'jenkins.example.com' not found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := cfg.SelectProxies(tc.profile, tc.only)
+
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			names := make([]string, len(selected))
+			for i, proxy := range selected {
+				names[i] = proxy.GetName()
+			}
+			assert.Equal(t, tc.expectedNames, names)
+		})
+	}
+}
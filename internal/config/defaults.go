@@ -0,0 +1,56 @@
+package config
+
+import "maps"
+
+// Keys of a proxy that identify it and so cannot be inherited from defaults.
+var proxyOnlyKeys = []string{"name", "hostname", "upstreams", "localport"}
+
+// Returns the settings of every proxy completed with the defaults block, as
+// they would be decoded. Settings are expected to have lowercase keys.
+func inheritDefaults(settings map[string]any) map[string]any {
+	defaults, ok := settings["defaults"].(map[string]any)
+	proxies, isList := settings["proxies"].([]any)
+	if !ok || !isList {
+		return settings
+	}
+
+	defaults = maps.Clone(defaults)
+	for _, key := range proxyOnlyKeys {
+		// Reported by Validate, never inherited.
+		delete(defaults, key)
+	}
+
+	inherited := make([]any, len(proxies))
+	for i, p := range proxies {
+		proxy, ok := p.(map[string]any)
+		if !ok {
+			inherited[i] = p
+			continue
+		}
+		inherited[i] = mergeDefaults(defaults, proxy)
+	}
+
+	out := maps.Clone(settings)
+	out["proxies"] = inherited
+	return out
+}
+
+// Returns the values of proxy completed with those of defaults. Maps, such
+// as headers, are merged key by key with the proxy taking precedence. Any
+// other value set by the proxy, including lists, replaces the default.
+func mergeDefaults(defaults, proxy map[string]any) map[string]any {
+	out := maps.Clone(proxy)
+	for key, value := range defaults {
+		existing, set := out[key]
+		if !set {
+			out[key] = value
+			continue
+		}
+		if defaultMap, ok := value.(map[string]any); ok {
+			if proxyMap, ok := existing.(map[string]any); ok {
+				out[key] = mergeDefaults(defaultMap, proxyMap)
+			}
+		}
+	}
+	return out
+}
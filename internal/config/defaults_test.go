@@ -0,0 +1,107 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInheritDefaults(t *testing.T) {
+	testCases := []struct {
+		name     string
+		defaults map[string]any
+		proxy    map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "unset scalars are inherited",
+			defaults: map[string]any{"skiptls": true, "destinationport": 8443},
+			proxy:    map[string]any{"hostname": "app.example.com"},
+			expected: map[string]any{"hostname": "app.example.com", "skiptls": true, "destinationport": 8443},
+		},
+		{
+			name:     "set scalars are kept",
+			defaults: map[string]any{"skiptls": true},
+			proxy:    map[string]any{"hostname": "app.example.com", "skiptls": false},
+			expected: map[string]any{"hostname": "app.example.com", "skiptls": false},
+		},
+		{
+			name:     "maps are merged key by key",
+			defaults: map[string]any{"headers": map[string]any{"x-team": "platform", "x-env": "dev"}},
+			proxy:    map[string]any{"hostname": "app.example.com", "headers": map[string]any{"x-env": "prod"}},
+			expected: map[string]any{"hostname": "app.example.com", "headers": map[string]any{"x-team": "platform", "x-env": "prod"}},
+		},
+		{
+			name:     "lists are replaced",
+			defaults: map[string]any{"remove": []any{"cookie"}},
+			proxy:    map[string]any{"hostname": "app.example.com", "remove": []any{"x-debug"}},
+			expected: map[string]any{"hostname": "app.example.com", "remove": []any{"x-debug"}},
+		},
+		{
+			name:     "identifying keys are not inherited",
+			defaults: map[string]any{"name": "shared", "hostname": "shared.example.com", "localport": 9000},
+			proxy:    map[string]any{"hostname": "app.example.com"},
+			expected: map[string]any{"hostname": "app.example.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := map[string]any{"defaults": tc.defaults, "proxies": []any{tc.proxy}}
+
+			inherited := inheritDefaults(settings)
+
+			assert.Equal(t, []any{tc.expected}, inherited["proxies"])
+			assert.Equal(t, []any{tc.proxy}, settings["proxies"], "settings must not be modified")
+		})
+	}
+}
+
+func TestDecodeDefaults(t *testing.T) {
+	m := Merge(
+		Layer{Name: "global", Settings: map[string]any{
+			"defaults": map[string]any{
+				"skipTLS":         true,
+				"destinationPort": 8443,
+				"requestHeaders": map[string]any{
+					"set":    map[string]any{"X-Team": "platform", "X-Env": "dev"},
+					"remove": []any{"Cookie"},
+				},
+				"transport": map[string]any{"dialTimeout": "5s", "maxConnsPerHost": 10},
+			},
+			"proxies": []any{
+				map[string]any{"name": "grafana", "hostname": "grafana.example.com"},
+				map[string]any{"name": "kibana", "hostname": "kibana.example.com", "skipTLS": false, "requestHeaders": map[string]any{
+					"set":    map[string]any{"X-Env": "prod"},
+					"remove": []any{"X-Debug"},
+				}, "transport": map[string]any{"dialTimeout": "1m"}},
+			},
+		}},
+		Layer{Name: "project", Settings: map[string]any{
+			"defaults": map[string]any{"destinationPort": 9443},
+		}},
+	)
+
+	cfg, err := m.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, []ProxyConfig{
+		{Name: "grafana", Hostname: "grafana.example.com", DestinationPort: 9443, SkipTLS: true, RequestHeaders: HeaderRules{
+			Set:    map[string]string{"x-team": "platform", "x-env": "dev"},
+			Remove: []string{"Cookie"},
+		}, Transport: TransportConfig{DialTimeout: 5 * time.Second, MaxConnsPerHost: 10}},
+		{Name: "kibana", Hostname: "kibana.example.com", DestinationPort: 9443, SkipTLS: false, RequestHeaders: HeaderRules{
+			Set:    map[string]string{"x-team": "platform", "x-env": "prod"},
+			Remove: []string{"X-Debug"},
+		}, Transport: TransportConfig{DialTimeout: time.Minute, MaxConnsPerHost: 10}},
+	}, cfg.Proxies)
+	assert.Equal(t, uint16(9443), cfg.Defaults.DestinationPort)
+
+	assert.Equal(t, "global (defaults)", m.Source("proxies[grafana].skipTLS"))
+	assert.Equal(t, "project (defaults)", m.Source("proxies[grafana].destinationPort"))
+	assert.Equal(t, "global", m.Source("proxies[kibana].skipTLS"))
+	assert.Equal(t, "global (defaults)", m.Source("proxies[kibana].requestHeaders.set.x-team"))
+	assert.Equal(t, "global", m.Source("proxies[kibana].requestHeaders.set.x-env"))
+	assert.Equal(t, "default", m.Source("proxies[grafana].localPort"))
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+const (
+	// EndpointFormat is the URL-like endpoint format, e.g.
+	// 127.0.0.1:9000=https://app.example.com:8443/base?skipTLS=true&name=app
+	EndpointFormat       = "[[BIND:]LOCAL_PORT=]SCHEME://HOSTNAME[:DEST_PORT][/PATH][?OPTION=VALUE&...]"
+	legacyEndpointFormat = "[LOCAL_PORT:]HOSTNAME[:DEST_PORT]"
+)
+
+// Keys of a proxy given by the address of an endpoint, not by its options.
+var endpointAddressKeys = []string{"hostname", "localport", "destinationport", "bindaddress", "scheme", "upstreampath"}
+
+// Parses an endpoint in EndpointFormat. The options of the query string are
+// the keys of a proxy in the config file, case-insensitive, list values
+// being comma-separated.
+func parseEndpointURL(endpoint string) (*ProxyConfig, error) {
+	proxy := &ProxyConfig{DestinationPort: DefaultDestinationPort}
+
+	target := endpoint
+	scheme := strings.Index(endpoint, "://")
+	if i := strings.LastIndex(endpoint[:scheme], "="); i != -1 {
+		listen := endpoint[:i]
+		target = endpoint[i+1:]
+
+		port := listen
+		if strings.Contains(listen, ":") {
+			var err error
+			if proxy.BindAddress, port, err = net.SplitHostPort(listen); err != nil {
+				return nil, fmt.Errorf("invalid listen address '%s': %v", listen, err)
+			}
+			if proxy.BindAddress != "" && !isValidHostname(proxy.BindAddress) {
+				return nil, fmt.Errorf("invalid bind address '%s'", proxy.BindAddress)
+			}
+		}
+		var err error
+		if proxy.LocalPort, err = parsePort(port); err != nil {
+			return nil, fmt.Errorf("invalid local port '%s': %v", port, err)
+		}
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint '%s': %v", endpoint, err)
+	}
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return nil, fmt.Errorf("unsupported scheme '%s', expected https or http", u.Scheme)
+	case u.User != nil:
+		return nil, fmt.Errorf("credentials are not supported in endpoint '%s'", endpoint)
+	case u.Fragment != "" || strings.Contains(target, "#"):
+		return nil, fmt.Errorf("fragments are not supported in endpoint '%s'", endpoint)
+	}
+	proxy.Scheme = u.Scheme
+
+	proxy.Hostname = u.Hostname()
+	if proxy.Hostname == "" {
+		return nil, fmt.Errorf("hostname cannot be empty")
+	}
+	if !isValidHostname(proxy.Hostname) {
+		return nil, fmt.Errorf("invalid hostname '%s'", proxy.Hostname)
+	}
+	if port := u.Port(); port != "" {
+		if proxy.DestinationPort, err = parsePort(port); err != nil {
+			return nil, fmt.Errorf("invalid destination port '%s': %v", port, err)
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return nil, fmt.Errorf("invalid destination port '': port cannot be empty")
+	}
+
+	if u.Path != "/" {
+		proxy.UpstreamPath = u.Path
+	}
+
+	if err := decodeEndpointOptions(u.RawQuery, proxy); err != nil {
+		return nil, fmt.Errorf("invalid endpoint options '%s': %v", u.RawQuery, err)
+	}
+	return proxy, nil
+}
+
+// Decodes the query string of an endpoint into proxy.
+func decodeEndpointOptions(query string, proxy *ProxyConfig) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	keys := endpointOptionKeys()
+	options := make(map[string]any, len(values))
+	for key, value := range values {
+		if slices.Contains(endpointAddressKeys, strings.ToLower(key)) {
+			return fmt.Errorf("'%s' is set by the address of the endpoint", key)
+		}
+		if _, ok := keys[strings.ToLower(key)]; !ok {
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+		if len(value) > 1 {
+			return fmt.Errorf("option '%s' is given more than once", key)
+		}
+		options[keys[strings.ToLower(key)]] = value[0]
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           proxy,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(options); err != nil {
+		// Drop the summary line of mapstructure.
+		if unwrapped := errors.Unwrap(err); unwrapped != nil {
+			err = unwrapped
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns the keys of the proxy settings that can be given as endpoint
+// options, keyed by their lowercase form. Maps and structs cannot be
+// expressed as a single value and are left out.
+func endpointOptionKeys() map[string]string {
+	keys := make(map[string]string)
+	t := reflect.TypeOf(ProxyConfig{})
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "-" || !field.IsExported() || slices.Contains(endpointAddressKeys, strings.ToLower(key)) {
+			continue
+		}
+		kind := field.Type.Kind()
+		if kind == reflect.Slice {
+			kind = field.Type.Elem().Kind()
+		}
+		if kind == reflect.Map || kind == reflect.Struct || kind == reflect.Pointer || kind == reflect.Slice {
+			continue
+		}
+		keys[strings.ToLower(key)] = key
+	}
+	return keys
+}
+
+// Returns the endpoint of a proxy in EndpointFormat, so that it can be
+// parsed back with ParseEndpointString. Unset ports are given their default.
+func FormatEndpoint(proxy ProxyConfig) string {
+	localPort, destPort := proxy.LocalPort, proxy.DestinationPort
+	if localPort == 0 {
+		localPort = DefaultLocalPort
+	}
+	if destPort == 0 {
+		destPort = DefaultDestinationPort
+	}
+
+	listen := strconv.Itoa(int(localPort))
+	if proxy.BindAddress != "" {
+		listen = net.JoinHostPort(proxy.BindAddress, listen)
+	}
+
+	options := url.Values{}
+	keys := endpointOptionKeys()
+	v := reflect.ValueOf(proxy)
+	for i := range v.NumField() {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("mapstructure"), ",")
+		if _, ok := keys[strings.ToLower(key)]; !ok || v.Field(i).IsZero() {
+			continue
+		}
+		options.Set(key, optionValue(v.Field(i)))
+	}
+
+	u := url.URL{
+		Scheme:   proxy.GetScheme(),
+		Host:     net.JoinHostPort(proxy.Hostname, strconv.Itoa(int(destPort))),
+		Path:     proxy.UpstreamPath,
+		RawQuery: options.Encode(),
+	}
+	return listen + "=" + u.String()
+}
+
+// Parses the endpoints given together on the command line. Endpoints without
+// a local port get the first free port from DefaultLocalPort on, and unnamed
+// endpoints to a hostname already used are named after their local port too,
+// so that several endpoints can be given without spelling these out.
+func ParseEndpoints(endpoints []string) ([]ProxyConfig, error) {
+	proxies := make([]ProxyConfig, len(endpoints))
+	ports := make(map[uint16]bool)
+	for i, endpoint := range endpoints {
+		proxy, err := parseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		proxies[i] = *proxy
+		ports[proxy.LocalPort] = true
+	}
+
+	port := DefaultLocalPort
+	names := make(map[string]bool)
+	for i := range proxies {
+		proxy := &proxies[i]
+		if proxy.LocalPort == 0 {
+			for ports[port] {
+				if port == math.MaxUint16 {
+					return nil, fmt.Errorf("no free local port left for endpoint '%s'", endpoints[i])
+				}
+				port++
+			}
+			proxy.LocalPort = port
+			ports[port] = true
+		}
+		if proxy.Name == "" && names[proxy.GetName()] {
+			proxy.Name = fmt.Sprintf("%s-%d", proxy.Hostname, proxy.LocalPort)
+		}
+		names[proxy.GetName()] = true
+	}
+	return proxies, nil
+}
+
+// Returns the endpoint option value of a scalar or a list of scalars.
+func optionValue(v reflect.Value) string {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return v.Interface().(time.Duration).String()
+	case v.Kind() == reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range v.Len() {
+			items[i] = optionValue(v.Index(i))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// Splits a legacy endpoint on the colons outside of brackets, so that IPv6
+// addresses can be given as [::1].
+func splitHostPorts(endpoint string) ([]string, error) {
+	var parts []string
+	start, depth := 0, 0
+	for i, c := range endpoint {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, endpoint[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("unbalanced brackets")
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced brackets")
+	}
+	return append(parts, endpoint[start:]), nil
+}
+
+// Parses a port number, rejecting anything but digits and port 0.
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("port cannot be 0")
+	}
+	return uint16(port), nil
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+// InitTemplate is the commented config file written by `config init`.
+//
+//go:embed init.yaml
+var InitTemplate []byte
+
+// Returns the directory searched for the default config file.
+func DefaultConfigDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "cloudflared-proxy"), nil
+}
+
+// File is a YAML config file edited in place. Comments and the order of
+// keys and proxies are preserved when it is saved, blank lines may not be.
+type File struct {
+	Path string
+	root yaml.Node
+}
+
+// Reads and parses a YAML config file.
+func LoadFile(path string) (*File, error) {
+	if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("only YAML config files can be edited, got '%s'", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{Path: path}
+	if err := yaml.Unmarshal(data, &f.root); err != nil {
+		return nil, fmt.Errorf("unable to parse %s, %v", path, err)
+	}
+	if f.root.Kind == 0 {
+		// Empty file, start from an empty document.
+		f.root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if f.root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid config file %s: expected a mapping at the top level", path)
+	}
+	return f, nil
+}
+
+// Writes the file back to disk.
+func (f *File) Save() error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&f.root); err != nil {
+		return fmt.Errorf("unable to encode %s, %v", f.Path, err)
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, buf.Bytes(), 0o644)
+}
+
+// Decodes the file into a Config, rejecting unknown keys. The defaults block
+// is inherited, the hardcoded defaults are not applied.
+func (f *File) Config() (*Config, error) {
+	data, err := yaml.Marshal(&f.root)
+	if err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	cfg, err := Merge(Layer{Name: f.Path, Settings: v.AllSettings()}).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode into struct, %v", err)
+	}
+	return cfg, nil
+}
+
+// Appends a proxy to the file after checking that the result is valid.
+func (f *File) AddProxy(proxy ProxyConfig) error {
+	cfg, err := f.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Proxies = append(cfg.Proxies, proxy)
+	SetDefaults(cfg.Proxies)
+	if err := Validate(cfg); err != nil {
+		return err
+	}
+
+	proxies := f.proxiesNode()
+	// An empty list is usually written in flow style, `proxies: []`.
+	proxies.Style = 0
+	proxies.Content = append(proxies.Content, proxyNode(proxy))
+	return nil
+}
+
+// Removes the proxy with the given name or local port, along with its
+// references in profiles and the profiles left empty, and returns it.
+func (f *File) RemoveProxy(nameOrPort string) (*ProxyConfig, error) {
+	cfg, err := f.Config()
+	if err != nil {
+		return nil, err
+	}
+	SetDefaults(cfg.Proxies)
+
+	index := -1
+	for i, proxy := range cfg.Proxies {
+		if proxy.GetName() == nameOrPort || strconv.Itoa(int(proxy.LocalPort)) == nameOrPort {
+			if index != -1 {
+				return nil, fmt.Errorf("'%s' matches more than one proxy", nameOrPort)
+			}
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("proxy '%s' not found", nameOrPort)
+	}
+	removed := cfg.Proxies[index]
+
+	proxies := f.proxiesNode()
+	proxies.Content = append(proxies.Content[:index], proxies.Content[index+1:]...)
+
+	if profiles := mappingValue(f.root.Content[0], "profiles"); profiles != nil && profiles.Kind == yaml.MappingNode {
+		keptProfiles := profiles.Content[:0]
+		for i := 0; i+1 < len(profiles.Content); i += 2 {
+			members := profiles.Content[i+1]
+			kept := members.Content[:0]
+			for _, member := range members.Content {
+				if member.Value != removed.GetName() {
+					kept = append(kept, member)
+				}
+			}
+			members.Content = kept
+			// A profile without proxies is invalid, it goes with its last one.
+			if len(kept) > 0 {
+				keptProfiles = append(keptProfiles, profiles.Content[i], members)
+			}
+		}
+		profiles.Content = keptProfiles
+	}
+
+	return &removed, nil
+}
+
+// Returns the proxies sequence node, creating it if missing.
+func (f *File) proxiesNode() *yaml.Node {
+	doc := f.root.Content[0]
+	if node := mappingValue(doc, "proxies"); node != nil {
+		return node
+	}
+	node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	doc.Content = append([]*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: "proxies"}, node}, doc.Content...)
+	return node
+}
+
+// Returns the value node of key in a mapping node, or nil if missing.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Returns the YAML node of a proxy, omitting unset optional keys.
+func proxyNode(proxy ProxyConfig) *yaml.Node {
+	return structNode(reflect.ValueOf(proxy))
+}
+
+// Returns a mapping node of a struct keyed by its mapstructure tags, in field
+// order and omitting zero values.
+func structNode(v reflect.Value) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+		key, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "-" || !field.IsExported() || value.IsZero() {
+			continue
+		}
+		if strings.Contains(opts, "squash") {
+			node.Content = append(node.Content, structNode(value).Content...)
+			continue
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, valueNode(value))
+	}
+	return node
+}
+
+// Returns the node of a config value, encoding nested structs with structNode.
+func valueNode(v reflect.Value) *yaml.Node {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.Interface().(time.Duration).String()}
+	case v.Kind() == reflect.Pointer:
+		return valueNode(v.Elem())
+	case v.Kind() == reflect.Struct:
+		return structNode(v)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for i := range v.Len() {
+			node.Content = append(node.Content, valueNode(v.Index(i)))
+		}
+		return node
+	case v.Kind() == reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		for _, key := range keys {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.String()}, valueNode(v.MapIndex(key)))
+		}
+		return node
+	default:
+		node := &yaml.Node{}
+		if err := node.Encode(v.Interface()); err != nil {
+			panic(fmt.Sprintf("unable to encode %s: %v", v.Type(), err))
+		}
+		return node
+	}
+}
+
+// Writes InitTemplate to path, creating its directory. Existing files are
+// only replaced if overwrite is set.
+func WriteInitFile(path string, overwrite bool) error {
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		return fmt.Errorf("config file %s already exists", path)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, InitTemplate, 0o644)
+}
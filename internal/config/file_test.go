@@ -0,0 +1,209 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigFile = `# Top comment
+proxies:
+  # Grafana comment
+  - name: grafana
+    hostname: grafana.example.com
+    localPort: 9000
+  # Kibana comment
+  - hostname: kibana.example.com
+
+# Profiles comment
+profiles:
+  staging: [grafana, kibana.example.com]
+`
+
+func writeTestFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestFileAddProxy(t *testing.T) {
+	t.Run("appends and preserves comments", func(t *testing.T) {
+		path := writeTestFile(t, testConfigFile)
+		f, err := LoadFile(path)
+		require.NoError(t, err)
+
+		require.NoError(t, f.AddProxy(ProxyConfig{Name: "jenkins", Hostname: "jenkins.example.com", LocalPort: 9001, DestinationPort: 443, SkipTLS: true}))
+		require.NoError(t, f.Save())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, `# Top comment
+proxies:
+  # Grafana comment
+  - name: grafana
+    hostname: grafana.example.com
+    localPort: 9000
+  # Kibana comment
+  - hostname: kibana.example.com
+  - name: jenkins
+    hostname: jenkins.example.com
+    localPort: 9001
+    destinationPort: 443
+    skipTLS: true
+# Profiles comment
+profiles:
+  staging: [grafana, kibana.example.com]
+`, string(data))
+	})
+
+	t.Run("empty flow list", func(t *testing.T) {
+		path := writeTestFile(t, "# Proxies\nproxies: []\n")
+		f, err := LoadFile(path)
+		require.NoError(t, err)
+
+		require.NoError(t, f.AddProxy(ProxyConfig{Hostname: "app.example.com", LocalPort: 8888, DestinationPort: 443}))
+		require.NoError(t, f.Save())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "# Proxies\nproxies:\n  - hostname: app.example.com\n    localPort: 8888\n    destinationPort: 443\n", string(data))
+	})
+
+	t.Run("rejects duplicate port", func(t *testing.T) {
+		f, err := LoadFile(writeTestFile(t, testConfigFile))
+		require.NoError(t, err)
+
+		err = f.AddProxy(ProxyConfig{Hostname: "other.example.com", LocalPort: 9000, DestinationPort: 443})
+		assert.EqualError(t, err, "proxies[2].localPort: duplicate port 9000, already used by proxies[0](grafana)")
+	})
+}
+
+func TestFileRemoveProxy(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       string // Defaults to testConfigFile
+		nameOrPort   string
+		expectedName string
+		expectedErr  string
+		expectedFile string
+	}{
+		{
+			name:         "by name",
+			nameOrPort:   "grafana",
+			expectedName: "grafana",
+			expectedFile: `# Top comment
+proxies:
+  # Kibana comment
+  - hostname: kibana.example.com
+# Profiles comment
+profiles:
+  staging: [kibana.example.com]
+`,
+		},
+		{
+			name:         "by default port",
+			nameOrPort:   "8888",
+			expectedName: "kibana.example.com",
+			expectedFile: `# Top comment
+proxies:
+  # Grafana comment
+  - name: grafana
+    hostname: grafana.example.com
+    localPort: 9000
+# Profiles comment
+profiles:
+  staging: [grafana]
+`,
+		},
+		{
+			name: "last member of a profile",
+			config: `proxies:
+  - name: grafana
+    hostname: grafana.example.com
+  - name: kibana
+    hostname: kibana.example.com
+    localPort: 9000
+profiles:
+  staging: [grafana]
+  all: [grafana, kibana]
+`,
+			nameOrPort:   "grafana",
+			expectedName: "grafana",
+			expectedFile: `proxies:
+  - name: kibana
+    hostname: kibana.example.com
+    localPort: 9000
+profiles:
+  all: [kibana]
+`,
+		},
+		{
+			name:        "not found",
+			nameOrPort:  "jenkins",
+			expectedErr: "proxy 'jenkins' not found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			if config == "" {
+				config = testConfigFile
+			}
+			path := writeTestFile(t, config)
+			f, err := LoadFile(path)
+			require.NoError(t, err)
+
+			removed, err := f.RemoveProxy(tc.nameOrPort)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedName, removed.GetName())
+
+			require.NoError(t, f.Save())
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedFile, string(data))
+
+			cfg, err := f.Config()
+			require.NoError(t, err)
+			SetDefaults(cfg.Proxies)
+			assert.NoError(t, Validate(cfg))
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	_, err := LoadFile(filepath.Join(t.TempDir(), "config.json"))
+	assert.ErrorContains(t, err, "only YAML config files can be edited")
+
+	f, err := LoadFile(writeTestFile(t, ""))
+	require.NoError(t, err)
+	require.NoError(t, f.AddProxy(ProxyConfig{Hostname: "app.example.com"}))
+	cfg, err := f.Config()
+	require.NoError(t, err)
+	assert.Equal(t, []ProxyConfig{{Hostname: "app.example.com"}}, cfg.Proxies)
+}
+
+func TestWriteInitFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "config.yaml")
+	require.NoError(t, WriteInitFile(path, false))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, InitTemplate, data)
+
+	assert.EqualError(t, WriteInitFile(path, false), "config file "+path+" already exists")
+	assert.NoError(t, WriteInitFile(path, true))
+
+	f, err := LoadFile(path)
+	require.NoError(t, err)
+	cfg, err := f.Config()
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Proxies)
+}
@@ -0,0 +1,484 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables overriding settings.
+	EnvPrefix = "CFPROXY_"
+	// ProjectFileName is the project-local config file, looked up from the
+	// working directory towards the filesystem root.
+	ProjectFileName = ".cloudflared-proxy.yaml"
+)
+
+const sourceDefault = "default"
+
+// Layer is a source of settings, keyed as in the config file.
+type Layer struct {
+	// Name describes the source in the output of `config show`.
+	Name     string
+	Settings map[string]any
+	// Replace lists the top-level keys replacing, instead of being merged
+	// with, the settings of the previous layers.
+	Replace []string
+}
+
+// Merged holds the settings of several layers merged in order, with the
+// layer each value comes from.
+type Merged struct {
+	Settings map[string]any
+	// Sources maps the lowercase path of each value, e.g.
+	// proxies[grafana].localport, to the name of its layer.
+	Sources map[string]string
+}
+
+// Merges layers in order, later layers taking precedence. Maps are merged
+// key by key and proxies are merged by name, falling back to the hostname
+// for unnamed proxies. Other values, including lists, are replaced.
+func Merge(layers ...Layer) *Merged {
+	m := &Merged{Settings: make(map[string]any), Sources: make(map[string]string)}
+	for _, layer := range layers {
+		settings := lowerKeys(layer.Settings).(map[string]any)
+		for _, key := range layer.Replace {
+			key = strings.ToLower(key)
+			if _, ok := settings[key]; ok {
+				delete(m.Settings, key)
+				m.forgetSources(key)
+			}
+		}
+		m.mergeMap(m.Settings, settings, "", layer.Name)
+	}
+	return m
+}
+
+func (m *Merged) mergeMap(dst, src map[string]any, path, source string) {
+	for key, value := range src {
+		keyPath := joinPath(path, key)
+		switch v := value.(type) {
+		case map[string]any:
+			existing, ok := dst[key].(map[string]any)
+			if !ok {
+				existing = make(map[string]any)
+				m.forgetSources(keyPath)
+				dst[key] = existing
+			}
+			m.mergeMap(existing, v, keyPath, source)
+		case []any:
+			if keyPath == "proxies" {
+				existing, _ := dst[key].([]any)
+				dst[key] = m.mergeProxies(existing, v, source)
+				continue
+			}
+			m.forgetSources(keyPath)
+			dst[key] = v
+			m.Sources[keyPath] = source
+		default:
+			m.forgetSources(keyPath)
+			dst[key] = v
+			m.Sources[keyPath] = source
+		}
+	}
+}
+
+func (m *Merged) mergeProxies(dst, src []any, source string) []any {
+	for _, value := range src {
+		proxy, ok := value.(map[string]any)
+		if !ok {
+			// Left for the decoder to report.
+			dst = append(dst, value)
+			continue
+		}
+
+		id := proxyIdentity(proxy)
+		var target map[string]any
+		for _, existing := range dst {
+			if e, ok := existing.(map[string]any); ok && id != "" && proxyIdentity(e) == id {
+				target = e
+				break
+			}
+		}
+		if target == nil {
+			target = make(map[string]any)
+			dst = append(dst, target)
+		} else {
+			// The key identifying the proxy is not overridden.
+			proxy = maps.Clone(proxy)
+			if _, named := proxy["name"]; named {
+				delete(proxy, "name")
+			} else {
+				delete(proxy, "hostname")
+			}
+		}
+		m.mergeMap(target, proxy, fmt.Sprintf("proxies[%s]", id), source)
+	}
+	return dst
+}
+
+// Removes the sources of path and of every path below it.
+func (m *Merged) forgetSources(path string) {
+	for p := range m.Sources {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(p, path+"[") {
+			delete(m.Sources, p)
+		}
+	}
+}
+
+// Returns the name of the layer a value comes from, or "default".
+// Values of a proxy inherited from the defaults block report the source of
+// the default value.
+func (m *Merged) Source(path string) string {
+	path = strings.ToLower(path)
+	if source, ok := m.Sources[path]; ok {
+		return source
+	}
+	if strings.HasPrefix(path, "proxies[") {
+		if _, key, ok := strings.Cut(path, "]."); ok {
+			if source, ok := m.Sources["defaults."+key]; ok {
+				return source + " (defaults)"
+			}
+		}
+	}
+	return sourceDefault
+}
+
+// Decodes the merged settings into a Config, rejecting unknown keys. The
+// values of the defaults block are inherited by the proxies, the hardcoded
+// defaults of SetDefaults are not applied.
+func (m *Merged) Decode() (*Config, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(inheritDefaults(m.Settings)); err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := v.UnmarshalExact(&cfg); err != nil {
+		return &cfg, err
+	}
+	return &cfg, nil
+}
+
+// Returns the YAML representation of cfg, annotated with the source of each
+// value. cfg is expected to be decoded from m.
+func (m *Merged) Annotate(cfg *Config) *yaml.Node {
+	node := structNode(reflect.ValueOf(*cfg))
+	m.annotate(node, "")
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}
+}
+
+func (m *Merged) annotate(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, strings.ToLower(key.Value))
+			switch {
+			case value.Kind == yaml.ScalarNode:
+				value.LineComment = m.Source(keyPath)
+				continue
+			case value.Kind == yaml.SequenceNode && keyPath != "proxies":
+				// Comments of block sequences are only written on their key.
+				key.LineComment = m.Source(keyPath)
+				continue
+			}
+			m.annotate(value, keyPath)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			var proxy map[string]any
+			if err := item.Decode(&proxy); err != nil {
+				continue
+			}
+			m.annotate(item, fmt.Sprintf("%s[%s]", path, proxyIdentity(lowerKeys(proxy).(map[string]any))))
+		}
+	}
+}
+
+// Returns the name of a proxy in raw settings, or its hostname if unnamed,
+// in lower case as the paths of the sources.
+func proxyIdentity(proxy map[string]any) string {
+	if name, ok := proxy["name"].(string); ok && name != "" {
+		return strings.ToLower(name)
+	}
+	if hostname, ok := proxy["hostname"].(string); ok {
+		return strings.ToLower(hostname)
+	}
+	return ""
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Returns a copy of settings with every map key lowercased, matching the
+// case-insensitive decoding of the config file.
+func lowerKeys(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, val := range v {
+			out[strings.ToLower(key)] = lowerKeys(val)
+		}
+		return out
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for key, val := range v {
+			out[strings.ToLower(fmt.Sprint(key))] = lowerKeys(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = lowerKeys(val)
+		}
+		return out
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = lowerKeys(val)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// Reads a config file in any format supported by viper into a layer.
+func FileLayer(name, path string) (Layer, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return Layer{}, fmt.Errorf("unable to read config file %s, %v", path, err)
+	}
+	return Layer{Name: fmt.Sprintf("%s %s", name, path), Settings: v.AllSettings()}, nil
+}
+
+// Returns the settings of a proxy as a layer would hold them.
+func ProxySettings(proxy ProxyConfig) map[string]any {
+	var settings map[string]any
+	if err := proxyNode(proxy).Decode(&settings); err != nil {
+		panic(fmt.Sprintf("unable to encode proxy %s: %v", proxy.GetName(), err))
+	}
+	return settings
+}
+
+// Returns the path of the project config file found in dir or its closest
+// parent, or an empty string if there is none.
+func FindProjectFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, ProjectFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Returns the layer of the CFPROXY_* variables of environ, given the
+// settings of the previous layers. Variable names are the path of a setting
+// in upper case, with underscores between keys, optionally inside words:
+//
+//	CFPROXY_TRACING_ENDPOINT=localhost:4318
+//	CFPROXY_TRACING_SERVICE_NAME=my-proxy
+//	CFPROXY_PROXY_<NAME>_LOCAL_PORT=9000
+//
+// where <NAME> is the name or hostname of a proxy of the previous layers,
+// in upper case and with every other character replaced by an underscore.
+func EnvLayer(environ []string, base *Merged) (Layer, error) {
+	layer := Layer{Name: "environment", Settings: make(map[string]any)}
+
+	// Identities of the known proxies, and whether they are names.
+	var proxies []string
+	named := make(map[string]bool)
+	if list, ok := base.Settings["proxies"].([]any); ok {
+		for _, p := range list {
+			if proxy, ok := p.(map[string]any); ok {
+				id := proxyIdentity(proxy)
+				proxies = append(proxies, id)
+				named[id] = proxy["name"] != nil && proxy["name"] != ""
+			}
+		}
+	}
+
+	var errs []error
+	for _, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		words := strings.Split(strings.ToLower(strings.TrimPrefix(name, EnvPrefix)), "_")
+
+		if len(words) > 1 && words[0] == "proxy" {
+			id, keys, t, ok := matchProxyEnv(words[1:], proxies)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown proxy or setting", name))
+				continue
+			}
+			parsed, err := parseEnvValue(value, t)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				continue
+			}
+			setProxyEnv(layer.Settings, id, named[id], keys, parsed)
+			continue
+		}
+
+		keys, t, ok := matchEnvPath(reflect.TypeOf(Config{}), words)
+		if !ok || t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", name))
+			continue
+		}
+		parsed, err := parseEnvValue(value, t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		setPath(layer.Settings, keys, parsed)
+	}
+
+	return layer, errors.Join(errs...)
+}
+
+// Splits the words following PROXY into a known proxy and a setting path.
+func matchProxyEnv(words []string, proxies []string) (string, []string, reflect.Type, bool) {
+	for _, id := range proxies {
+		idWords := strings.Split(envWord(id), "_")
+		if len(words) <= len(idWords) || strings.Join(words[:len(idWords)], "_") != strings.Join(idWords, "_") {
+			continue
+		}
+		if keys, t, ok := matchEnvPath(reflect.TypeOf(ProxyConfig{}), words[len(idWords):]); ok {
+			return id, keys, t, true
+		}
+	}
+	return "", nil, nil, false
+}
+
+// Returns s in lower case with every character other than letters and
+// digits replaced by an underscore.
+func envWord(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(s))
+}
+
+// Resolves lowercase words against the mapstructure keys of struct t,
+// returning the key path and the type of the setting.
+func matchEnvPath(t reflect.Type, words []string) ([]string, reflect.Type, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if len(words) == 0 {
+		return nil, t, true
+	}
+	if t.Kind() == reflect.Map && t.Key().Kind() == reflect.String {
+		// Map keys are taken verbatim, as a single word.
+		keys, vt, ok := matchEnvPath(t.Elem(), words[1:])
+		return append([]string{words[0]}, keys...), vt, ok
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil, false
+	}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "-" || !field.IsExported() {
+			continue
+		}
+		if strings.Contains(opts, "squash") {
+			if keys, vt, ok := matchEnvPath(field.Type, words); ok {
+				return keys, vt, true
+			}
+			continue
+		}
+		for n := 1; n <= len(words); n++ {
+			if strings.Join(words[:n], "") != strings.ToLower(key) {
+				continue
+			}
+			if keys, vt, ok := matchEnvPath(field.Type, words[n:]); ok {
+				return append([]string{key}, keys...), vt, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// Parses an environment value for a setting of type t. Lists are comma
+// separated, other values are left to the decoder.
+func parseEnvValue(value string, t reflect.Type) (any, error) {
+	switch t.Kind() {
+	case reflect.Slice:
+		var list []any
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid boolean '%s'", value)
+		}
+	case reflect.Struct, reflect.Map:
+		return nil, fmt.Errorf("not a single value")
+	}
+	return value, nil
+}
+
+func setPath(settings map[string]any, keys []string, value any) {
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := settings[key].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			settings[key] = next
+		}
+		settings = next
+	}
+	settings[keys[len(keys)-1]] = value
+}
+
+// Sets a setting of the proxy identified by id, adding the proxy to the
+// settings if needed.
+func setProxyEnv(settings map[string]any, id string, named bool, keys []string, value any) {
+	list, _ := settings["proxies"].([]any)
+	for _, p := range list {
+		if proxy := p.(map[string]any); proxyIdentity(proxy) == id {
+			setPath(proxy, keys, value)
+			return
+		}
+	}
+
+	proxy := map[string]any{"hostname": id}
+	if named {
+		proxy = map[string]any{"name": id}
+	}
+	setPath(proxy, keys, value)
+	settings["proxies"] = append(list, proxy)
+}
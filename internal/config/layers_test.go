@@ -0,0 +1,203 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestMerge(t *testing.T) {
+	global := Layer{Name: "global", Settings: map[string]any{
+		"proxies": []any{
+			map[string]any{"name": "grafana", "hostname": "grafana.example.com", "localPort": 9000},
+			map[string]any{"hostname": "kibana.example.com"},
+		},
+		"profiles": map[string]any{"staging": []any{"grafana"}},
+		"tracing":  map[string]any{"endpoint": "localhost:4318", "insecure": true},
+	}}
+	project := Layer{Name: "project", Settings: map[string]any{
+		"proxies": []any{
+			map[string]any{"name": "grafana", "localport": 9100},
+			map[string]any{"hostname": "kibana.example.com", "skipTLS": true},
+			map[string]any{"name": "jenkins", "hostname": "jenkins.example.com"},
+		},
+		"profiles": map[string]any{"staging": []any{"jenkins"}},
+	}}
+	env := Layer{Name: "env", Settings: map[string]any{
+		"tracing": map[string]any{"endpoint": "collector:4318"},
+	}}
+
+	m := Merge(global, project, env)
+
+	cfg, err := m.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, []ProxyConfig{
+		{Name: "grafana", Hostname: "grafana.example.com", LocalPort: 9100},
+		{Hostname: "kibana.example.com", SkipTLS: true},
+		{Name: "jenkins", Hostname: "jenkins.example.com"},
+	}, cfg.Proxies)
+	assert.Equal(t, map[string][]string{"staging": {"jenkins"}}, cfg.Profiles)
+	assert.Equal(t, TracingConfig{Endpoint: "collector:4318", Insecure: true}, cfg.Tracing)
+
+	assert.Equal(t, "global", m.Source("proxies[grafana].hostname"))
+	assert.Equal(t, "global", m.Source("proxies[grafana].name"))
+	assert.Equal(t, "project", m.Source("proxies[grafana].localPort"))
+	assert.Equal(t, "global", m.Source("proxies[kibana.example.com].hostname"))
+	assert.Equal(t, "project", m.Source("proxies[kibana.example.com].skipTLS"))
+	assert.Equal(t, "project", m.Source("profiles.staging"))
+	assert.Equal(t, "env", m.Source("tracing.endpoint"))
+	assert.Equal(t, "global", m.Source("tracing.insecure"))
+	assert.Equal(t, "default", m.Source("proxies[jenkins].localPort"))
+}
+
+func TestMergeMixedCaseName(t *testing.T) {
+	m := Merge(
+		Layer{Name: "global", Settings: map[string]any{
+			"proxies": []any{map[string]any{"name": "Grafana", "hostname": "Grafana.example.com"}},
+		}},
+		Layer{Name: "project", Settings: map[string]any{
+			"proxies": []any{map[string]any{"name": "Grafana", "localPort": 9100}},
+		}},
+	)
+	cfg, err := m.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, []ProxyConfig{{Name: "Grafana", Hostname: "Grafana.example.com", LocalPort: 9100}}, cfg.Proxies)
+
+	assert.Equal(t, "global", m.Source("proxies[Grafana].hostname"))
+	assert.Equal(t, "project", m.Source("proxies[Grafana].localPort"))
+
+	out, err := yaml.Marshal(m.Annotate(cfg))
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "hostname: Grafana.example.com # global")
+	assert.Contains(t, string(out), "localPort: 9100 # project")
+}
+
+func TestMergeReplace(t *testing.T) {
+	file := Layer{Name: "file", Settings: map[string]any{
+		"proxies":  []any{map[string]any{"name": "grafana", "hostname": "grafana.example.com"}},
+		"profiles": map[string]any{"staging": []any{"grafana"}},
+	}}
+	flags := Layer{Name: "flags", Replace: []string{"proxies", "profiles"}, Settings: map[string]any{
+		"proxies":  []any{ProxySettings(ProxyConfig{Hostname: "app.example.com", LocalPort: 9000})},
+		"profiles": map[string]any{},
+	}}
+
+	m := Merge(file, flags)
+
+	cfg, err := m.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, []ProxyConfig{{Hostname: "app.example.com", LocalPort: 9000}}, cfg.Proxies)
+	assert.Empty(t, cfg.Profiles)
+	assert.Equal(t, "flags", m.Source("proxies[app.example.com].localPort"))
+	assert.Equal(t, "default", m.Source("proxies[grafana].hostname"))
+}
+
+func TestMergedDecodeUnknownKeys(t *testing.T) {
+	m := Merge(Layer{Name: "file", Settings: map[string]any{
+		"proxies": []any{map[string]any{"hostname": "app.example.com", "localPrt": 9000}},
+	}})
+
+	cfg, err := m.Decode()
+	assert.ErrorContains(t, err, "'proxies[0]' has invalid keys: localprt")
+	assert.Equal(t, "app.example.com", cfg.Proxies[0].Hostname)
+}
+
+func TestEnvLayer(t *testing.T) {
+	base := Merge(Layer{Name: "file", Settings: map[string]any{
+		"proxies": []any{
+			map[string]any{"name": "grafana-prod", "hostname": "grafana.example.com"},
+			map[string]any{"hostname": "kibana.example.com"},
+		},
+	}})
+
+	t.Run("valid variables", func(t *testing.T) {
+		layer, err := EnvLayer([]string{
+			"HOME=/home/user",
+			"CFPROXY_TRACING_ENDPOINT=localhost:4318",
+			"CFPROXY_TRACING_SERVICE_NAME=proxy",
+			"CFPROXY_TRACING_INSECURE=true",
+			"CFPROXY_PROFILES_STAGING=grafana-prod, kibana.example.com",
+			"CFPROXY_PROXY_GRAFANA_PROD_LOCAL_PORT=9000",
+			"CFPROXY_PROXY_KIBANA_EXAMPLE_COM_SKIPTLS=true",
+		}, base)
+		require.NoError(t, err)
+
+		m := Merge(Layer{Name: "file", Settings: base.Settings}, layer)
+		cfg, err := m.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, TracingConfig{Endpoint: "localhost:4318", ServiceName: "proxy", Insecure: true}, cfg.Tracing)
+		assert.Equal(t, map[string][]string{"staging": {"grafana-prod", "kibana.example.com"}}, cfg.Profiles)
+		assert.Equal(t, []ProxyConfig{
+			{Name: "grafana-prod", Hostname: "grafana.example.com", LocalPort: 9000},
+			{Hostname: "kibana.example.com", SkipTLS: true},
+		}, cfg.Proxies)
+		assert.Equal(t, "environment", m.Source("proxies[grafana-prod].localPort"))
+		assert.Equal(t, "file", m.Source("proxies[kibana.example.com].hostname"))
+	})
+
+	t.Run("invalid variables", func(t *testing.T) {
+		_, err := EnvLayer([]string{
+			"CFPROXY_TRACING=x",
+			"CFPROXY_UNKNOWN=x",
+			"CFPROXY_PROXIES=x",
+			"CFPROXY_PROXY_JENKINS_LOCAL_PORT=9000",
+			"CFPROXY_TRACING_INSECURE=maybe",
+		}, base)
+		assert.Equal(t, []string{
+			"CFPROXY_TRACING: not a single value",
+			"CFPROXY_UNKNOWN: unknown setting",
+			"CFPROXY_PROXIES: unknown setting",
+			"CFPROXY_PROXY_JENKINS_LOCAL_PORT: unknown proxy or setting",
+			"CFPROXY_TRACING_INSECURE: invalid boolean 'maybe'",
+		}, strings.Split(err.Error(), "\n"))
+	})
+}
+
+func TestFindProjectFile(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "a", "b")
+	require.NoError(t, os.MkdirAll(nested, 0o755))
+
+	path, err := FindProjectFile(nested)
+	require.NoError(t, err)
+	assert.Empty(t, path)
+
+	expected := filepath.Join(root, "a", ProjectFileName)
+	require.NoError(t, os.WriteFile(expected, []byte("proxies: []\n"), 0o644))
+
+	path, err = FindProjectFile(nested)
+	require.NoError(t, err)
+	assert.Equal(t, expected, path)
+}
+
+func TestAnnotate(t *testing.T) {
+	m := Merge(
+		Layer{Name: "global", Settings: map[string]any{
+			"proxies":  []any{map[string]any{"name": "grafana", "hostname": "grafana.example.com"}},
+			"profiles": map[string]any{"staging": []any{"grafana"}},
+		}},
+		Layer{Name: "flags", Settings: map[string]any{"tracing": map[string]any{"endpoint": "localhost:4318"}}},
+	)
+	cfg, err := m.Decode()
+	require.NoError(t, err)
+	SetDefaults(cfg.Proxies)
+
+	out, err := yaml.Marshal(m.Annotate(cfg))
+	require.NoError(t, err)
+	assert.Equal(t, `proxies:
+    - name: grafana # global
+      hostname: grafana.example.com # global
+      localPort: 8888 # default
+      destinationPort: 443 # default
+profiles:
+    staging: # global
+        - grafana
+tracing:
+    endpoint: localhost:4318 # flags
+`, string(out))
+}
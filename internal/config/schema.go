@@ -0,0 +1,174 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/tracing"
+)
+
+const schemaID = "https://raw.githubusercontent.com/sbldevnet/cloudflared-proxy/main/config.schema.json"
+
+// Default values published in the schema, keyed by Go type name and
+// mapstructure key. They must match the defaults applied by SetDefaults.
+var schemaDefaults = map[string]any{
+	"ProxyConfig.localPort":               DefaultLocalPort,
+	"ProxyConfig.destinationPort":         DefaultDestinationPort,
+	"ProxyConfig.skipTLS":                 false,
+	"ProxyConfig.scheme":                  DefaultScheme,
+	"ProxyConfig.tokenTransport":          options.TokenTransportHeader,
+	"ProxyConfig.tokenHeader":             options.DefaultTokenHeader,
+	"ProxyConfig.forwardedHeaders":        options.ForwardedPreserve,
+	"TransportConfig.dialTimeout":         options.DefaultDialTimeout.String(),
+	"TransportConfig.keepAlive":           options.DefaultKeepAlive.String(),
+	"TransportConfig.tlsHandshakeTimeout": options.DefaultTLSHandshakeTimeout.String(),
+	"TransportConfig.idleConnTimeout":     options.DefaultIdleConnTimeout.String(),
+	"TransportConfig.maxIdleConns":        options.DefaultMaxIdleConns,
+	"TransportConfig.http2":               false,
+	"TransportConfig.disableKeepAlives":   false,
+	"TLSConfig.minVersion":                "1.2",
+	"RetryConfig.initialBackoff":          options.DefaultRetryInitialBackoff.String(),
+	"RetryConfig.maxBackoff":              options.DefaultRetryMaxBackoff.String(),
+	"RetryConfig.maxBodySize":             options.DefaultRetryMaxBodySize,
+	"RetryConfig.budgetRatio":             options.DefaultRetryBudgetRatio,
+	"RetryConfig.budgetMinRetries":        options.DefaultRetryBudgetMinRetries,
+	"LoadBalancingConfig.strategy":        options.StrategyRoundRobin,
+	"LoadBalancingConfig.maxFails":        options.DefaultMaxFails,
+	"LoadBalancingConfig.failTimeout":     options.DefaultFailTimeout.String(),
+	"HealthCheckConfig.interval":          options.DefaultHealthCheckInterval.String(),
+	"HealthCheckConfig.timeout":           options.DefaultHealthCheckTimeout.String(),
+	"ProxyConfig.optional":                false,
+	"CacheConfig.enabled":                 false,
+	"CacheConfig.maxSize":                 options.DefaultCacheMaxSize,
+	"CacheConfig.maxEntrySize":            options.DefaultCacheMaxEntrySize,
+	"CompressionConfig.enabled":           false,
+	"CompressionConfig.encodings":         options.DefaultCompressionEncodings(),
+	"CompressionConfig.minSize":           options.DefaultCompressionMinSize,
+	"ProbesConfig.onListeners":            false,
+	"TracingConfig.insecure":              false,
+	"TracingConfig.serviceName":           tracing.DefaultServiceName,
+}
+
+// Required keys, keyed by Go type name.
+var schemaRequired = map[string][]string{
+	"ProxyConfig": {"hostname"},
+}
+
+// Keys left out of the schema, keyed by Go type name.
+var schemaExcluded = map[string][]string{
+	"ProxyDefaults": {"name", "hostname", "upstreams", "localPort"},
+}
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) used by the config file.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Default              any                    `json:"default,omitempty"`
+	Minimum              *int64                 `json:"minimum,omitempty"`
+	Maximum              *int64                 `json:"maximum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// Generates the JSON Schema of the config file from the Config struct,
+// using the mapstructure keys, description tags and published defaults.
+func Schema() ([]byte, error) {
+	defs := make(map[string]*jsonSchema)
+	schema := structSchema(reflect.TypeOf(Config{}), defs)
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	schema.ID = schemaID
+	schema.Title = "cloudflared-proxy configuration"
+	schema.Defs = defs
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode schema, %v", err)
+	}
+	return append(out, '\n'), nil
+}
+
+// Returns the schema of t. Structs are added to defs and referenced.
+func schemaForType(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return &jsonSchema{Type: "string", Pattern: `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaForType(t.Elem(), defs)
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		min := int64(0)
+		schema := &jsonSchema{Type: "integer", Minimum: &min}
+		if t.Kind() != reflect.Uint && t.Kind() != reflect.Uint64 {
+			max := int64(1)<<(t.Bits()) - 1
+			schema.Maximum = &max
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaForType(t.Elem(), defs)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // Reserve the name while the struct is being built.
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return &jsonSchema{Ref: "#/$defs/" + t.Name()}
+	default:
+		panic(fmt.Sprintf("unsupported config type %s", t))
+	}
+}
+
+// Returns the object schema of struct t.
+func structSchema(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+	schema := &jsonSchema{
+		Type:                 "object",
+		Properties:           make(map[string]*jsonSchema),
+		AdditionalProperties: false,
+		Required:             schemaRequired[t.Name()],
+	}
+	addStructProperties(t, schema, defs)
+	return schema
+}
+
+// Adds the fields of struct t, including squashed embedded structs, to schema.
+func addStructProperties(t reflect.Type, schema *jsonSchema, defs map[string]*jsonSchema) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "-" || !field.IsExported() || slices.Contains(schemaExcluded[t.Name()], key) {
+			continue
+		}
+		if strings.Contains(opts, "squash") {
+			addStructProperties(field.Type, schema, defs)
+			continue
+		}
+
+		// Keywords next to $ref are allowed since draft 2019-09.
+		property := schemaForType(field.Type, defs)
+		property.Description = field.Tag.Get("description")
+		property.Default = schemaDefaults[t.Name()+"."+key]
+		schema.Properties[key] = property
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateSchema = flag.Bool("update-schema", false, "regenerate the published JSON Schema")
+
+const schemaFile = "../../config.schema.json"
+
+// TestSchemaUpToDate fails when the published schema differs from the one
+// generated from the config structs. Regenerate it with:
+//
+//	go test ./internal/config -run TestSchemaUpToDate -update-schema
+func TestSchemaUpToDate(t *testing.T) {
+	generated, err := Schema()
+	require.NoError(t, err)
+
+	if *updateSchema {
+		require.NoError(t, os.WriteFile(schemaFile, generated, 0o644))
+	}
+
+	published, err := os.ReadFile(schemaFile)
+	require.NoError(t, err)
+	assert.Equal(t, string(published), string(generated), "config.schema.json is out of date, regenerate it with -update-schema")
+}
+
+func TestSchema(t *testing.T) {
+	generated, err := Schema()
+	require.NoError(t, err)
+
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal(generated, &schema))
+
+	assert.Equal(t, false, schema["additionalProperties"])
+	assert.NotContains(t, schema, "required", "a config without proxies is reported by Validate")
+
+	proxies := schema["properties"].(map[string]any)["proxies"].(map[string]any)
+	assert.Equal(t, "array", proxies["type"])
+	assert.Equal(t, "#/$defs/ProxyConfig", proxies["items"].(map[string]any)["$ref"])
+
+	proxy := schema["$defs"].(map[string]any)["ProxyConfig"].(map[string]any)
+	localPort := proxy["properties"].(map[string]any)["localPort"].(map[string]any)
+	assert.Equal(t, "integer", localPort["type"])
+	assert.Equal(t, float64(DefaultLocalPort), localPort["default"])
+	assert.Equal(t, float64(65535), localPort["maximum"])
+	assert.Equal(t, "Local port the proxy listens on.", localPort["description"])
+	assert.Equal(t, []any{"hostname"}, proxy["required"])
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Validates a configuration after defaults have been applied. Every problem
+// found is reported, prefixed with its location in the config file, and
+// joined into a single error. Returns nil if the configuration is valid.
+func Validate(cfg *Config) error {
+	var errs []error
+	add := func(location, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", location, fmt.Sprintf(format, args...)))
+	}
+
+	if len(cfg.Proxies) == 0 {
+		add("proxies", "no proxies defined")
+	}
+
+	// These identify a proxy, a shared value would only make them collide.
+	if cfg.Defaults.Name != "" {
+		add("defaults.name", "name cannot be set in defaults")
+	}
+	if cfg.Defaults.Hostname != "" {
+		add("defaults.hostname", "hostname cannot be set in defaults")
+	}
+	if len(cfg.Defaults.Upstreams) > 0 {
+		add("defaults.upstreams", "upstreams cannot be set in defaults")
+	}
+	if cfg.Defaults.LocalPort != 0 {
+		add("defaults.localPort", "localPort cannot be set in defaults")
+	}
+
+	var listeners []listener
+	names := make(map[string]string)
+	for i, proxy := range cfg.Proxies {
+		location := proxyLocation(i, proxy)
+
+		if proxy.Hostname == "" {
+			add(location+".hostname", "hostname is required")
+		} else if !isValidHostname(proxy.Hostname) {
+			add(location+".hostname", "invalid hostname '%s'", proxy.Hostname)
+		}
+
+		if strings.ContainsAny(proxy.Name, ", ") {
+			add(location+".name", "name '%s' cannot contain commas or spaces", proxy.Name)
+		}
+		if other, ok := names[proxy.GetName()]; ok {
+			add(location+".name", "duplicate name '%s', already used by %s", proxy.GetName(), other)
+		} else {
+			names[proxy.GetName()] = location
+		}
+
+		hostnames := map[string]bool{strings.ToLower(proxy.Hostname): true}
+		for _, upstream := range proxy.Upstreams {
+			switch {
+			case !isValidHostname(upstream):
+				add(location+".upstreams", "invalid hostname '%s'", upstream)
+			case hostnames[strings.ToLower(upstream)]:
+				add(location+".upstreams", "duplicate hostname '%s'", upstream)
+			}
+			hostnames[strings.ToLower(upstream)] = true
+		}
+
+		if proxy.LocalPort == 0 {
+			add(location+".localPort", "port cannot be 0")
+		} else {
+			if other, ok := boundBy(listeners, proxy.BindAddress, proxy.LocalPort); ok {
+				add(location+".localPort", "duplicate port %d, already used by %s", proxy.LocalPort, other)
+			}
+			listeners = append(listeners, listener{proxy.BindAddress, proxy.LocalPort, location})
+		}
+
+		if proxy.DestinationPort == 0 {
+			add(location+".destinationPort", "port cannot be 0")
+		}
+
+		if proxy.BindAddress != "" && !isValidHostname(proxy.BindAddress) {
+			add(location+".bindAddress", "invalid bind address '%s'", proxy.BindAddress)
+		}
+		if proxy.Scheme != "" && proxy.Scheme != "https" && proxy.Scheme != "http" {
+			add(location+".scheme", "unsupported scheme '%s', expected https or http", proxy.Scheme)
+		}
+		if proxy.UpstreamPath != "" && !strings.HasPrefix(proxy.UpstreamPath, "/") {
+			add(location+".upstreamPath", "path '%s' must start with /", proxy.UpstreamPath)
+		}
+		if proxy.StripPrefix != "" && !strings.HasPrefix(proxy.StripPrefix, "/") {
+			add(location+".stripPrefix", "path '%s' must start with /", proxy.StripPrefix)
+		}
+
+		if err := options.ValidateTokenTransport(proxy.TokenTransport, proxy.TokenHeader); err != nil {
+			add(location+".tokenTransport", "%v", err)
+		}
+		if err := options.ValidateForwarding(proxy.ForwardedHeaders, nil); err != nil {
+			add(location+".forwardedHeaders", "%v", err)
+		}
+		if err := options.ValidateForwarding("", proxy.TrustedProxies); err != nil {
+			add(location+".trustedProxies", "%v", err)
+		}
+		if err := options.ValidateUpstreamProxy(proxy.UpstreamProxy); err != nil {
+			add(location+".upstreamProxy", "%v", err)
+		}
+		if err := options.ValidateResolve(hostOverrides(proxy.Resolve)); err != nil {
+			add(location+".resolve", "%v", err)
+		}
+		if err := options.ValidateDNSServer(proxy.DNSServer); err != nil {
+			add(location+".dnsServer", "%v", err)
+		}
+		if (len(proxy.Resolve) > 0 || proxy.DNSServer != "") && throughUpstreamProxy(proxy.UpstreamProxy) {
+			add(location+".upstreamProxy", "resolve and dnsServer do not apply through an upstream proxy, which resolves the hostname itself")
+		}
+		if err := options.Transport(proxy.Transport).Validate(); err != nil {
+			add(location+".transport", "%v", err)
+		}
+		if err := options.TLS(proxy.TLS).Validate(); err != nil {
+			add(location+".tls", "%v", err)
+		}
+		if proxy.SkipTLS && proxy.TLS.CAFile != "" {
+			add(location+".tls.caFile", "conflicts with skipTLS")
+		}
+		if err := options.Server(proxy.Server).Validate(); err != nil {
+			add(location+".server", "%v", err)
+		}
+		if err := options.Retry(proxy.Retry).Validate(); err != nil {
+			add(location+".retry", "%v", err)
+		}
+		if err := options.LoadBalancing(proxy.LoadBalancing).Validate(); err != nil {
+			add(location+".loadBalancing", "%v", err)
+		}
+		if err := options.Cache(proxy.Cache).Validate(); err != nil {
+			add(location+".cache", "%v", err)
+		}
+		if err := options.Compression(proxy.Compression).Validate(); err != nil {
+			add(location+".compression", "%v", err)
+		}
+		if err := options.HealthCheck(proxy.HealthCheck).Validate(); err != nil {
+			add(location+".healthCheck", "%v", err)
+		}
+		if err := options.HeaderRules(proxy.RequestHeaders).Validate(); err != nil {
+			add(location+".requestHeaders", "%v", err)
+		}
+		if err := options.HeaderRules(proxy.ResponseHeaders).Validate(); err != nil {
+			add(location+".responseHeaders", "%v", err)
+		}
+	}
+
+	for _, profile := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		members := cfg.Profiles[profile]
+		location := fmt.Sprintf("profiles.%s", profile)
+		if len(members) == 0 {
+			add(location, "profile has no proxies")
+		}
+		for _, member := range members {
+			if _, ok := names[member]; !ok {
+				add(location, "unknown proxy '%s'", member)
+			}
+		}
+	}
+
+	if other, ok := boundBy(listeners, cfg.Probes.BindAddress, cfg.Probes.Port); ok {
+		add("probes.port", "duplicate port %d, already used by %s", cfg.Probes.Port, other)
+	}
+	if cfg.Probes.BindAddress != "" && !isValidHostname(cfg.Probes.BindAddress) {
+		add("probes.bindAddress", "invalid bind address '%s'", cfg.Probes.BindAddress)
+	}
+
+	if cfg.Tracing.Insecure && strings.HasPrefix(cfg.Tracing.Endpoint, "https://") {
+		add("tracing.insecure", "conflicts with https endpoint '%s'", cfg.Tracing.Endpoint)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Returns the location of a proxy in the config file, including its name if set.
+func proxyLocation(i int, proxy ProxyConfig) string {
+	if proxy.Name != "" {
+		return fmt.Sprintf("proxies[%d](%s)", i, proxy.Name)
+	}
+	return fmt.Sprintf("proxies[%d]", i)
+}
+
+// A local address a proxy listens on, all interfaces if bindAddress is empty.
+type listener struct {
+	bindAddress string
+	port        uint16
+	location    string
+}
+
+// Returns the location of the listener already bound to port on bindAddress.
+// An empty address means all interfaces, so it conflicts with every other one.
+func boundBy(listeners []listener, bindAddress string, port uint16) (string, bool) {
+	for _, l := range listeners {
+		if l.port == port && (l.bindAddress == "" || bindAddress == "" || strings.EqualFold(l.bindAddress, bindAddress)) {
+			return l.location, true
+		}
+	}
+	return "", false
+}
+
+// Returns the host overrides of resolve.
+func hostOverrides(resolve []ResolveConfig) []options.HostOverride {
+	overrides := make([]options.HostOverride, len(resolve))
+	for i, r := range resolve {
+		overrides[i] = options.HostOverride(r)
+	}
+	return overrides
+}
+
+// Reports whether requests go through the outbound proxy upstreamProxy
+// rather than the proxy of the environment or none.
+func throughUpstreamProxy(upstreamProxy string) bool {
+	return upstreamProxy != "" && upstreamProxy != options.UpstreamProxyDirect
+}
+
+// Reports whether h is an IP address or a syntactically valid DNS hostname.
+func isValidHostname(h string) bool {
+	if net.ParseIP(h) != nil {
+		return true
+	}
+	h = strings.TrimSuffix(h, ".")
+	if len(h) == 0 || len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name           string
+		config         Config
+		expectedErrors []string
+	}{
+		{
+			name: "valid",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "grafana", Hostname: "grafana.example.com", LocalPort: 8080, DestinationPort: 443},
+					{Hostname: "10.0.0.1", LocalPort: 8081, DestinationPort: 443},
+				},
+				Profiles: map[string][]string{"staging": {"grafana", "10.0.0.1"}},
+			},
+		},
+		{
+			name:           "no proxies",
+			config:         Config{},
+			expectedErrors: []string{"proxies: no proxies defined"},
+		},
+		{
+			name: "every problem is reported",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "grafana", Hostname: "grafana.example.com", LocalPort: 8080, DestinationPort: 443},
+					{Name: "grafana", Hostname: "bad_host!", LocalPort: 8080, DestinationPort: 0},
+					{Hostname: "", LocalPort: 0, DestinationPort: 443},
+				},
+				Profiles: map[string][]string{"prod": {"kibana"}, "empty": {}},
+				Tracing:  TracingConfig{Endpoint: "https://collector:4318", Insecure: true},
+			},
+			expectedErrors: []string{
+				"proxies[1](grafana).hostname: invalid hostname 'bad_host!'",
+				"proxies[1](grafana).name: duplicate name 'grafana', already used by proxies[0](grafana)",
+				"proxies[1](grafana).localPort: duplicate port 8080, already used by proxies[0](grafana)",
+				"proxies[1](grafana).destinationPort: port cannot be 0",
+				"proxies[2].hostname: hostname is required",
+				"proxies[2].localPort: port cannot be 0",
+				"profiles.empty: profile has no proxies",
+				"profiles.prod: unknown proxy 'kibana'",
+				"tracing.insecure: conflicts with https endpoint 'https://collector:4318'",
+			},
+		},
+		{
+			name: "identifying keys in defaults",
+			config: Config{
+				Defaults: ProxyDefaults{Name: "shared", Hostname: "app.example.com", LocalPort: 8080, SkipTLS: true},
+				Proxies:  []ProxyConfig{{Hostname: "app.example.com", LocalPort: 8080, DestinationPort: 443}},
+			},
+			expectedErrors: []string{
+				"defaults.name: name cannot be set in defaults",
+				"defaults.hostname: hostname cannot be set in defaults",
+				"defaults.localPort: localPort cannot be set in defaults",
+			},
+		},
+		{
+			name: "invalid endpoint address",
+			config: Config{
+				Proxies: []ProxyConfig{{Hostname: "app.example.com", LocalPort: 8080, DestinationPort: 443, BindAddress: "not an ip", Scheme: "ftp", UpstreamPath: "base"}},
+			},
+			expectedErrors: []string{
+				"proxies[0].bindAddress: invalid bind address 'not an ip'",
+				"proxies[0].scheme: unsupported scheme 'ftp', expected https or http",
+				"proxies[0].upstreamPath: path 'base' must start with /",
+			},
+		},
+		{
+			name: "invalid headers",
+			config: Config{
+				Proxies: []ProxyConfig{{
+					Hostname: "app.example.com", LocalPort: 8080, DestinationPort: 443,
+					RequestHeaders:  HeaderRules{Set: map[string]string{"x-user": "{{ .User }}"}},
+					ResponseHeaders: HeaderRules{Remove: []string{"bad header"}},
+				}},
+			},
+			expectedErrors: []string{
+				"proxies[0].requestHeaders: invalid value of header 'x-user', template: x-user:1:3: executing \"x-user\" at <.User>: can't evaluate field User in type options.HeaderVars",
+				"proxies[0].responseHeaders: invalid header name 'bad header'",
+			},
+		},
+		{
+			name: "invalid token transport",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, TokenTransport: "query"},
+					{Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443, TokenTransport: "cookie", TokenHeader: "X-Token"},
+				},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).tokenTransport: unsupported token transport 'query', expected header, cookie or both",
+				"proxies[1](b).tokenTransport: token header 'X-Token' conflicts with token transport 'cookie'",
+			},
+		},
+		{
+			name: "invalid forwarded headers",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, ForwardedHeaders: "replace"},
+					{Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443, ForwardedHeaders: "set", TrustedProxies: []string{"10.0.0.0/8", "proxy.local"}},
+				},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).forwardedHeaders: unsupported forwarded headers policy 'replace', expected preserve, set, strip or rfc7239",
+				"proxies[1](b).trustedProxies: invalid trusted proxy 'proxy.local', expected an IP address or CIDR range",
+			},
+		},
+		{
+			name: "negative timeouts",
+			config: Config{
+				Proxies: []ProxyConfig{{
+					Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443,
+					Transport: TransportConfig{ResponseHeaderTimeout: -time.Second},
+					Server:    ServerConfig{WriteTimeout: -time.Second},
+				}},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).transport: response header timeout cannot be negative",
+				"proxies[0](a).server: write timeout cannot be negative",
+			},
+		},
+		{
+			name: "invalid tls",
+			config: Config{
+				Proxies: []ProxyConfig{{
+					Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, SkipTLS: true,
+					TLS: TLSConfig{CAFile: "ca.pem", MinVersion: "1.4"},
+				}, {
+					Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443,
+					TLS: TLSConfig{Pins: []string{"sha256/abc"}},
+				}},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).tls: unsupported minimum TLS version '1.4', expected 1.0, 1.1, 1.2 or 1.3",
+				"proxies[0](a).tls.caFile: conflicts with skipTLS",
+				"proxies[1](b).tls: invalid pin 'sha256/abc', expected spki-sha256:<BASE64> or cert-sha256:<HEX>",
+			},
+		},
+		{
+			name: "invalid upstream proxy",
+			config: Config{
+				Proxies: []ProxyConfig{{
+					Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, UpstreamProxy: "ftp://proxy.corp:21",
+				}, {
+					Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443, UpstreamProxy: "direct",
+				}},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).upstreamProxy: unsupported upstream proxy scheme 'ftp', expected http, https, socks5 or socks5h",
+			},
+		},
+		{
+			name: "invalid resolution",
+			config: Config{
+				Proxies: []ProxyConfig{{
+					Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443,
+					Resolve:   []ResolveConfig{{Host: "a.example.com", Addresses: []string{"edge.example.com"}}},
+					DNSServer: "dns.example.com",
+				}, {
+					Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443, UpstreamProxy: "http://proxy.corp:3128",
+					DNSServer: "https://cloudflare-dns.com/dns-query",
+				}},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).resolve: invalid address 'edge.example.com' of host 'a.example.com', expected an IP address",
+				"proxies[0](a).dnsServer: DNS server 'dns.example.com' must be an IP address",
+				"proxies[1](b).upstreamProxy: resolve and dnsServer do not apply through an upstream proxy, which resolves the hostname itself",
+			},
+		},
+		{
+			name: "invalid upstreams",
+			config: Config{
+				Defaults: ProxyDefaults{Upstreams: []string{"shared.example.com"}},
+				Proxies: []ProxyConfig{{
+					Name: "a", Hostname: "a.example.com", Upstreams: []string{"A.example.com", "a_us.example.com!"}, LocalPort: 8080, DestinationPort: 443,
+					LoadBalancing: LoadBalancingConfig{Strategy: "random", MaxFails: -1},
+				}},
+			},
+			expectedErrors: []string{
+				"defaults.upstreams: upstreams cannot be set in defaults",
+				"proxies[0](a).upstreams: duplicate hostname 'A.example.com'",
+				"proxies[0](a).upstreams: invalid hostname 'a_us.example.com!'",
+				"proxies[0](a).loadBalancing: unsupported load balancing strategy 'random', expected round-robin, least-connections or primary-backup",
+			},
+		},
+		{
+			name: "invalid health check",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, HealthCheck: HealthCheckConfig{Path: "healthz"}},
+					{Name: "b", Hostname: "b.example.com", LocalPort: 8081, DestinationPort: 443, HealthCheck: HealthCheckConfig{Path: "/", Interval: time.Second, Timeout: time.Minute}},
+				},
+			},
+			expectedErrors: []string{
+				"proxies[0](a).healthCheck: health check path 'healthz' must start with /",
+				"proxies[1](b).healthCheck: timeout 1m0s is greater than interval 1s",
+			},
+		},
+		{
+			name: "invalid cache",
+			config: Config{
+				Proxies: []ProxyConfig{{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, Cache: CacheConfig{Enabled: true, MaxSize: 10, MaxEntrySize: 20}}},
+			},
+			expectedErrors: []string{"proxies[0](a).cache: max entry size 20 is greater than max size 10"},
+		},
+		{
+			name: "same port on distinct bind addresses",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, BindAddress: "127.0.0.1"},
+					{Name: "b", Hostname: "b.example.com", LocalPort: 8080, DestinationPort: 443, BindAddress: "127.0.0.2"},
+				},
+			},
+		},
+		{
+			name: "same port on a bind address and all interfaces",
+			config: Config{
+				Proxies: []ProxyConfig{
+					{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, BindAddress: "127.0.0.1"},
+					{Name: "b", Hostname: "b.example.com", LocalPort: 8080, DestinationPort: 443},
+					{Name: "c", Hostname: "c.example.com", LocalPort: 8080, DestinationPort: 443, BindAddress: "localhost"},
+					{Name: "d", Hostname: "d.example.com", LocalPort: 9090, DestinationPort: 443, BindAddress: "LOCALHOST"},
+				},
+				Probes: ProbesConfig{Port: 9090, BindAddress: "localhost"},
+			},
+			expectedErrors: []string{
+				"proxies[1](b).localPort: duplicate port 8080, already used by proxies[0](a)",
+				"proxies[2](c).localPort: duplicate port 8080, already used by proxies[1](b)",
+				"probes.port: duplicate port 9090, already used by proxies[3](d)",
+			},
+		},
+		{
+			name: "invalid compression",
+			config: Config{
+				Proxies: []ProxyConfig{{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443, Compression: CompressionConfig{Enabled: true, Encodings: []string{"deflate"}}}},
+			},
+			expectedErrors: []string{"proxies[0](a).compression: unsupported encoding 'deflate', expected br, zstd or gzip"},
+		},
+		{
+			name: "invalid probes",
+			config: Config{
+				Proxies: []ProxyConfig{{Name: "a", Hostname: "a.example.com", LocalPort: 8080, DestinationPort: 443}},
+				Probes:  ProbesConfig{Port: 8080, BindAddress: "local host"},
+			},
+			expectedErrors: []string{
+				"probes.port: duplicate port 8080, already used by proxies[0](a)",
+				"probes.bindAddress: invalid bind address 'local host'",
+			},
+		},
+		{
+			name: "invalid name",
+			config: Config{
+				Proxies: []ProxyConfig{{Name: "a,b", Hostname: "app.example.com", LocalPort: 8080, DestinationPort: 443}},
+			},
+			expectedErrors: []string{"proxies[0](a,b).name: name 'a,b' cannot contain commas or spaces"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(&tc.config)
+
+			if len(tc.expectedErrors) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Equal(t, tc.expectedErrors, strings.Split(err.Error(), "\n"))
+		})
+	}
+}
+
+func TestIsValidHostname(t *testing.T) {
+	for _, h := range []string{"app.example.com", "localhost", "app.example.com.", "1.2.3.4", "::1", "a-b.c"} {
+		assert.True(t, isValidHostname(h), h)
+	}
+	for _, h := range []string{"", "-app.example.com", "app..example.com", "app_1.example.com", "app.example.com:443", strings.Repeat("a", 64) + ".com"} {
+		assert.False(t, isValidHostname(h), h)
+	}
+}
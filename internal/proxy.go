@@ -5,16 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/sbldevnet/cloudflared-proxy/internal/config"
 	"github.com/sbldevnet/cloudflared-proxy/pkg/cloudflared"
 	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
 	"github.com/sbldevnet/cloudflared-proxy/pkg/proxy"
 )
 
 type ProxyService interface {
-	GetCloudflareAccessTokenForApp(url string) (string, error)
-	StartMultipleProxies(ctx context.Context, configs []proxy.CFAccessProxyConfig) error
+	// GetCloudflareAccessTokenForApp logs in to the application at url,
+	// running cloudflared with the variables env added to its environment.
+	GetCloudflareAccessTokenForApp(url string, env []string) (string, error)
+	StartMultipleProxies(ctx context.Context, configs []proxy.CFAccessProxyConfig, probes proxy.ProbeOptions) error
 }
 
 type LiveProxyService struct{}
@@ -23,39 +27,116 @@ func NewLiveProxyService() *LiveProxyService {
 	return &LiveProxyService{}
 }
 
-func (s *LiveProxyService) GetCloudflareAccessTokenForApp(url string) (string, error) {
-	return cloudflared.GetCloudflareAccessTokenForApp(url)
+func (s *LiveProxyService) GetCloudflareAccessTokenForApp(url string, env []string) (string, error) {
+	return cloudflared.GetCloudflareAccessTokenForApp(url, cloudflared.WithEnv(env...))
 }
 
-func (s *LiveProxyService) StartMultipleProxies(ctx context.Context, configs []proxy.CFAccessProxyConfig) error {
-	return proxy.StartMultipleProxies(ctx, configs)
+func (s *LiveProxyService) StartMultipleProxies(ctx context.Context, configs []proxy.CFAccessProxyConfig, probes proxy.ProbeOptions) error {
+	return proxy.StartMultipleProxies(ctx, configs, probes)
 }
 
-func ProxyCFAccess(ctx context.Context, configs []config.ProxyConfig, service ProxyService) error {
+func ProxyCFAccess(ctx context.Context, configs []config.ProxyConfig, probes config.ProbesConfig, service ProxyService) error {
 	proxyConfigs := make([]proxy.CFAccessProxyConfig, len(configs))
 	for i, config := range configs {
-		token, err := service.GetCloudflareAccessTokenForApp(config.GetAddress())
+		env := cloudflaredEnv(config.UpstreamProxy)
+		upstreams, err := getUpstreams(config, env, service)
+		if err != nil {
+			return err
+		}
+
+		proxyConfigs[i] = proxy.CFAccessProxyConfig{
+			Name:           config.GetName(),
+			Upstreams:      upstreams,
+			LoadBalancing:  proxy.LoadBalancingOptions(config.LoadBalancing),
+			HealthCheck:    proxy.HealthCheckOptions(config.HealthCheck),
+			Optional:       config.Optional,
+			BindAddress:    config.BindAddress,
+			LocalPort:      config.LocalPort,
+			TokenTransport: config.TokenTransport,
+			TokenHeader:    config.TokenHeader,
+			SkipTLS:        config.SkipTLS,
+			StripPrefix:    config.StripPrefix,
+			UpstreamProxy:  config.UpstreamProxy,
+			Resolve:        hostOverrides(config.Resolve),
+			DNSServer:      config.DNSServer,
+
+			ForwardedHeaders: config.ForwardedHeaders,
+			TrustedProxies:   config.TrustedProxies,
+
+			Transport:   proxy.TransportOptions(config.Transport),
+			TLS:         proxy.TLSOptions(config.TLS),
+			Server:      proxy.ServerOptions(config.Server),
+			Retry:       proxy.RetryOptions(config.Retry),
+			Cache:       proxy.CacheOptions(config.Cache),
+			Compression: proxy.CompressionOptions(config.Compression),
+
+			RequestHeaders:  proxy.HeaderRules(config.RequestHeaders),
+			ResponseHeaders: proxy.HeaderRules(config.ResponseHeaders),
+		}
+	}
+
+	return service.StartMultipleProxies(ctx, proxyConfigs, proxy.ProbeOptions(probes))
+}
+
+// Returns the upstreams of a proxy, its hostname and then its upstreams,
+// each with its own token. cloudflared runs with the variables env.
+func getUpstreams(config config.ProxyConfig, env []string, service ProxyService) ([]proxy.Upstream, error) {
+	var upstreams []proxy.Upstream
+	for _, address := range config.GetAddresses() {
+		token, err := service.GetCloudflareAccessTokenForApp(address, env)
 		if err != nil {
 			if errors.Is(err, cloudflared.ErrAccessAppNotFound) {
-				logger.Warn("proxy.ProxyCFAccess", "Access application not found at %s, continuing without authentication", config.GetAddress())
+				logger.Warn("proxy.ProxyCFAccess", "Access application not found at %s, continuing without authentication for proxy %s", address, config.GetName())
 			} else {
-				return err
+				return nil, err
 			}
 		}
 
-		url, err := url.Parse(fmt.Sprintf("https://%s", config.GetAddress()))
+		url, err := url.Parse(fmt.Sprintf("%s://%s%s", config.GetScheme(), address, (&url.URL{Path: config.UpstreamPath}).EscapedPath()))
 		if err != nil {
-			logger.Error("proxy.ProxyCFAccess", err, "Error parsing target URL for %s, skipping", config.GetAddress())
-			return err
+			logger.Error("proxy.ProxyCFAccess", err, "Error parsing target URL for %s (%s), skipping", address, config.GetName())
+			return nil, err
 		}
 
-		proxyConfigs[i] = proxy.CFAccessProxyConfig{
-			Url:       url,
-			LocalPort: config.LocalPort,
-			Token:     token,
-			SkipTLS:   config.SkipTLS,
-		}
+		upstreams = append(upstreams, proxy.Upstream{
+			Url:   url,
+			Token: token,
+			Reauthenticate: func() (string, error) {
+				return service.GetCloudflareAccessTokenForApp(address, env)
+			},
+		})
+	}
+	return upstreams, nil
+}
+
+// Returns the host overrides of a proxy.
+func hostOverrides(resolve []config.ResolveConfig) []proxy.HostOverride {
+	if len(resolve) == 0 {
+		return nil
+	}
+	overrides := make([]proxy.HostOverride, len(resolve))
+	for i, r := range resolve {
+		overrides[i] = proxy.HostOverride(r)
+	}
+	return overrides
+}
+
+// Returns the environment variables making cloudflared use the same outbound
+// proxy as the proxy, or nil to leave its environment as it is.
+func cloudflaredEnv(upstreamProxy string) []string {
+	var value string
+	switch upstreamProxy {
+	case "":
+		return nil
+	case options.UpstreamProxyDirect:
+		value = ""
+	default:
+		value = upstreamProxy
 	}
 
-	return service.StartMultipleProxies(ctx, proxyConfigs)
+	env := []string{"NO_PROXY=", "no_proxy="}
+	for _, name := range []string{"HTTPS_PROXY", "HTTP_PROXY", "ALL_PROXY"} {
+		env = append(env, name+"="+value, strings.ToLower(name)+"="+value)
+	}
+	return env
 }
@@ -1,12 +1,20 @@
 package cloudflared
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"slices"
 	"strings"
 
 	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Commander executes a command and returns its combined output.
@@ -14,14 +22,46 @@ type Commander interface {
 	CombinedOutput(name string, arg ...string) ([]byte, error)
 }
 
+// EnvCommander is a Commander that can run commands with extra environment
+// variables.
+type EnvCommander interface {
+	Commander
+	WithEnv(env []string) Commander
+}
+
 // execCommander is the default implementation of Commander that executes real commands.
-type execCommander struct{}
+type execCommander struct {
+	env []string // Variables added to the environment of the process
+}
 
 func (c *execCommander) CombinedOutput(name string, arg ...string) ([]byte, error) {
 	cmd := exec.Command(name, arg...)
+	if len(c.env) > 0 {
+		// Later values override those of the process environment.
+		cmd.Env = append(os.Environ(), c.env...)
+	}
 	return cmd.CombinedOutput()
 }
 
+// WithEnv returns a commander adding env, as KEY=VALUE, to the environment.
+func (c *execCommander) WithEnv(env []string) Commander {
+	return &execCommander{env: append(slices.Clone(c.env), env...)}
+}
+
+// Option configures how cloudflared is run.
+type Option func(*options)
+
+type options struct {
+	env []string
+}
+
+// WithEnv adds variables, as KEY=VALUE, to the environment of cloudflared.
+func WithEnv(env ...string) Option {
+	return func(o *options) {
+		o.env = append(o.env, env...)
+	}
+}
+
 // cmdr is the command runner used by the package. It can be replaced in tests.
 var cmdr Commander = &execCommander{}
 
@@ -32,8 +72,27 @@ const (
 
 var ErrAccessAppNotFound = errors.New("access application not found")
 
-func GetCloudflareAccessTokenForApp(url string) (string, error) {
-	output, err := cmdr.CombinedOutput("cloudflared", "access", "login", url)
+func GetCloudflareAccessTokenForApp(url string, opts ...Option) (token string, err error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := cmdr
+	if ec, ok := c.(EnvCommander); ok && len(o.env) > 0 {
+		c = ec.WithEnv(o.env)
+	}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "cloudflared.GetCloudflareAccessTokenForApp",
+		trace.WithAttributes(attribute.String("cloudflared.app", url)))
+	defer func() {
+		if err != nil && !errors.Is(err, ErrAccessAppNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	output, err := runTraced(ctx, c, "cloudflared", "access", "login", url)
 	logger.Debug("cloudflared.GetCloudflareAccessTokenForApp", "executing cloudflared access login command for %s", url)
 	if err != nil {
 		if errors.Is(err, exec.ErrNotFound) {
@@ -51,7 +110,7 @@ func GetCloudflareAccessTokenForApp(url string) (string, error) {
 		return "", fmt.Errorf("cloudflared login failed: %s", outputStr)
 	}
 
-	output, err = cmdr.CombinedOutput("cloudflared", "access", "token", fmt.Sprintf("-app=%s", url))
+	output, err = runTraced(ctx, c, "cloudflared", "access", "token", fmt.Sprintf("-app=%s", url))
 	logger.Debug("cloudflared.GetCloudflareAccessTokenForApp", "executing cloudflared access token command for %s", url)
 	if err != nil {
 		logger.Error("cloudflared.GetCloudflareAccessTokenForApp", err, "cloudflared token failed: %s", string(output))
@@ -60,3 +119,21 @@ func GetCloudflareAccessTokenForApp(url string) (string, error) {
 
 	return string(output), nil
 }
+
+// runTraced runs a command through c inside a child span of ctx. The span
+// is named after the command and its subcommand, e.g. "cloudflared access login".
+func runTraced(ctx context.Context, c Commander, name string, arg ...string) ([]byte, error) {
+	spanName := name
+	if len(arg) >= 2 {
+		spanName = fmt.Sprintf("%s %s %s", name, arg[0], arg[1])
+	}
+	_, span := tracing.Tracer().Start(ctx, spanName)
+	defer span.End()
+
+	output, err := c.CombinedOutput(name, arg...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return output, err
+}
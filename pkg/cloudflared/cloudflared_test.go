@@ -7,6 +7,12 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // MockCommander is a mock for the Commander interface.
@@ -120,3 +126,69 @@ func TestGetCloudflareAccessTokenForAppWithMock(t *testing.T) {
 		mockCmdr.AssertExpectations(t)
 	})
 }
+
+func TestGetCloudflareAccessTokenForAppSpans(t *testing.T) {
+	originalCmdr := cmdr
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		cmdr = originalCmdr
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	mockCmdr := new(MockCommander)
+	cmdr = mockCmdr
+	mockCmdr.On("CombinedOutput", "cloudflared", "access", "login", "app.example.com").Return([]byte(""), nil)
+	mockCmdr.On("CombinedOutput", "cloudflared", "access", "token", "-app=app.example.com").Return([]byte("error"), errors.New("exit status 1"))
+
+	_, err := GetCloudflareAccessTokenForApp("app.example.com")
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "cloudflared access login", spans[0].Name())
+	assert.Equal(t, "cloudflared access token", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "cloudflared.GetCloudflareAccessTokenForApp", spans[2].Name())
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[0].Parent().SpanID())
+}
+
+// envCommander records the environment it is given.
+type envCommander struct {
+	*MockCommander
+	env []string
+}
+
+func (c *envCommander) WithEnv(env []string) Commander {
+	c.env = env
+	return c
+}
+
+func TestGetCloudflareAccessTokenForAppWithEnv(t *testing.T) {
+	originalCmdr := cmdr
+	t.Cleanup(func() {
+		cmdr = originalCmdr
+	})
+
+	mockCmdr := &envCommander{MockCommander: new(MockCommander)}
+	cmdr = mockCmdr
+	mockCmdr.On("CombinedOutput", "cloudflared", "access", "login", "app.example.com").Return([]byte(""), nil)
+	mockCmdr.On("CombinedOutput", "cloudflared", "access", "token", "-app=app.example.com").Return([]byte("mock-token"), nil)
+
+	token, err := GetCloudflareAccessTokenForApp("app.example.com", WithEnv("HTTPS_PROXY=http://proxy.corp:3128"))
+	require.NoError(t, err)
+	assert.Equal(t, "mock-token", token)
+	assert.Equal(t, []string{"HTTPS_PROXY=http://proxy.corp:3128"}, mockCmdr.env)
+}
+
+func TestExecCommanderWithEnv(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	t.Setenv("HTTPS_PROXY", "http://old.corp:3128")
+
+	output, err := (&execCommander{}).WithEnv([]string{"HTTPS_PROXY=http://proxy.corp:3128"}).CombinedOutput("sh", "-c", "echo $HTTPS_PROXY")
+	require.NoError(t, err)
+	assert.Equal(t, "http://proxy.corp:3128\n", string(output))
+}
@@ -0,0 +1,42 @@
+package options
+
+import (
+	"fmt"
+	"time"
+)
+
+// Strategies choosing the upstream of each request.
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyPrimaryBackup    = "primary-backup"
+)
+
+// Defaults of the LoadBalancing options.
+const (
+	DefaultMaxFails    = 1
+	DefaultFailTimeout = 10 * time.Second
+)
+
+// LoadBalancing chooses the upstream of each request. An upstream failing
+// MaxFails requests in a row is marked down for FailTimeout, during which it
+// only receives requests if every upstream is down.
+type LoadBalancing struct {
+	Strategy    string // One of the Strategy constants, round-robin by default
+	MaxFails    int
+	FailTimeout time.Duration
+}
+
+// Checks the strategy, and that no limit is negative.
+func (o LoadBalancing) Validate() error {
+	switch o.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections, StrategyPrimaryBackup:
+	default:
+		return fmt.Errorf("unsupported load balancing strategy '%s', expected %s, %s or %s", o.Strategy, StrategyRoundRobin, StrategyLeastConnections, StrategyPrimaryBackup)
+	}
+	return checkNonNegative([]namedValue[time.Duration]{
+		{"fail timeout", o.FailTimeout},
+	}, []namedValue[int]{
+		{"max fails", o.MaxFails},
+	})
+}
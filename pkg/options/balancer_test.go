@@ -0,0 +1,33 @@
+package options
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBalancingOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     LoadBalancing
+		expectedErr string
+	}{
+		{name: "defaults"},
+		{name: "set", options: LoadBalancing{Strategy: StrategyPrimaryBackup, MaxFails: 3, FailTimeout: time.Minute}},
+		{name: "unknown strategy", options: LoadBalancing{Strategy: "random"},
+			expectedErr: "unsupported load balancing strategy 'random', expected round-robin, least-connections or primary-backup"},
+		{name: "negative max fails", options: LoadBalancing{MaxFails: -1}, expectedErr: "max fails cannot be negative"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package options
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Defaults of the Cache options.
+const (
+	DefaultCacheMaxSize      = 64 << 20
+	DefaultCacheMaxEntrySize = 8 << 20
+)
+
+// Cache configures the cache of the responses of a proxy. The cache follows
+// the rules of a private cache, as a browser would, scoped to the identity
+// of the Access token: entries cached for one user are never served to
+// another. It is disabled unless Enabled is set; other zero values select
+// the defaults.
+type Cache struct {
+	Enabled      bool
+	MaxSize      int64  // Bytes of responses kept, the least recently used being evicted
+	MaxEntrySize int64  // Largest response body cached
+	Dir          string // Directory keeping the responses on disk instead of in memory
+}
+
+// Checks that no size is negative and that an entry fits in the cache.
+func (o Cache) Validate() error {
+	if o.MaxSize < 0 {
+		return errors.New("max size cannot be negative")
+	}
+	if o.MaxEntrySize < 0 {
+		return errors.New("max entry size cannot be negative")
+	}
+	if o.MaxSize > 0 && o.MaxEntrySize > o.MaxSize {
+		return fmt.Errorf("max entry size %d is greater than max size %d", o.MaxEntrySize, o.MaxSize)
+	}
+	return nil
+}
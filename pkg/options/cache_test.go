@@ -0,0 +1,32 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     Cache
+		expectedErr string
+	}{
+		{name: "defaults"},
+		{name: "set", options: Cache{Enabled: true, MaxSize: 1 << 20, MaxEntrySize: 1 << 10, Dir: "/tmp/cache"}},
+		{name: "negative max size", options: Cache{MaxSize: -1}, expectedErr: "max size cannot be negative"},
+		{name: "negative max entry size", options: Cache{MaxEntrySize: -1}, expectedErr: "max entry size cannot be negative"},
+		{name: "entry above max size", options: Cache{MaxSize: 10, MaxEntrySize: 20}, expectedErr: "max entry size 20 is greater than max size 10"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
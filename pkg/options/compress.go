@@ -0,0 +1,59 @@
+package options
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Content codings negotiated with the local clients.
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// DefaultCompressionMinSize is the smallest body compressed unless set
+// otherwise, below which compression does not pay off.
+const DefaultCompressionMinSize = 1024
+
+// Returns the codings offered to clients unless set otherwise, in order of
+// preference.
+func DefaultCompressionEncodings() []string {
+	return []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+}
+
+// Compression configures the compression of the responses of a proxy.
+// Upstreams are asked for compressed responses, which are served as they
+// are to the clients accepting their coding, and decoded and compressed
+// again as preferred by the others. It is disabled unless Enabled is set;
+// other zero values select the defaults.
+type Compression struct {
+	Enabled      bool
+	Encodings    []string // Codings offered to clients, in order of preference
+	ContentTypes []string // Media types compressed, TYPE/* matching every subtype
+	MinSize      int64    // Smallest body compressed, when its length is known
+}
+
+// Checks the codings and media types, and that the size is not negative.
+func (o Compression) Validate() error {
+	for i, encoding := range o.Encodings {
+		if !slices.Contains(DefaultCompressionEncodings(), encoding) {
+			return fmt.Errorf("unsupported encoding '%s', expected %s, %s or %s", encoding, EncodingBrotli, EncodingZstd, EncodingGzip)
+		}
+		if slices.Contains(o.Encodings[:i], encoding) {
+			return fmt.Errorf("duplicate encoding '%s'", encoding)
+		}
+	}
+	for _, contentType := range o.ContentTypes {
+		mediaType, subtype, ok := strings.Cut(contentType, "/")
+		if !ok || mediaType == "" || subtype == "" || strings.ContainsAny(contentType, " ;,") {
+			return fmt.Errorf("invalid content type '%s', expected TYPE/SUBTYPE or TYPE/*", contentType)
+		}
+	}
+	if o.MinSize < 0 {
+		return errors.New("min size cannot be negative")
+	}
+	return nil
+}
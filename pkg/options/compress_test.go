@@ -0,0 +1,34 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     Compression
+		expectedErr string
+	}{
+		{name: "defaults"},
+		{name: "set", options: Compression{Enabled: true, Encodings: []string{"gzip", "br"}, ContentTypes: []string{"text/*", "application/json"}, MinSize: 512}},
+		{name: "unknown encoding", options: Compression{Encodings: []string{"deflate"}}, expectedErr: "unsupported encoding 'deflate', expected br, zstd or gzip"},
+		{name: "duplicate encoding", options: Compression{Encodings: []string{"gzip", "gzip"}}, expectedErr: "duplicate encoding 'gzip'"},
+		{name: "invalid content type", options: Compression{ContentTypes: []string{"text"}}, expectedErr: "invalid content type 'text', expected TYPE/SUBTYPE or TYPE/*"},
+		{name: "content type with parameters", options: Compression{ContentTypes: []string{"text/html; charset=utf-8"}}, expectedErr: "invalid content type 'text/html; charset=utf-8', expected TYPE/SUBTYPE or TYPE/*"},
+		{name: "negative min size", options: Compression{MinSize: -1}, expectedErr: "min size cannot be negative"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package options
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Policies for the X-Forwarded-* and Forwarded headers sent to the origin.
+const (
+	// ForwardedPreserve keeps the headers of the client and appends its
+	// address to X-Forwarded-For.
+	ForwardedPreserve = "preserve"
+	// ForwardedSet replaces the headers with X-Forwarded-For, -Host and
+	// -Proto describing the client, extending those of trusted proxies.
+	ForwardedSet = "set"
+	// ForwardedStrip removes the headers.
+	ForwardedStrip = "strip"
+	// ForwardedRFC7239 replaces the headers with a Forwarded header,
+	// extending that of trusted proxies.
+	ForwardedRFC7239 = "rfc7239"
+)
+
+// Checks a forwarding header policy, which may be empty, and the trusted
+// proxies, given as IP addresses or CIDR ranges.
+func ValidateForwarding(policy string, trustedProxies []string) error {
+	if _, err := ForwardingPolicy(policy); err != nil {
+		return err
+	}
+	_, err := ParseTrustedProxies(trustedProxies)
+	return err
+}
+
+// Returns a forwarding header policy, ForwardedPreserve if empty.
+func ForwardingPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return ForwardedPreserve, nil
+	case ForwardedPreserve, ForwardedSet, ForwardedStrip, ForwardedRFC7239:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unsupported forwarded headers policy '%s', expected %s, %s, %s or %s", policy, ForwardedPreserve, ForwardedSet, ForwardedStrip, ForwardedRFC7239)
+}
+
+// Returns the ranges of trusted proxies given as IP addresses or CIDR ranges.
+func ParseTrustedProxies(trustedProxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, trusted := range trustedProxies {
+		prefix, err := netip.ParsePrefix(trusted)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(trusted)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s', expected an IP address or CIDR range", trusted)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
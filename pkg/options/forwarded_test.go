@@ -0,0 +1,32 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateForwarding(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		trustedProxies []string
+		expectedErr    string
+	}{
+		{name: "default"},
+		{name: "rfc7239 with trusted proxies", policy: ForwardedRFC7239, trustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "::1", "fd00::/8"}},
+		{name: "unsupported policy", policy: "replace", expectedErr: "unsupported forwarded headers policy 'replace', expected preserve, set, strip or rfc7239"},
+		{name: "invalid trusted proxy", policy: ForwardedSet, trustedProxies: []string{"proxy.local"}, expectedErr: "invalid trusted proxy 'proxy.local', expected an IP address or CIDR range"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateForwarding(tc.policy, tc.trustedProxies)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
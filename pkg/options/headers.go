@@ -0,0 +1,72 @@
+package options
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// HeaderRules are the headers changed in a request or response. Removals are
+// applied first, then Set and Add. Values are text/template templates
+// executed with HeaderVars.
+type HeaderRules struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+// HeaderVars are the variables available to the header templates.
+type HeaderVars struct {
+	Name         string // Name of the proxy
+	ClientIP     string // IP address of the client of the proxy
+	TokenSubject string // Subject of the Access token
+	TokenEmail   string // Email of the Access token
+}
+
+// Checks the header names and templates of the rules, executing the
+// templates once so that unknown variables are reported before any request
+// is proxied.
+func (r HeaderRules) Validate() error {
+	for _, name := range r.Remove {
+		if !ValidHeaderName(name) {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+	}
+	for _, headers := range []map[string]string{r.Set, r.Add} {
+		for _, name := range slices.Sorted(maps.Keys(headers)) {
+			if !ValidHeaderName(name) {
+				return fmt.Errorf("invalid header name '%s'", name)
+			}
+			tmpl, err := ParseHeaderTemplate(name, headers[name])
+			if err != nil {
+				return fmt.Errorf("invalid value of header '%s', %v", name, err)
+			}
+			if err := tmpl.Execute(io.Discard, HeaderVars{}); err != nil {
+				return fmt.Errorf("invalid value of header '%s', %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses the value of the header name as a template executed with
+// HeaderVars.
+func ParseHeaderTemplate(name, value string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(value)
+}
+
+// Reports whether name is a valid HTTP header name (RFC 9110 token).
+func ValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
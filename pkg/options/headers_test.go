@@ -0,0 +1,33 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderRulesValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		rules       HeaderRules
+		expectedErr string
+	}{
+		{name: "empty", rules: HeaderRules{}},
+		{name: "valid", rules: HeaderRules{Set: map[string]string{"X-Forwarded-User": "{{ .TokenEmail }}"}, Add: map[string]string{"X-Tenant": "acme"}, Remove: []string{"Server"}}},
+		{name: "invalid header name", rules: HeaderRules{Set: map[string]string{"X Forwarded": "a"}}, expectedErr: "invalid header name 'X Forwarded'"},
+		{name: "invalid removed header name", rules: HeaderRules{Remove: []string{"X:Y"}}, expectedErr: "invalid header name 'X:Y'"},
+		{name: "invalid template", rules: HeaderRules{Add: map[string]string{"X-User": "{{ .TokenEmail"}}, expectedErr: "invalid value of header 'X-User'"},
+		{name: "unknown variable", rules: HeaderRules{Set: map[string]string{"X-User": "{{ .User }}"}}, expectedErr: "can't evaluate field User"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rules.Validate()
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
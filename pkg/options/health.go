@@ -0,0 +1,43 @@
+package options
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults of the HealthCheck options.
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// HealthCheck configures the checks of the upstreams of a proxy, run in the
+// background with the token of each upstream. Health checks are disabled
+// unless Path is set; other zero values select the defaults.
+type HealthCheck struct {
+	Path           string        // Path requested, below the base path of the upstream
+	Interval       time.Duration // Delay between two checks of an upstream
+	Timeout        time.Duration // Timeout of a check
+	ExpectedStatus int           // Status of a healthy upstream, any 2xx status by default
+}
+
+// Checks the path and status, and that no duration is negative or the
+// timeout longer than the interval.
+func (o HealthCheck) Validate() error {
+	if o.Path != "" && o.Path[0] != '/' {
+		return fmt.Errorf("health check path '%s' must start with /", o.Path)
+	}
+	if o.ExpectedStatus != 0 && (o.ExpectedStatus < 100 || o.ExpectedStatus > 599) {
+		return fmt.Errorf("invalid expected status %d", o.ExpectedStatus)
+	}
+	if err := checkNonNegative([]namedValue[time.Duration]{
+		{"interval", o.Interval},
+		{"timeout", o.Timeout},
+	}, nil); err != nil {
+		return err
+	}
+	if o.Interval > 0 && o.Timeout > o.Interval {
+		return fmt.Errorf("timeout %v is greater than interval %v", o.Timeout, o.Interval)
+	}
+	return nil
+}
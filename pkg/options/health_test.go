@@ -0,0 +1,35 @@
+package options
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     HealthCheck
+		expectedErr string
+	}{
+		{name: "disabled"},
+		{name: "set", options: HealthCheck{Path: "/healthz", Interval: time.Minute, Timeout: time.Second, ExpectedStatus: 204}},
+		{name: "relative path", options: HealthCheck{Path: "healthz"}, expectedErr: "health check path 'healthz' must start with /"},
+		{name: "invalid status", options: HealthCheck{Path: "/", ExpectedStatus: 999}, expectedErr: "invalid expected status 999"},
+		{name: "negative interval", options: HealthCheck{Interval: -time.Second}, expectedErr: "interval cannot be negative"},
+		{name: "timeout above interval", options: HealthCheck{Interval: time.Second, Timeout: time.Minute},
+			expectedErr: "timeout 1m0s is greater than interval 1s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+// Package options defines the options of a proxy shared by the config file
+// and the proxy: their values, defaults and validation. It depends on no
+// other package of the module, so that a configuration can be checked
+// without starting any proxy.
+package options
+
+import (
+	"fmt"
+	"time"
+)
+
+type namedValue[T time.Duration | int] struct {
+	name  string
+	value T
+}
+
+// Returns an error for the first negative duration or count.
+func checkNonNegative(durations []namedValue[time.Duration], counts []namedValue[int]) error {
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%s cannot be negative", d.name)
+		}
+	}
+	for _, n := range counts {
+		if n.value < 0 {
+			return fmt.Errorf("%s cannot be negative", n.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package options
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Prefixes of the certificate pins.
+const (
+	// PinSPKI pins the SHA-256 hash of a public key, base64 encoded. It
+	// matches any certificate of the verified chain, so that a CA key can be
+	// pinned, or the leaf when verification is skipped.
+	PinSPKI = "spki-sha256:"
+	// PinCert pins the SHA-256 fingerprint of the leaf certificate, hex
+	// encoded with optional colons.
+	PinCert = "cert-sha256:"
+)
+
+// Pin is a parsed certificate pin.
+type Pin struct {
+	SPKI bool   // Hash of a public key rather than of the leaf certificate
+	Hash []byte // SHA-256 hash
+}
+
+// Parses pins in the PinSPKI or PinCert formats.
+func ParsePins(pins []string) ([]Pin, error) {
+	parsed := make([]Pin, 0, len(pins))
+	for _, pin := range pins {
+		var p Pin
+		var err error
+		switch {
+		case strings.HasPrefix(pin, PinSPKI):
+			p.SPKI = true
+			p.Hash, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, PinSPKI))
+		case strings.HasPrefix(pin, PinCert):
+			p.Hash, err = hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(pin, PinCert), ":", ""))
+		default:
+			return nil, fmt.Errorf("invalid pin '%s', expected %s<BASE64> or %s<HEX>", pin, PinSPKI, PinCert)
+		}
+		if err != nil || len(p.Hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin '%s', expected a SHA-256 hash", pin)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,38 @@
+package options
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePins(t *testing.T) {
+	hash := sha256.Sum256([]byte("key"))
+	testCases := []struct {
+		name        string
+		pin         string
+		expectedErr string
+	}{
+		{name: "spki", pin: PinSPKI + base64.StdEncoding.EncodeToString(hash[:])},
+		{name: "cert", pin: PinCert + hex.EncodeToString(hash[:])},
+		{name: "uppercase cert", pin: PinCert + strings.ToUpper(hex.EncodeToString(hash[:]))},
+		{name: "unknown prefix", pin: "sha256/abc", expectedErr: "invalid pin 'sha256/abc', expected spki-sha256:<BASE64> or cert-sha256:<HEX>"},
+		{name: "short hash", pin: PinSPKI + "YWJj", expectedErr: "invalid pin 'spki-sha256:YWJj', expected a SHA-256 hash"},
+		{name: "invalid hex", pin: PinCert + "xyz", expectedErr: "invalid pin 'cert-sha256:xyz', expected a SHA-256 hash"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePins([]string{tc.pin})
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
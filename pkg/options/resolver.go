@@ -0,0 +1,95 @@
+package options
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// HostOverride dials Addresses instead of resolving Host, as an entry of
+// /etc/hosts would.
+type HostOverride struct {
+	Host      string
+	Addresses []string // IP addresses, tried in order
+}
+
+// Checks host overrides: a hostname, given once, and IP addresses.
+func ValidateResolve(overrides []HostOverride) error {
+	_, err := ParseOverrides(overrides)
+	return err
+}
+
+// Checks a DNS server: empty for the system resolver, an IP address with an
+// optional port, a udp:// or tcp:// URL of an IP address, or the https:// URL
+// of a DNS over HTTPS server.
+func ValidateDNSServer(server string) error {
+	_, err := ParseDNSServer(server)
+	return err
+}
+
+// Returns the addresses of the overridden hosts by lowercase hostname.
+func ParseOverrides(overrides []HostOverride) (map[string][]netip.Addr, error) {
+	parsed := make(map[string][]netip.Addr, len(overrides))
+	for _, o := range overrides {
+		host := strings.ToLower(strings.TrimSuffix(o.Host, "."))
+		if host == "" {
+			return nil, errors.New("host override without a host")
+		}
+		if _, ok := parsed[host]; ok {
+			return nil, fmt.Errorf("host '%s' is overridden twice", o.Host)
+		}
+		if len(o.Addresses) == 0 {
+			return nil, fmt.Errorf("host override of '%s' has no addresses", o.Host)
+		}
+		addrs := make([]netip.Addr, 0, len(o.Addresses))
+		for _, a := range o.Addresses {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address '%s' of host '%s', expected an IP address", a, o.Host)
+			}
+			addrs = append(addrs, addr.Unmap())
+		}
+		parsed[host] = addrs
+	}
+	return parsed, nil
+}
+
+// Returns the URL of a DNS server, with a udp, tcp or https scheme, or nil
+// for the system resolver.
+func ParseDNSServer(server string) (*url.URL, error) {
+	if server == "" {
+		return nil, nil
+	}
+	if addr, err := netip.ParseAddr(server); err == nil {
+		server = "udp://" + net.JoinHostPort(addr.String(), "53")
+	} else if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server, %v", err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("DNS server '%s' has no host", server)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+	case "udp", "tcp":
+		if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("DNS server '%s' must be an IP address", u.Host)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "53")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DNS server scheme '%s', expected udp, tcp or https", u.Scheme)
+	}
+	return u, nil
+}
@@ -0,0 +1,74 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResolve(t *testing.T) {
+	testCases := []struct {
+		name        string
+		overrides   []HostOverride
+		expectedErr string
+	}{
+		{name: "none"},
+		{name: "valid", overrides: []HostOverride{{Host: "app.example.com", Addresses: []string{"192.0.2.10", "2001:db8::10"}}}},
+		{name: "no host", overrides: []HostOverride{{Addresses: []string{"192.0.2.10"}}}, expectedErr: "host override without a host"},
+		{name: "no addresses", overrides: []HostOverride{{Host: "app.example.com"}}, expectedErr: "host override of 'app.example.com' has no addresses"},
+		{name: "hostname address", overrides: []HostOverride{{Host: "app.example.com", Addresses: []string{"edge.example.com"}}},
+			expectedErr: "invalid address 'edge.example.com' of host 'app.example.com', expected an IP address"},
+		{name: "duplicate host", overrides: []HostOverride{
+			{Host: "app.example.com", Addresses: []string{"192.0.2.10"}},
+			{Host: "App.Example.com.", Addresses: []string{"192.0.2.11"}},
+		}, expectedErr: "host 'App.Example.com.' is overridden twice"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateResolve(tc.overrides)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	testCases := []struct {
+		name        string
+		server      string
+		expectedURL string
+		expectedErr string
+	}{
+		{name: "system"},
+		{name: "ipv4", server: "1.1.1.1", expectedURL: "udp://1.1.1.1:53"},
+		{name: "ipv6", server: "2606:4700::1111", expectedURL: "udp://[2606:4700::1111]:53"},
+		{name: "ip and port", server: "10.0.0.53:5353", expectedURL: "udp://10.0.0.53:5353"},
+		{name: "tcp", server: "tcp://10.0.0.53", expectedURL: "tcp://10.0.0.53:53"},
+		{name: "doh", server: "https://cloudflare-dns.com/dns-query", expectedURL: "https://cloudflare-dns.com/dns-query"},
+		{name: "doh default path", server: "https://1.1.1.1", expectedURL: "https://1.1.1.1/dns-query"},
+		{name: "hostname", server: "dns.example.com", expectedErr: "DNS server 'dns.example.com' must be an IP address"},
+		{name: "unsupported scheme", server: "tls://1.1.1.1", expectedErr: "unsupported DNS server scheme 'tls', expected udp, tcp or https"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := ParseDNSServer(tc.server)
+			switch {
+			case tc.expectedErr != "":
+				assert.EqualError(t, err, tc.expectedErr)
+				assert.EqualError(t, ValidateDNSServer(tc.server), tc.expectedErr)
+			case tc.expectedURL == "":
+				require.NoError(t, err)
+				assert.Nil(t, u)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedURL, u.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package options
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults of the Retry options.
+const (
+	DefaultRetryInitialBackoff   = 100 * time.Millisecond
+	DefaultRetryMaxBackoff       = 2 * time.Second
+	DefaultRetryMaxBodySize      = 1 << 20
+	DefaultRetryBudgetRatio      = 0.2
+	DefaultRetryBudgetMinRetries = 10
+)
+
+// Retry configures the retries of idempotent requests failing with a
+// connection error or a 502, 503 or 504 response. Retries are disabled
+// unless MaxRetries is set; other zero values select the defaults.
+type Retry struct {
+	MaxRetries     int           // Retries of a request after the first attempt
+	InitialBackoff time.Duration // Delay before the first retry, doubled for each one
+	MaxBackoff     time.Duration // Maximum delay between retries
+	MaxBodySize    int64         // Largest request body buffered so it can be resent
+	// BudgetRatio caps the retries to this ratio of the requests of the last
+	// 10 seconds, while allowing at least BudgetMinRetries.
+	BudgetRatio      float64
+	BudgetMinRetries int
+}
+
+// Checks that no setting is negative and the backoffs are ordered.
+func (o Retry) Validate() error {
+	if err := checkNonNegative([]namedValue[time.Duration]{
+		{"initial backoff", o.InitialBackoff},
+		{"max backoff", o.MaxBackoff},
+	}, []namedValue[int]{
+		{"max retries", o.MaxRetries},
+		{"budget min retries", o.BudgetMinRetries},
+	}); err != nil {
+		return err
+	}
+	if o.MaxBodySize < 0 {
+		return errors.New("max body size cannot be negative")
+	}
+	if o.BudgetRatio < 0 {
+		return errors.New("budget ratio cannot be negative")
+	}
+	if o.InitialBackoff > 0 && o.MaxBackoff > 0 && o.InitialBackoff > o.MaxBackoff {
+		return fmt.Errorf("initial backoff %v is greater than max backoff %v", o.InitialBackoff, o.MaxBackoff)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package options
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     Retry
+		expectedErr string
+	}{
+		{name: "disabled"},
+		{name: "set", options: Retry{MaxRetries: 3, InitialBackoff: time.Second, MaxBackoff: time.Second, MaxBodySize: 1024, BudgetRatio: 0.5}},
+		{name: "negative retries", options: Retry{MaxRetries: -1}, expectedErr: "max retries cannot be negative"},
+		{name: "negative body size", options: Retry{MaxBodySize: -1}, expectedErr: "max body size cannot be negative"},
+		{name: "negative ratio", options: Retry{BudgetRatio: -0.1}, expectedErr: "budget ratio cannot be negative"},
+		{name: "unordered backoffs", options: Retry{InitialBackoff: time.Minute, MaxBackoff: time.Second}, expectedErr: "initial backoff 1m0s is greater than max backoff 1s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package options
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TLS configures the TLS connections of a proxy to its upstream.
+type TLS struct {
+	CAFile       string   // PEM bundle of CAs trusted in addition to the system ones
+	ServerName   string   // Server name sent in the SNI extension and verified
+	ClientCert   string   // PEM certificate presented to the upstream
+	ClientKey    string   // PEM private key of ClientCert
+	MinVersion   string   // Minimum TLS version, 1.0 to 1.3, 1.2 by default
+	CipherSuites []string // Names of the TLS 1.0-1.2 cipher suites allowed
+	Pins         []string // Certificate pins, see PinSPKI and PinCert
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Checks the options, loading the CA bundle and client certificate.
+func (o TLS) Validate() error {
+	if _, err := o.Config(); err != nil {
+		return err
+	}
+	_, err := ParsePins(o.Pins)
+	return err
+}
+
+// Returns the tls.Config of the options, with the CA bundle and client
+// certificate loaded. Pins are left to the caller.
+func (o TLS) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(o.MinVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version '%s', expected 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	for _, name := range o.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	if len(cfg.CipherSuites) > 0 && cfg.MinVersion == tls.VersionTLS13 {
+		return nil, errors.New("cipher suites cannot be set with minimum TLS version 1.3, whose suites are not configurable")
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file, %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file '%s'", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	switch {
+	case o.ClientCert != "" && o.ClientKey != "":
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate, %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case o.ClientCert != "":
+		return nil, errors.New("client certificate requires a client key")
+	case o.ClientKey != "":
+		return nil, errors.New("client key requires a client certificate")
+	}
+
+	return cfg, nil
+}
+
+// Returns the ID of a secure cipher suite given by its name.
+func cipherSuite(name string) (uint16, error) {
+	suites := tls.CipherSuites()
+	i := slices.IndexFunc(suites, func(s *tls.CipherSuite) bool { return strings.EqualFold(s.Name, name) })
+	if i == -1 {
+		if slices.ContainsFunc(tls.InsecureCipherSuites(), func(s *tls.CipherSuite) bool { return strings.EqualFold(s.Name, name) }) {
+			return 0, fmt.Errorf("insecure cipher suite '%s' is not supported", name)
+		}
+		return 0, fmt.Errorf("unknown cipher suite '%s'", name)
+	}
+	if !slices.Contains(suites[i].SupportedVersions, tls.VersionTLS12) {
+		return 0, fmt.Errorf("cipher suite '%s' is only used by TLS 1.3 and cannot be configured", name)
+	}
+	return suites[i].ID, nil
+}
@@ -0,0 +1,84 @@
+package options
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes a self-signed CA certificate, also usable as a client certificate,
+// returning the paths of its PEM certificate and key files.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestTLSOptionsValidate(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(emptyFile, []byte("not a certificate"), 0o600))
+
+	testCases := []struct {
+		name        string
+		options     TLS
+		expectedErr string
+	}{
+		{name: "defaults"},
+		{name: "all set", options: TLS{CAFile: certFile, ServerName: "app.internal", ClientCert: certFile, ClientKey: keyFile, MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}},
+		{name: "tls prefixed version", options: TLS{MinVersion: "TLS1.3"}},
+		{name: "unsupported version", options: TLS{MinVersion: "1.4"}, expectedErr: "unsupported minimum TLS version '1.4', expected 1.0, 1.1, 1.2 or 1.3"},
+		{name: "unknown cipher suite", options: TLS{CipherSuites: []string{"TLS_FAST"}}, expectedErr: "unknown cipher suite 'TLS_FAST'"},
+		{name: "insecure cipher suite", options: TLS{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, expectedErr: "insecure cipher suite 'TLS_RSA_WITH_RC4_128_SHA' is not supported"},
+		{name: "tls 1.3 cipher suite", options: TLS{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, expectedErr: "cipher suite 'TLS_AES_128_GCM_SHA256' is only used by TLS 1.3 and cannot be configured"},
+		{name: "cipher suites with tls 1.3", options: TLS{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, expectedErr: "cipher suites cannot be set with minimum TLS version 1.3, whose suites are not configurable"},
+		{name: "missing CA file", options: TLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, expectedErr: "unable to read CA file"},
+		{name: "empty CA file", options: TLS{CAFile: emptyFile}, expectedErr: "no certificate found in CA file"},
+		{name: "certificate without key", options: TLS{ClientCert: certFile}, expectedErr: "client certificate requires a client key"},
+		{name: "key without certificate", options: TLS{ClientKey: keyFile}, expectedErr: "client key requires a client certificate"},
+		{name: "mismatched key", options: TLS{ClientCert: certFile, ClientKey: certFile}, expectedErr: "unable to load client certificate"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
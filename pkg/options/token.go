@@ -0,0 +1,32 @@
+package options
+
+import (
+	"fmt"
+)
+
+// Ways of passing the Access token to the origin.
+const (
+	TokenTransportHeader = "header"
+	TokenTransportCookie = "cookie"
+	TokenTransportBoth   = "both"
+)
+
+// DefaultTokenHeader is the header carrying the token unless set otherwise.
+const DefaultTokenHeader = "cf-access-token"
+
+// Checks a token transport and header name, either of which may be empty.
+func ValidateTokenTransport(transport, header string) error {
+	switch transport {
+	case "", TokenTransportHeader, TokenTransportBoth:
+	case TokenTransportCookie:
+		if header != "" {
+			return fmt.Errorf("token header '%s' conflicts with token transport '%s'", header, transport)
+		}
+	default:
+		return fmt.Errorf("unsupported token transport '%s', expected %s, %s or %s", transport, TokenTransportHeader, TokenTransportCookie, TokenTransportBoth)
+	}
+	if header != "" && !ValidHeaderName(header) {
+		return fmt.Errorf("invalid header name '%s'", header)
+	}
+	return nil
+}
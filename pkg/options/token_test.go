@@ -0,0 +1,35 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTokenTransport(t *testing.T) {
+	testCases := []struct {
+		name        string
+		transport   string
+		header      string
+		expectedErr string
+	}{
+		{name: "default"},
+		{name: "header", transport: TokenTransportHeader, header: "X-Access-Token"},
+		{name: "cookie", transport: TokenTransportCookie},
+		{name: "both", transport: TokenTransportBoth, header: "X-Access-Token"},
+		{name: "unsupported transport", transport: "query", expectedErr: "unsupported token transport 'query', expected header, cookie or both"},
+		{name: "header with cookie transport", transport: TokenTransportCookie, header: "X-Access-Token", expectedErr: "token header 'X-Access-Token' conflicts with token transport 'cookie'"},
+		{name: "invalid header", header: "X Token", expectedErr: "invalid header name 'X Token'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateTokenTransport(tc.transport, tc.header)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package options
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Defaults of the Transport, those of http.DefaultTransport.
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConns        = 100
+)
+
+// UpstreamProxyDirect disables the proxy of the environment.
+const UpstreamProxyDirect = "direct"
+
+// Transport tunes the connections of a proxy to its upstream. Zero values
+// select the defaults, or no limit if there is none.
+type Transport struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration // Interval of TCP keep-alive probes
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	HTTP2                 bool // Attempt HTTP/2 to the upstream
+	DisableKeepAlives     bool // Use each connection for a single request
+}
+
+// Server holds the timeouts of the local listener of a proxy. Zero values
+// mean no timeout.
+type Server struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// Checks that no timeout or limit is negative.
+func (o Transport) Validate() error {
+	return checkNonNegative([]namedValue[time.Duration]{
+		{"dial timeout", o.DialTimeout},
+		{"keep-alive", o.KeepAlive},
+		{"TLS handshake timeout", o.TLSHandshakeTimeout},
+		{"response header timeout", o.ResponseHeaderTimeout},
+		{"idle connection timeout", o.IdleConnTimeout},
+	}, []namedValue[int]{
+		{"max idle connections", o.MaxIdleConns},
+		{"max idle connections per host", o.MaxIdleConnsPerHost},
+		{"max connections per host", o.MaxConnsPerHost},
+	})
+}
+
+// Checks that no timeout is negative.
+func (o Server) Validate() error {
+	return checkNonNegative([]namedValue[time.Duration]{
+		{"read timeout", o.ReadTimeout},
+		{"read header timeout", o.ReadHeaderTimeout},
+		{"write timeout", o.WriteTimeout},
+		{"idle timeout", o.IdleTimeout},
+	}, nil)
+}
+
+// Checks an outbound proxy: empty to use the proxy of the environment,
+// UpstreamProxyDirect, or an http, https, socks5 or socks5h URL, which may
+// hold credentials.
+func ValidateUpstreamProxy(upstreamProxy string) error {
+	if upstreamProxy == "" || upstreamProxy == UpstreamProxyDirect {
+		return nil
+	}
+	_, err := ParseUpstreamProxy(upstreamProxy)
+	return err
+}
+
+// Returns the URL of an outbound proxy, neither empty nor UpstreamProxyDirect.
+func ParseUpstreamProxy(upstreamProxy string) (*url.URL, error) {
+	u, err := url.Parse(upstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy, %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme '%s', expected http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream proxy '%s' has no host", u.Redacted())
+	}
+	return u, nil
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// Upstream is an application a proxy forwards to, with its own token.
+type Upstream struct {
+	Url   *url.URL
+	Token string
+	// Reauthenticate logs in again and returns a fresh token. If set, error
+	// pages link to a path of the proxy calling it.
+	Reauthenticate func() (string, error)
+}
+
+// LoadBalancingOptions choose the upstream of each request.
+type LoadBalancingOptions = options.LoadBalancing
+
+// Checks that there is at least one upstream and that each has a URL.
+func validateUpstreams(upstreams []Upstream) error {
+	if len(upstreams) == 0 {
+		return errors.New("no upstream")
+	}
+	for i, u := range upstreams {
+		if u.Url == nil || u.Url.Host == "" {
+			return fmt.Errorf("upstream %d has no URL", i)
+		}
+	}
+	return nil
+}
+
+// upstream is an Upstream along with its token and health.
+type upstream struct {
+	Upstream
+	tokens *tokenStore
+	active atomic.Int64 // Requests in flight
+
+	mu        sync.Mutex
+	fails     int // Consecutive failures
+	downUntil time.Time
+
+	health health // Outcome of the health checks
+}
+
+func newUpstream(u Upstream) *upstream {
+	return &upstream{Upstream: u, tokens: newTokenStore(u.Token)}
+}
+
+// Returns the current token of the upstream.
+func (u *upstream) currentToken() string {
+	return *u.tokens.token.Load()
+}
+
+// Returns the URL of the upstream, for logs and error pages.
+func (u *upstream) String() string {
+	if u.Url == nil {
+		return ""
+	}
+	return u.Url.String()
+}
+
+// Reports whether the upstream is not marked down at now, either by failed
+// requests or by its health checks.
+func (u *upstream) available(now time.Time) bool {
+	if state := u.health.state(); state == HealthDown || state == HealthTokenExpired {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+// upstreamKey is the context key of the route of a request.
+type upstreamKey struct{}
+
+// route is where a request is sent: its upstream, replaced when a retry
+// moves to another one, and its local path, to which the base path of the
+// upstream is prepended.
+type route struct {
+	upstream      atomic.Pointer[upstream]
+	path, rawPath string
+}
+
+// Points req at u: its URL, Host and token.
+func (c CFAccessProxyConfig) sendTo(req *http.Request, r *route, u *upstream) {
+	r.upstream.Store(u)
+	req.URL.Scheme = u.Url.Scheme
+	req.URL.Host = u.Url.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(u.Url, &url.URL{Path: r.path, RawPath: r.rawPath})
+	req.Host = u.Url.Host
+	setToken(req, c, u.currentToken())
+}
+
+// Returns a copy of req sent to the upstream the balancer picks now, which
+// skips the upstreams marked down by the previous attempts, or req itself if
+// it stays on its upstream.
+func (c CFAccessProxyConfig) reroute(req *http.Request) *http.Request {
+	r, ok := req.Context().Value(upstreamKey{}).(*route)
+	if !ok || c.balancer == nil || len(c.balancer.upstreams) < 2 {
+		return req
+	}
+	u := c.balancer.pick()
+	if u == r.upstream.Load() {
+		return req
+	}
+	logger.Debug("proxy.Proxy", "Moving %s %s of proxy %s from upstream %s to %s", req.Method, r.path, c.Name, r.upstream.Load(), u)
+	req = req.Clone(req.Context())
+	c.sendTo(req, r, u)
+	return req
+}
+
+// balancer chooses the upstream of each request of a proxy.
+type balancer struct {
+	name      string
+	options   LoadBalancingOptions
+	upstreams []*upstream
+	next      atomic.Uint64
+	now       func() time.Time // Replaced in tests
+}
+
+func newBalancer(config CFAccessProxyConfig) *balancer {
+	b := &balancer{name: config.Name, options: config.LoadBalancing, now: time.Now}
+	for _, u := range config.Upstreams {
+		b.upstreams = append(b.upstreams, newUpstream(u))
+	}
+	return b
+}
+
+// Returns the upstream of the next request. Upstreams marked down are
+// skipped unless they all are.
+func (b *balancer) pick() *upstream {
+	now := b.now()
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		logger.Debug("proxy.Proxy", "Every upstream of proxy %s is down, trying them anyway", b.name)
+		candidates = b.upstreams
+	}
+
+	switch b.options.Strategy {
+	case options.StrategyPrimaryBackup:
+		return candidates[0]
+	case options.StrategyLeastConnections:
+		// Ties are broken in turn, so that idle upstreams share the load.
+		start := int(b.next.Add(1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := range candidates {
+			if u := candidates[(start+i)%len(candidates)]; u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	default:
+		return candidates[int((b.next.Add(1)-1)%uint64(len(candidates)))]
+	}
+}
+
+// Records the outcome of a request to u, marking it down after MaxFails
+// failures in a row.
+func (b *balancer) report(u *upstream, failure string) {
+	maxFails := orDefault(b.options.MaxFails, options.DefaultMaxFails)
+	failTimeout := orDefault(b.options.FailTimeout, options.DefaultFailTimeout)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if failure == "" {
+		if u.fails >= maxFails && len(b.upstreams) > 1 {
+			logger.Info("proxy.Proxy", "Upstream %s of proxy %s is back up", u, b.name)
+		}
+		u.fails = 0
+		return
+	}
+
+	u.fails++
+	if u.fails >= maxFails {
+		u.downUntil = b.now().Add(failTimeout)
+		if len(b.upstreams) > 1 {
+			logger.Warn("proxy.Proxy", "Upstream %s of proxy %s marked down for %s after %d failures: %s", u, b.name, failTimeout, u.fails, failure)
+		}
+	}
+}
+
+// Returns the upstream chosen for req, or the first one if the request was
+// not routed by the balancer.
+func (c CFAccessProxyConfig) upstreamOf(req *http.Request) *upstream {
+	if req != nil {
+		if r, ok := req.Context().Value(upstreamKey{}).(*route); ok {
+			return r.upstream.Load()
+		}
+	}
+	if c.balancer != nil && len(c.balancer.upstreams) > 0 {
+		return c.balancer.upstreams[0]
+	}
+	if len(c.Upstreams) > 0 {
+		return newUpstream(c.Upstreams[0])
+	}
+	return newUpstream(Upstream{})
+}
+
+// Returns the URLs of the upstreams, for logs.
+func (c CFAccessProxyConfig) upstreamURLs() string {
+	urls := make([]string, 0, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		urls = append(urls, u.Url.String())
+	}
+	return strings.Join(urls, ", ")
+}
+
+// balancerTransport reports the outcome of each attempt of a request to the
+// balancer and counts the requests in flight of the upstreams. Connection
+// errors and 502, 503 and 504 responses are failures.
+type balancerTransport struct {
+	balancer *balancer
+	next     http.RoundTripper
+}
+
+func newBalancerTransport(b *balancer, next http.RoundTripper) *balancerTransport {
+	return &balancerTransport{balancer: b, next: next}
+}
+
+func (t *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, ok := req.Context().Value(upstreamKey{}).(*route)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	u := r.upstream.Load()
+
+	u.active.Add(1)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		u.active.Add(-1)
+		if req.Context().Err() == nil {
+			t.balancer.report(u, err.Error())
+		}
+		return nil, err
+	}
+
+	failure := ""
+	if shouldRetry(req.Context(), resp, nil) {
+		failure = resp.Status
+	}
+	t.balancer.report(u, failure)
+
+	// The request is in flight until its body is closed.
+	body := &doneBody{ReadCloser: resp.Body, done: func() { u.active.Add(-1) }}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// The body of a protocol upgrade is the connection itself.
+		resp.Body = doneReadWriteBody{body, rw}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// doneBody calls done once when closed.
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// doneReadWriteBody is a doneBody that can be written to.
+type doneReadWriteBody struct {
+	*doneBody
+	w io.Writer
+}
+
+func (b doneReadWriteBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// Returns ctx carrying a route to u, for requests not sent by the director.
+func withUpstream(ctx context.Context, u *upstream) context.Context {
+	r := &route{}
+	r.upstream.Store(u)
+	return context.WithValue(ctx, upstreamKey{}, r)
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUpstreams(t *testing.T) {
+	assert.EqualError(t, validateUpstreams(nil), "no upstream")
+	assert.EqualError(t, validateUpstreams([]Upstream{{Url: &url.URL{Scheme: "https", Host: "a.example.com"}}, {}}), "upstream 1 has no URL")
+}
+
+// Returns a balancer over upstreams named by host, with a clock set by the
+// returned function.
+func newTestBalancer(t *testing.T, options LoadBalancingOptions, hosts ...string) (*balancer, func(time.Duration)) {
+	t.Helper()
+	config := CFAccessProxyConfig{Name: "app", LoadBalancing: options}
+	for _, host := range hosts {
+		config.Upstreams = append(config.Upstreams, Upstream{Url: &url.URL{Scheme: "https", Host: host}})
+	}
+	b := newBalancer(config)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+// Returns the hosts of the next n picks.
+func picks(b *balancer, n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = b.pick().Url.Host
+	}
+	return hosts
+}
+
+func TestBalancerPick(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		b, _ := newTestBalancer(t, LoadBalancingOptions{}, "eu", "us", "ap")
+		assert.Equal(t, []string{"eu", "us", "ap", "eu"}, picks(b, 4))
+	})
+
+	t.Run("round robin skips upstreams marked down", func(t *testing.T) {
+		b, advance := newTestBalancer(t, LoadBalancingOptions{FailTimeout: time.Minute}, "eu", "us")
+		b.report(b.upstreams[0], "connection refused")
+		assert.Equal(t, []string{"us", "us"}, picks(b, 2))
+
+		advance(time.Minute)
+		assert.ElementsMatch(t, []string{"eu", "us"}, picks(b, 2))
+	})
+
+	t.Run("primary backup", func(t *testing.T) {
+		b, advance := newTestBalancer(t, LoadBalancingOptions{Strategy: options.StrategyPrimaryBackup, MaxFails: 2}, "primary", "backup")
+		assert.Equal(t, []string{"primary", "primary"}, picks(b, 2))
+
+		b.report(b.upstreams[0], "502 Bad Gateway")
+		assert.Equal(t, "primary", b.pick().Url.Host, "marked down after two failures in a row")
+		b.report(b.upstreams[0], "502 Bad Gateway")
+		assert.Equal(t, "backup", b.pick().Url.Host)
+
+		advance(options.DefaultFailTimeout)
+		assert.Equal(t, "primary", b.pick().Url.Host)
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		b, _ := newTestBalancer(t, LoadBalancingOptions{Strategy: options.StrategyPrimaryBackup, MaxFails: 2}, "primary", "backup")
+		b.report(b.upstreams[0], "502 Bad Gateway")
+		b.report(b.upstreams[0], "")
+		b.report(b.upstreams[0], "502 Bad Gateway")
+		assert.Equal(t, "primary", b.pick().Url.Host)
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		b, _ := newTestBalancer(t, LoadBalancingOptions{Strategy: options.StrategyLeastConnections}, "eu", "us", "ap")
+		b.upstreams[0].active.Store(2)
+		b.upstreams[1].active.Store(1)
+		b.upstreams[2].active.Store(3)
+		assert.Equal(t, []string{"us", "us"}, picks(b, 2))
+
+		b.upstreams[1].active.Store(2)
+		assert.ElementsMatch(t, []string{"eu", "us"}, picks(b, 2), "ties are broken in turn")
+	})
+
+	t.Run("all down", func(t *testing.T) {
+		b, _ := newTestBalancer(t, LoadBalancingOptions{Strategy: options.StrategyPrimaryBackup}, "primary", "backup")
+		b.report(b.upstreams[0], "connection refused")
+		b.report(b.upstreams[1], "connection refused")
+		assert.Equal(t, "primary", b.pick().Url.Host)
+	})
+}
+
+func TestBalancerTransport(t *testing.T) {
+	b, _ := newTestBalancer(t, LoadBalancingOptions{}, "eu", "us")
+	eu, us := b.upstreams[0], b.upstreams[1]
+
+	var status int
+	var err error
+	transport := newBalancerTransport(b, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader("body"))}, nil
+	}))
+	send := func(u *upstream) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "https://"+u.Url.Host+"/", nil)
+		resp, _ := transport.RoundTrip(req.WithContext(withUpstream(req.Context(), u)))
+		return resp
+	}
+
+	status = http.StatusOK
+	resp := send(eu)
+	assert.Equal(t, int64(1), eu.active.Load(), "in flight until the body is closed")
+	resp.Body.Close()
+	resp.Body.Close()
+	assert.Equal(t, int64(0), eu.active.Load())
+
+	status = http.StatusServiceUnavailable
+	send(eu).Body.Close()
+	assert.False(t, eu.available(b.now()))
+
+	err = errors.New("connection refused")
+	assert.Nil(t, send(us))
+	assert.False(t, us.available(b.now()))
+	assert.Equal(t, int64(0), us.active.Load())
+}
+
+func TestBalancerFailover(t *testing.T) {
+	var hits []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.Host+" "+r.Header.Get(options.DefaultTokenHeader))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL, _ := url.Parse(down.URL)
+	down.Close()
+	healthyURL, _ := url.Parse(healthy.URL)
+
+	config := CFAccessProxyConfig{
+		Name:          "app",
+		Upstreams:     []Upstream{{Url: downURL, Token: "down-token"}, {Url: healthyURL, Token: "healthy-token"}},
+		LoadBalancing: LoadBalancingOptions{Strategy: options.StrategyPrimaryBackup},
+	}
+	config.balancer = newBalancer(config)
+	proxy := &httputil.ReverseProxy{
+		Director:     newDirector(config, nil),
+		Transport:    newBalancerTransport(config.balancer, http.DefaultTransport),
+		ErrorHandler: newErrorHandler(config),
+	}
+
+	codes := make([]int, 3)
+	for i := range codes {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost:8888/", nil))
+		codes[i] = rec.Code
+	}
+
+	assert.Equal(t, []int{http.StatusBadGateway, http.StatusOK, http.StatusOK}, codes)
+	require.Len(t, hits, 2)
+	assert.Equal(t, healthyURL.Host+" healthy-token", hits[0], "each upstream gets its own token")
+}
+
+func TestBalancerFailoverOnRetry(t *testing.T) {
+	var hits []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path+" "+strings.Join(r.Header.Values(options.DefaultTokenHeader), ","))
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL, _ := url.Parse(down.URL + "/eu")
+	down.Close()
+	healthyURL, _ := url.Parse(healthy.URL + "/us")
+
+	config := CFAccessProxyConfig{
+		Name:          "app",
+		Upstreams:     []Upstream{{Url: downURL, Token: "down-token"}, {Url: healthyURL, Token: "healthy-token"}},
+		LoadBalancing: LoadBalancingOptions{Strategy: options.StrategyPrimaryBackup},
+		Retry:         RetryOptions{MaxRetries: 1, InitialBackoff: time.Millisecond},
+	}
+	config.balancer = newBalancer(config)
+	proxy := &httputil.ReverseProxy{
+		Director:     newDirector(config, nil),
+		Transport:    newRetryTransport(config, newBalancerTransport(config.balancer, http.DefaultTransport)),
+		ErrorHandler: newErrorHandler(config),
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost:8888/page", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code, "the retry moves to the backup")
+	assert.Equal(t, []string{"/us/page healthy-token"}, hits, "with the path and token of the backup")
+}
@@ -0,0 +1,633 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// CacheOptions configure the cache of the responses of a proxy.
+type CacheOptions = options.Cache
+
+// Statuses cached when the response allows it.
+var cacheableStatuses = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMultipleChoices,
+	http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone,
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Vary   http.Header // Request headers named by Vary, which must match
+	Stored time.Time   // Time the response was received or last revalidated
+}
+
+// Returns the age of the entry at now, counting the Age of the response.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	age := now.Sub(e.Stored)
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return max(age, 0)
+}
+
+// Returns how long the entry is fresh for, from its max-age or Expires.
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if maxAge, ok := cc["max-age"]; ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(e.Header.Get("Date"))
+		if err != nil {
+			date = e.Stored
+		}
+		return expiresAt.Sub(date)
+	}
+	return 0
+}
+
+// Reports whether the entry can be served to req at now without
+// revalidation.
+func (e *cacheEntry) fresh(req *http.Request, now time.Time) bool {
+	cc := parseCacheControl(req.Header)
+	if _, ok := cc["no-cache"]; ok || req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	age := e.age(now)
+	if maxAge, ok := cc["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err != nil || age > time.Duration(seconds)*time.Second {
+			return false
+		}
+	}
+	return age < e.lifetime()
+}
+
+// Reports whether the entry can be revalidated with a conditional request.
+func (e *cacheEntry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// Reports whether the request headers named by Vary match those of req.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, values := range e.Vary {
+		if !slices.Equal(values, req.Header.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the entry as a response to req at now.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// Returns a 304 response to req, whose validator matched the entry.
+func (e *cacheEntry) notModified(req *http.Request, now time.Time) *http.Response {
+	resp := e.response(req, now)
+	resp.Status, resp.StatusCode = "304 Not Modified", http.StatusNotModified
+	resp.Body, resp.ContentLength = http.NoBody, 0
+	resp.Header.Del("Content-Length")
+	return resp
+}
+
+// Updates the headers of the entry from a 304 response received at now.
+func (e *cacheEntry) revalidated(header http.Header, now time.Time) {
+	for name, values := range header {
+		if name != "Content-Length" {
+			e.Header[name] = values
+		}
+	}
+	if header.Get("Age") == "" {
+		e.Header.Del("Age")
+	}
+	e.Stored = now
+}
+
+// Returns the directives of the Cache-Control header, lowercase, with their
+// unquoted value if any.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// Reports whether req, carrying token, can be served from the cache.
+// Requests with credentials of the client, such as its cookies, or for a
+// part of a resource are forwarded as they are.
+func cacheableRequest(req *http.Request, token string) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if hasClientCookies(req, token) {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// Reports whether req carries cookies other than the CF_Authorization
+// cookie of token, set by the proxy.
+func hasClientCookies(req *http.Request, token string) bool {
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != TokenCookie || token == "" || cookie.Value != token {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether resp can be stored. Responses setting cookies or private
+// to a client are never stored, and those without a lifetime only if they
+// can be revalidated.
+func cacheableResponse(resp *http.Response) bool {
+	if !slices.Contains(cacheableStatuses, resp.StatusCode) || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, noStore := cc["no-store"]; noStore {
+		return false
+	}
+	if _, private := cc["private"]; private {
+		return false
+	}
+	entry := cacheEntry{Header: resp.Header}
+	return entry.lifetime() > 0 || entry.hasValidator()
+}
+
+// Reports whether a request with method may change the resource.
+func isUnsafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// Reports whether req carries validators of its own.
+func isConditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// Reports whether the If-None-Match header of req lists etag.
+func etagMatches(req *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	weak := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == weak {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheTransport serves the responses of a proxy from its cache, and
+// stores the cacheable ones.
+type cacheTransport struct {
+	config  CFAccessProxyConfig
+	options CacheOptions
+	store   cacheStore
+	next    http.RoundTripper
+	now     func() time.Time // Replaced in tests
+}
+
+// Returns next wrapped in a cacheTransport, or next if the cache is
+// disabled.
+func newCacheTransport(config CFAccessProxyConfig, next http.RoundTripper) (http.RoundTripper, error) {
+	o := config.Cache
+	if !o.Enabled {
+		return next, nil
+	}
+	o.MaxSize = orDefault(o.MaxSize, options.DefaultCacheMaxSize)
+	o.MaxEntrySize = min(orDefault(o.MaxEntrySize, options.DefaultCacheMaxEntrySize), o.MaxSize)
+
+	var store cacheStore = newMemoryStore(o.MaxSize)
+	if o.Dir != "" {
+		// Each proxy has its own directory, so that they never share entries.
+		var err error
+		if store, err = newDiskStore(filepath.Join(o.Dir, cacheDirName(config.Name)), o.MaxSize); err != nil {
+			return nil, err
+		}
+	}
+	return &cacheTransport{config: config, options: o, store: store, next: next, now: time.Now}, nil
+}
+
+// Returns the name of the directory of a proxy, a digest of its name so
+// that any name maps to a single directory entry of its own.
+func cacheDirName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Returns the key of the entry of req, scoped to the upstream it is routed
+// to and to the identity of its token. A retry may move req to another
+// upstream, so the key of a response is taken once it is received.
+func (t *cacheTransport) key(req *http.Request) string {
+	upstream := t.config.upstreamOf(req)
+	return cacheScope(upstream.currentToken()) + " " + upstream.Url.Scheme + "://" + upstream.Url.Host + req.URL.RequestURI()
+}
+
+// Returns the identity of a token: its subject, a digest of the token if it
+// has none, or nothing for applications outside of Access.
+func cacheScope(token string) string {
+	if token == "" {
+		return ""
+	}
+	if subject, _ := tokenClaims(token); subject != "" {
+		return "sub:" + subject
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:16])
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req, t.config.upstreamOf(req).currentToken()) {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && isUnsafe(req.Method) && resp.StatusCode < 400 {
+			// Unsafe methods invalidate the cached resource.
+			t.store.delete(t.key(req))
+		}
+		return resp, err
+	}
+
+	key := t.key(req)
+	entry := t.load(key, req)
+	now := t.now()
+
+	switch {
+	case entry != nil && entry.fresh(req, now):
+		logger.Debug("proxy.Proxy", "Serving %s of proxy %s from the cache", req.URL.Path, t.config.Name)
+		if etagMatches(req, entry.Header.Get("ETag")) {
+			return entry.notModified(req, now), nil
+		}
+		return entry.response(req, now), nil
+
+	case entry != nil && entry.hasValidator() && !isConditional(req):
+		conditional := req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			conditional.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			conditional.Header.Set("If-Modified-Since", lastModified)
+		}
+		resp, err := t.next.RoundTrip(conditional)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusNotModified {
+			resp.Request = req
+			return t.cache(req, resp), nil
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		now = t.now()
+		entry.revalidated(resp.Header, now)
+		revalidated := entry.response(req, now)
+		switch {
+		case t.key(req) != key:
+			// Another upstream answered, the entry is left as it was.
+		case !cacheableResponse(revalidated):
+			t.store.delete(key)
+		default:
+			t.save(key, entry)
+			logger.Debug("proxy.Proxy", "Revalidated %s of proxy %s in the cache", req.URL.Path, t.config.Name)
+		}
+		return revalidated, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.cache(req, resp), nil
+}
+
+// Returns the entry of key if it matches req.
+func (t *cacheTransport) load(key string, req *http.Request) *cacheEntry {
+	data, ok := t.store.get(key)
+	if !ok {
+		return nil
+	}
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		logger.Debug("proxy.Proxy", "Dropping unreadable cache entry of proxy %s: %v", t.config.Name, err)
+		t.store.delete(key)
+		return nil
+	}
+	if !entry.matches(req) {
+		return nil
+	}
+	return &entry
+}
+
+// Stores entry under key.
+func (t *cacheTransport) save(key string, entry *cacheEntry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		logger.Debug("proxy.Proxy", "Failed to encode cache entry of proxy %s: %v", t.config.Name, err)
+		return
+	}
+	t.store.set(key, buf.Bytes())
+}
+
+// Returns resp with its body stored once fully read, if it can be cached,
+// under the key of the upstream that answered req.
+func (t *cacheTransport) cache(req *http.Request, resp *http.Response) *http.Response {
+	if !cacheableResponse(resp) || resp.ContentLength > t.options.MaxEntrySize {
+		return resp
+	}
+	key := t.key(req)
+
+	entry := &cacheEntry{Status: resp.StatusCode, Header: resp.Header.Clone(), Vary: make(http.Header), Stored: t.now()}
+	for _, line := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				entry.Vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: t.options.MaxEntrySize, done: func(body []byte) {
+		entry.Body = body
+		t.save(key, entry)
+		logger.Debug("proxy.Proxy", "Cached %s of proxy %s", req.URL.Path, t.config.Name)
+	}}
+	return resp
+}
+
+// cachingBody keeps a copy of the body read, and calls done with it once
+// the body is read to its end within limit.
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+// cacheStore keeps the encoded cache entries of a proxy within a size.
+type cacheStore interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte)
+	delete(key string)
+}
+
+// lru orders the keys of a store by use and evicts the least recently used
+// ones beyond max bytes.
+type lru struct {
+	max   int64
+	size  int64
+	order *list.List // Of *lruItem, most recently used first
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// Marks key as used, returning whether it is known.
+func (l *lru) touch(key string) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// Records key with its size and returns the keys evicted to make room.
+func (l *lru) add(key string, size int64) []string {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.max && l.order.Len() > 1 {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) {
+	if e, ok := l.items[key]; ok {
+		l.size -= e.Value.(*lruItem).size
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+// memoryStore keeps the entries in memory.
+type memoryStore struct {
+	mu   sync.Mutex
+	lru  *lru
+	data map[string][]byte
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{lru: newLRU(maxSize), data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.touch(key)
+	data, ok := s.data[key]
+	return data, ok
+}
+
+func (s *memoryStore) set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	for _, evicted := range s.lru.add(key, int64(len(value))) {
+		delete(s.data, evicted)
+	}
+}
+
+func (s *memoryStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(key)
+	delete(s.data, key)
+}
+
+// diskStore keeps the entries in files of a directory, named by a digest
+// of their key, so that they survive restarts.
+type diskStore struct {
+	mu  sync.Mutex
+	dir string
+	lru *lru // Keyed by file name
+}
+
+// Returns a store in dir, created if needed, picking up the entries left
+// there in the order they were written.
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory, %v", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache directory, %v", err)
+	}
+
+	type stored struct {
+		name     string
+		size     int64
+		modified time.Time
+	}
+	var entries []stored
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		entries = append(entries, stored{file.Name(), info.Size(), info.ModTime()})
+	}
+	slices.SortFunc(entries, func(a, b stored) int { return a.modified.Compare(b.modified) })
+
+	s := &diskStore{dir: dir, lru: newLRU(maxSize)}
+	for _, e := range entries {
+		s.removeFiles(s.lru.add(e.name, e.size))
+	}
+	return s, nil
+}
+
+// Returns the file name of key.
+func (s *diskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *diskStore) get(key string) ([]byte, bool) {
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lru.touch(name) {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		s.lru.remove(name)
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *diskStore) set(key string, value []byte) {
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Written aside then renamed, so that a crash never leaves half an entry.
+	tmp, err := os.CreateTemp(s.dir, ".entry-*")
+	if err != nil {
+		logger.Debug("proxy.Proxy", "Failed to write cache entry in %s: %v", s.dir, err)
+		return
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Debug("proxy.Proxy", "Failed to write cache entry in %s: %v", s.dir, err)
+		return
+	}
+	s.removeFiles(s.lru.add(name, int64(len(value))))
+}
+
+func (s *diskStore) delete(key string) {
+	name := s.name(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lru.touch(name) {
+		s.lru.remove(name)
+		s.removeFiles([]string{name})
+	}
+}
+
+func (s *diskStore) removeFiles(names []string) {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Debug("proxy.Proxy", "Failed to remove cache entry in %s: %v", s.dir, err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	h := http.Header{"Cache-Control": {`Public, max-age=60`, `no-cache="Set-Cookie"`}}
+	assert.Equal(t, map[string]string{"public": "", "max-age": "60", "no-cache": "Set-Cookie"}, parseCacheControl(h))
+}
+
+// testOrigin answers the requests of a cacheTransport, recording them.
+type testOrigin struct {
+	requests []*http.Request
+	respond  func(req *http.Request) (int, http.Header, string)
+}
+
+func (o *testOrigin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.requests = append(o.requests, req)
+	status, header, body := o.respond(req)
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Status:        http.StatusText(status),
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// Returns a cache of a proxy with an upstream per token, and a function
+// sending requests through it as the upstream at index i.
+func newTestCache(t *testing.T, options CacheOptions, origin *testOrigin, tokens ...string) (*cacheTransport, func(i int, method, path string, header http.Header) *http.Response) {
+	t.Helper()
+	config := CFAccessProxyConfig{Name: "app", Cache: options}
+	for i, token := range tokens {
+		config.Upstreams = append(config.Upstreams, Upstream{Url: &url.URL{Scheme: "https", Host: fmt.Sprintf("app%d.example.com", i)}, Token: token})
+	}
+	config.balancer = newBalancer(config)
+
+	options.Enabled = true
+	config.Cache = options
+	transport, err := newCacheTransport(config, origin)
+	require.NoError(t, err)
+	cache := transport.(*cacheTransport)
+
+	send := func(i int, method, path string, header http.Header) *http.Response {
+		req := httptest.NewRequest(method, "https://app.example.com"+path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		req = req.WithContext(withUpstream(req.Context(), config.balancer.upstreams[i]))
+		resp, err := cache.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+	return cache, send
+}
+
+// Returns the body of resp, read to its end.
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func TestCacheTransport(t *testing.T) {
+	alice := testToken(`{"sub":"alice"}`)
+	bob := testToken(`{"sub":"bob"}`)
+
+	t.Run("fresh response", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "bundle"
+		}}
+		cache, send := newTestCache(t, CacheOptions{}, origin, alice)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+
+		assert.Equal(t, "bundle", readBody(t, send(0, http.MethodGet, "/app.js", nil)))
+		now = now.Add(30 * time.Second)
+		resp := send(0, http.MethodGet, "/app.js", nil)
+		assert.Equal(t, "bundle", readBody(t, resp))
+		assert.Equal(t, "30", resp.Header.Get("Age"))
+		assert.Len(t, origin.requests, 1)
+
+		now = now.Add(time.Minute)
+		readBody(t, send(0, http.MethodGet, "/app.js", nil))
+		assert.Len(t, origin.requests, 2, "stale without validator, fetched again")
+	})
+
+	t.Run("scoped per identity", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "for " + req.Header.Get("X-User")
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice, bob)
+
+		assert.Equal(t, "for alice", readBody(t, send(0, http.MethodGet, "/me", http.Header{"X-User": {"alice"}})))
+		assert.Equal(t, "for bob", readBody(t, send(1, http.MethodGet, "/me", http.Header{"X-User": {"bob"}})))
+		assert.Equal(t, "for alice", readBody(t, send(0, http.MethodGet, "/me", nil)))
+		assert.Len(t, origin.requests, 2)
+	})
+
+	t.Run("scoped per upstream", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "body"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, "", "")
+
+		readBody(t, send(0, http.MethodGet, "/app.js", nil))
+		readBody(t, send(1, http.MethodGet, "/app.js", nil))
+		readBody(t, send(0, http.MethodGet, "/app.js", nil))
+		assert.Len(t, origin.requests, 2)
+	})
+
+	t.Run("stored for the upstream that answered", func(t *testing.T) {
+		var cache *cacheTransport
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			// As a retry moving the request to the second upstream.
+			req.Context().Value(upstreamKey{}).(*route).upstream.Store(cache.config.balancer.upstreams[1])
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "from bob"
+		}}
+		cache, send := newTestCache(t, CacheOptions{}, origin, alice, bob)
+
+		readBody(t, send(0, http.MethodGet, "/me", nil))
+		readBody(t, send(1, http.MethodGet, "/me", nil))
+		assert.Len(t, origin.requests, 1, "served from the entry of the second upstream")
+		readBody(t, send(0, http.MethodGet, "/me", nil))
+		assert.Len(t, origin.requests, 2, "nothing stored for the first upstream")
+	})
+
+	t.Run("token cookie of the proxy", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "body"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+
+		cookie := http.Header{"Cookie": {TokenCookie + "=" + alice}}
+		readBody(t, send(0, http.MethodGet, "/app.js", cookie.Clone()))
+		readBody(t, send(0, http.MethodGet, "/app.js", cookie.Clone()))
+		assert.Len(t, origin.requests, 1)
+	})
+
+	t.Run("revalidation", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			header := http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				return http.StatusNotModified, header, ""
+			}
+			return http.StatusOK, header, "index"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+
+		assert.Equal(t, "index", readBody(t, send(0, http.MethodGet, "/", nil)))
+		resp := send(0, http.MethodGet, "/", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "index", readBody(t, resp))
+		require.Len(t, origin.requests, 2)
+		assert.Equal(t, `"v1"`, origin.requests[1].Header.Get("If-None-Match"))
+	})
+
+	t.Run("conditional request on a fresh response", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`W/"v1"`}}, "style"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+
+		readBody(t, send(0, http.MethodGet, "/app.css", nil))
+		resp := send(0, http.MethodGet, "/app.css", http.Header{"If-None-Match": {`"v1"`}})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		assert.Len(t, origin.requests, 1)
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, req.Header.Get("Accept-Encoding")
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+
+		assert.Equal(t, "gzip", readBody(t, send(0, http.MethodGet, "/app.js", http.Header{"Accept-Encoding": {"gzip"}})))
+		assert.Equal(t, "br", readBody(t, send(0, http.MethodGet, "/app.js", http.Header{"Accept-Encoding": {"br"}})))
+		assert.Equal(t, "br", readBody(t, send(0, http.MethodGet, "/app.js", http.Header{"Accept-Encoding": {"br"}})))
+		assert.Len(t, origin.requests, 2)
+	})
+
+	t.Run("not stored", func(t *testing.T) {
+		testCases := []struct {
+			name   string
+			header http.Header
+			status int
+			reqHdr http.Header
+		}{
+			{name: "no-store", header: http.Header{"Cache-Control": {"no-store, max-age=60"}}, status: http.StatusOK},
+			{name: "set cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}, status: http.StatusOK},
+			{name: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}, status: http.StatusOK},
+			{name: "no lifetime nor validator", header: http.Header{}, status: http.StatusOK},
+			{name: "access login redirect", header: http.Header{"Cache-Control": {"max-age=60"}, "Location": {"/cdn-cgi/access/login"}}, status: http.StatusFound},
+			{name: "vary star", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, status: http.StatusOK},
+			{name: "authorization", header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusOK, reqHdr: http.Header{"Authorization": {"Bearer x"}}},
+			{name: "client cookie", header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusOK, reqHdr: http.Header{"Cookie": {"session=1"}}},
+			{name: "client token cookie", header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusOK, reqHdr: http.Header{"Cookie": {TokenCookie + "=other"}}},
+			{name: "request no-store", header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusOK, reqHdr: http.Header{"Cache-Control": {"no-store"}}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+					return tc.status, tc.header.Clone(), "body"
+				}}
+				_, send := newTestCache(t, CacheOptions{}, origin, alice)
+				readBody(t, send(0, http.MethodGet, "/", tc.reqHdr))
+				readBody(t, send(0, http.MethodGet, "/", tc.reqHdr))
+				assert.Len(t, origin.requests, 2)
+			})
+		}
+	})
+
+	t.Run("request no-cache", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "body"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+		readBody(t, send(0, http.MethodGet, "/", nil))
+		readBody(t, send(0, http.MethodGet, "/", http.Header{"Cache-Control": {"no-cache"}}))
+		assert.Len(t, origin.requests, 2)
+	})
+
+	t.Run("unsafe method invalidates", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "body"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+		readBody(t, send(0, http.MethodGet, "/items", nil))
+		readBody(t, send(0, http.MethodPost, "/items", nil))
+		readBody(t, send(0, http.MethodGet, "/items", nil))
+		assert.Len(t, origin.requests, 3)
+	})
+
+	t.Run("entry too large", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 100)
+		}}
+		_, send := newTestCache(t, CacheOptions{MaxEntrySize: 10}, origin, alice)
+		assert.Len(t, readBody(t, send(0, http.MethodGet, "/", nil)), 100)
+		readBody(t, send(0, http.MethodGet, "/", nil))
+		assert.Len(t, origin.requests, 2)
+	})
+
+	t.Run("body not read to its end", func(t *testing.T) {
+		origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+			return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "body"
+		}}
+		_, send := newTestCache(t, CacheOptions{}, origin, alice)
+		send(0, http.MethodGet, "/", nil).Body.Close()
+		readBody(t, send(0, http.MethodGet, "/", nil))
+		assert.Len(t, origin.requests, 2)
+	})
+}
+
+func TestCacheScope(t *testing.T) {
+	assert.Empty(t, cacheScope(""))
+	assert.Equal(t, "sub:alice", cacheScope(testToken(`{"sub":"alice"}`)))
+	assert.NotEqual(t, cacheScope("opaque-a"), cacheScope("opaque-b"))
+}
+
+func TestLRU(t *testing.T) {
+	l := newLRU(10)
+	assert.Empty(t, l.add("a", 4))
+	assert.Empty(t, l.add("b", 4))
+	assert.True(t, l.touch("a"))
+	assert.Equal(t, []string{"b"}, l.add("c", 4))
+	assert.Equal(t, []string{"a", "c"}, l.add("d", 20), "an entry larger than the cache evicts every other")
+	assert.False(t, l.touch("a"))
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore(8)
+	s.set("a", []byte("1234"))
+	s.set("b", []byte("5678"))
+	s.set("c", []byte("9"))
+
+	_, ok := s.get("a")
+	assert.False(t, ok, "evicted")
+	value, ok := s.get("b")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("5678"), value)
+	s.delete("b")
+	_, ok = s.get("b")
+	assert.False(t, ok)
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskStore(dir, 8)
+	require.NoError(t, err)
+	s.set("a", []byte("1234"))
+	s.set("b", []byte("5678"))
+
+	// Entries survive a restart.
+	s, err = newDiskStore(dir, 8)
+	require.NoError(t, err)
+	value, ok := s.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1234"), value)
+
+	s.set("c", []byte("9"))
+	_, ok = s.get("b")
+	assert.False(t, ok, "least recently used entry evicted")
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	s.delete("a")
+	_, ok = s.get("a")
+	assert.False(t, ok)
+}
+
+func TestCacheTransportOnDisk(t *testing.T) {
+	origin := &testOrigin{respond: func(req *http.Request) (int, http.Header, string) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "bundle"
+	}}
+	dir := t.TempDir()
+	_, send := newTestCache(t, CacheOptions{Dir: dir}, origin, "")
+	readBody(t, send(0, http.MethodGet, "/app.js", nil))
+
+	_, send = newTestCache(t, CacheOptions{Dir: dir}, origin, "")
+	assert.Equal(t, "bundle", readBody(t, send(0, http.MethodGet, "/app.js", nil)))
+	assert.Len(t, origin.requests, 1)
+
+	files, err := os.ReadDir(filepath.Join(dir, cacheDirName("app")))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "each proxy has its own directory")
+}
+
+func TestCacheDirName(t *testing.T) {
+	for _, name := range []string{"app", "..", ".", "a/b", ""} {
+		dirName := cacheDirName(name)
+		assert.True(t, filepath.IsLocal(dirName), name)
+		assert.Equal(t, dirName, filepath.Base(dirName), name)
+	}
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codings offered to clients unless set otherwise, in order of preference.
+var defaultCompressionEncodings = options.DefaultCompressionEncodings()
+
+// Media types compressed unless set otherwise. Event streams are left out,
+// as compressing them would hold back the events.
+var defaultCompressionTypes = []string{
+	"text/html", "text/css", "text/plain", "text/javascript", "text/xml", "text/csv",
+	"application/javascript", "application/json", "application/xml", "application/wasm",
+	"application/manifest+json", "image/svg+xml",
+}
+
+// upstreamAcceptEncoding asks the upstream for any coding the proxy can
+// decode.
+const upstreamAcceptEncoding = "br, zstd, gzip"
+
+// brotliLevel trades some ratio for the speed needed on the fly.
+const brotliLevel = 4
+
+// CompressionOptions configure the compression of the responses of a proxy.
+type CompressionOptions = options.Compression
+
+// Reports whether the media type of contentType is one of the types of o.
+func compressible(o CompressionOptions, contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, allowed := range o.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEncodingKey is the context key of the codings accepted by the
+// client, as parsed by parseAcceptEncoding.
+type acceptEncodingKey struct{}
+
+// Returns the weights of the codings of Accept-Encoding headers, lowercase.
+func parseAcceptEncoding(values []string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, line := range values {
+		for _, part := range strings.Split(line, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			weight := 1.0
+			for _, param := range strings.Split(params, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if ok && strings.EqualFold(name, "q") {
+					if q, err := strconv.ParseFloat(value, 64); err == nil {
+						weight = q
+					}
+				}
+			}
+			weights[coding] = weight
+		}
+	}
+	return weights
+}
+
+// Returns the weight of coding in accepted, that of * if it is not listed.
+func acceptWeight(accepted map[string]float64, coding string) float64 {
+	if weight, ok := accepted[strings.ToLower(coding)]; ok {
+		return weight
+	}
+	return accepted["*"]
+}
+
+// Returns the coding of encodings weighted highest by accepted, the first
+// one on a tie, or nothing if none is accepted.
+func negotiateEncoding(accepted map[string]float64, encodings []string) string {
+	best, bestWeight := "", 0.0
+	for _, encoding := range encodings {
+		if weight := acceptWeight(accepted, encoding); weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// withCompression negotiates the compression of the responses of next with
+// the local client. Range and upgrade requests are left untouched.
+func withCompression(config CFAccessProxyConfig, next http.Handler) http.Handler {
+	o := config.Compression
+	if !o.Enabled {
+		return next
+	}
+	if len(o.Encodings) == 0 {
+		o.Encodings = defaultCompressionEncodings
+	}
+	if len(o.ContentTypes) == 0 {
+		o.ContentTypes = defaultCompressionTypes
+	}
+	o.MinSize = orDefault(o.MinSize, options.DefaultCompressionMinSize)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accepted := parseAcceptEncoding(r.Header.Values("Accept-Encoding"))
+		// The client's codings travel to the decodingTransport, while the
+		// upstream is asked for any coding the proxy can decode.
+		r.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+		r = r.WithContext(context.WithValue(r.Context(), acceptEncodingKey{}, accepted))
+
+		cw := &compressWriter{ResponseWriter: w, options: o, encoding: negotiateEncoding(accepted, o.Encodings), head: r.Method == http.MethodHead}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter compresses the responses of a compressible media type
+// that are not encoded yet.
+type compressWriter struct {
+	http.ResponseWriter
+	options     CompressionOptions
+	encoding    string // Coding preferred by the client, none if empty
+	head        bool
+	wroteHeader bool
+	encoder     encoder // Set while compressing
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader || status < http.StatusOK {
+		// Informational responses precede the final one.
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	compressible := compressible(w.options, h.Get("Content-Type"))
+	if compressible || h.Get("Content-Encoding") != "" {
+		addVary(h, "Accept-Encoding")
+	}
+	if compressible && w.shouldCompress(status, h) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		weakenETag(h)
+		if !w.head {
+			w.encoder = getEncoder(w.encoding, w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Reports whether a response with status and h is worth compressing.
+func (w *compressWriter) shouldCompress(status int, h http.Header) bool {
+	if w.encoding == "" || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if _, noTransform := parseCacheControl(h)["no-transform"]; noTransform {
+		return false
+	}
+	if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length < w.options.MinSize {
+		return false
+	}
+	return true
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was compressed so far, for streamed responses.
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		_ = w.encoder.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the connection.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Ends the compressed stream, if any.
+func (w *compressWriter) close() {
+	if w.encoder != nil {
+		_ = w.encoder.Close()
+		putEncoder(w.encoding, w.encoder)
+		w.encoder = nil
+	}
+}
+
+// Adds value to the Vary header of h unless it is listed already.
+func addVary(h http.Header, value string) {
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name == "*" || strings.EqualFold(name, value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// Makes a strong ETag of h weak, as the encoded bytes differ from those of
+// the upstream.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// encoder is a compressing writer that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	options.EncodingBrotli: {New: func() any { return brotli.NewWriterLevel(nil, brotliLevel) }},
+	options.EncodingZstd: {New: func() any {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return e
+	}},
+	options.EncodingGzip: {New: func() any { return gzip.NewWriter(nil) }},
+}
+
+// Returns an encoder of coding writing to w.
+func getEncoder(coding string, w io.Writer) encoder {
+	e := encoderPools[coding].Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+func putEncoder(coding string, e encoder) {
+	e.Reset(nil)
+	encoderPools[coding].Put(e)
+}
+
+// Reports whether the proxy can decode coding.
+func isDecodable(coding string) bool {
+	switch strings.ToLower(coding) {
+	case options.EncodingBrotli, options.EncodingZstd, options.EncodingGzip, "x-gzip":
+		return true
+	}
+	return false
+}
+
+// Returns a reader decoding r from coding, or r itself if there is none.
+func newDecoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(coding) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case options.EncodingGzip, "x-gzip":
+		return gzip.NewReader(r)
+	case options.EncodingBrotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case options.EncodingZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding '%s'", coding)
+}
+
+// decodingTransport decodes the responses whose coding the local client
+// does not accept, as negotiated by withCompression, so that they can be
+// compressed again as the client prefers.
+type decodingTransport struct {
+	next http.RoundTripper
+}
+
+// Returns next wrapped in a decodingTransport, or next if compression is
+// disabled.
+func newDecodingTransport(config CFAccessProxyConfig, next http.RoundTripper) http.RoundTripper {
+	if !config.Compression.Enabled {
+		return next
+	}
+	return &decodingTransport{next: next}
+}
+
+func (t *decodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	accepted, ok := req.Context().Value(acceptEncodingKey{}).(map[string]float64)
+	coding := resp.Header.Get("Content-Encoding")
+	if !ok || !isDecodable(coding) || acceptWeight(accepted, coding) > 0 {
+		return resp, nil
+	}
+
+	if req.Method != http.MethodHead {
+		decoder, err := newDecoder(coding, resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to decode %s response, %v", coding, err)
+		}
+		resp.Body = decodedBody{ReadCloser: decoder, body: resp.Body}
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	weakenETag(resp.Header)
+	return resp, nil
+}
+
+// decodedBody closes the decoder and the body it reads.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b decodedBody) Close() error {
+	_ = b.ReadCloser.Close()
+	return b.body.Close()
+}
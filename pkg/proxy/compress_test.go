@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns s encoded with coding.
+func encode(coding, s string) string {
+	var b bytes.Buffer
+	e := getEncoder(coding, &b)
+	_, _ = io.WriteString(e, s)
+	_ = e.Close()
+	putEncoder(coding, e)
+	return b.String()
+}
+
+// Returns s decoded from coding.
+func decode(t *testing.T, coding, s string) string {
+	d, err := newDecoder(coding, strings.NewReader(s))
+	require.NoError(t, err)
+	defer d.Close()
+	b, err := io.ReadAll(d)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "", expected: ""},
+		{acceptEncoding: "gzip, deflate", expected: "gzip"},
+		{acceptEncoding: "gzip, deflate, br, zstd", expected: "br"},
+		{acceptEncoding: "gzip;q=1.0, br;q=0.5", expected: "gzip"},
+		{acceptEncoding: "BR;Q=0", expected: ""},
+		{acceptEncoding: "*", expected: "br"},
+		{acceptEncoding: "*, br;q=0", expected: "zstd"},
+		{acceptEncoding: "identity", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			accepted := parseAcceptEncoding([]string{tc.acceptEncoding})
+			assert.Equal(t, tc.expected, negotiateEncoding(accepted, defaultCompressionEncodings))
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	o := CompressionOptions{ContentTypes: []string{"text/*", "application/json"}}
+	assert.True(t, compressible(o, "text/html; charset=utf-8"))
+	assert.True(t, compressible(o, "Application/JSON"))
+	assert.False(t, compressible(o, "application/octet-stream"))
+	assert.False(t, compressible(o, ""))
+}
+
+func TestWithCompression(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+
+	testCases := []struct {
+		name             string
+		method           string
+		header           http.Header // Of the request
+		responseHeader   http.Header
+		body             string
+		expectedEncoding string
+		expectedVary     bool
+	}{
+		{
+			name:             "preferred coding",
+			header:           http.Header{"Accept-Encoding": {"gzip, deflate, br, zstd"}},
+			responseHeader:   http.Header{"Content-Type": {"text/html"}},
+			body:             page,
+			expectedEncoding: options.EncodingBrotli,
+			expectedVary:     true,
+		},
+		{
+			name:             "gzip",
+			header:           http.Header{"Accept-Encoding": {"gzip"}},
+			responseHeader:   http.Header{"Content-Type": {"application/json"}, "Etag": {`"v1"`}},
+			body:             page,
+			expectedEncoding: options.EncodingGzip,
+			expectedVary:     true,
+		},
+		{
+			name:             "zstd",
+			header:           http.Header{"Accept-Encoding": {"zstd"}},
+			responseHeader:   http.Header{"Content-Type": {"text/css"}},
+			body:             page,
+			expectedEncoding: options.EncodingZstd,
+			expectedVary:     true,
+		},
+		{
+			name:           "not accepted",
+			responseHeader: http.Header{"Content-Type": {"text/html"}},
+			body:           page,
+			expectedVary:   true,
+		},
+		{
+			name:           "small body",
+			header:         http.Header{"Accept-Encoding": {"gzip"}},
+			responseHeader: http.Header{"Content-Type": {"text/html"}, "Content-Length": {"5"}},
+			body:           "small",
+			expectedVary:   true,
+		},
+		{
+			name:           "content type not compressed",
+			header:         http.Header{"Accept-Encoding": {"gzip"}},
+			responseHeader: http.Header{"Content-Type": {"image/png"}},
+			body:           page,
+		},
+		{
+			name:             "already encoded",
+			header:           http.Header{"Accept-Encoding": {"gzip, br"}},
+			responseHeader:   http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+			body:             encode(options.EncodingGzip, page),
+			expectedEncoding: options.EncodingGzip,
+			expectedVary:     true,
+		},
+		{
+			name:           "no-transform",
+			header:         http.Header{"Accept-Encoding": {"gzip"}},
+			responseHeader: http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"no-transform"}},
+			body:           page,
+			expectedVary:   true,
+		},
+		{
+			name:           "range request",
+			header:         http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}},
+			responseHeader: http.Header{"Content-Type": {"text/html"}},
+			body:           page,
+		},
+		{
+			name:             "head",
+			method:           http.MethodHead,
+			header:           http.Header{"Accept-Encoding": {"gzip"}},
+			responseHeader:   http.Header{"Content-Type": {"text/html"}},
+			expectedEncoding: options.EncodingGzip,
+			expectedVary:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var upstreamEncoding string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamEncoding = r.Header.Get("Accept-Encoding")
+				for name, values := range tc.responseHeader {
+					w.Header()[name] = values
+				}
+				_, _ = io.WriteString(w, tc.body)
+			})
+			config := CFAccessProxyConfig{Compression: CompressionOptions{Enabled: true}}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			req.Header = tc.header.Clone()
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			rec := httptest.NewRecorder()
+			withCompression(config, next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedEncoding, rec.Header().Get("Content-Encoding"))
+			if tc.expectedVary {
+				assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+			} else {
+				assert.Empty(t, rec.Header().Get("Vary"))
+			}
+			if tc.header.Get("Range") != "" {
+				assert.Equal(t, "gzip", upstreamEncoding, "range requests are untouched")
+			} else {
+				assert.Equal(t, upstreamAcceptEncoding, upstreamEncoding)
+			}
+			if method == http.MethodHead {
+				assert.Empty(t, rec.Body.String())
+				return
+			}
+			if tc.expectedEncoding != "" {
+				assert.Empty(t, rec.Header().Get("Content-Length"))
+				assert.Equal(t, page, decode(t, tc.expectedEncoding, rec.Body.String()))
+			} else {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+			if etag := tc.responseHeader.Get("ETag"); etag != "" {
+				assert.Equal(t, "W/"+etag, rec.Header().Get("ETag"), "the encoded bytes differ from the upstream")
+			}
+		})
+	}
+}
+
+func TestWithCompressionFlush(t *testing.T) {
+	flushed := make(chan string, 1)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "first")
+		http.NewResponseController(w).Flush()
+		flushed <- w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String()
+		_, _ = io.WriteString(w, " second")
+	})
+	config := CFAccessProxyConfig{Compression: CompressionOptions{Enabled: true}}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	withCompression(config, next).ServeHTTP(rec, req)
+
+	assert.True(t, rec.Flushed)
+	// What was flushed decodes on its own, without the end of the stream.
+	r, err := gzip.NewReader(strings.NewReader(<-flushed))
+	require.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(r, b)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(b))
+	assert.Equal(t, "first second", decode(t, options.EncodingGzip, rec.Body.String()))
+}
+
+func TestDecodingTransport(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}, "Etag": {`"v1"`}},
+			Body:       io.NopCloser(strings.NewReader(encode(options.EncodingGzip, page))),
+			Request:    req,
+		}, nil
+	})
+	transport := newDecodingTransport(CFAccessProxyConfig{Compression: CompressionOptions{Enabled: true}}, upstream)
+
+	roundTrip := func(ctx context.Context) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil).WithContext(ctx)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("coding not accepted", func(t *testing.T) {
+		resp := roundTrip(context.WithValue(context.Background(), acceptEncodingKey{}, parseAcceptEncoding([]string{"br"})))
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+		assert.Equal(t, page, readBody(t, resp))
+	})
+
+	t.Run("coding accepted", func(t *testing.T) {
+		resp := roundTrip(context.WithValue(context.Background(), acceptEncodingKey{}, parseAcceptEncoding([]string{"gzip"})))
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, page, decode(t, options.EncodingGzip, readBody(t, resp)))
+	})
+
+	t.Run("outside of withCompression", func(t *testing.T) {
+		resp := roundTrip(context.Background())
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	})
+}
+
+func TestCompressionThroughProxy(t *testing.T) {
+	page := strings.Repeat(`{"hello":"world"}`, 200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The upstream only speaks gzip.
+		assert.Contains(t, r.Header.Get("Accept-Encoding"), "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = io.WriteString(w, encode(options.EncodingGzip, page))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	config := CFAccessProxyConfig{Compression: CompressionOptions{Enabled: true}}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = newDecodingTransport(config, http.DefaultTransport)
+	handler := withCompression(config, proxy)
+
+	for _, coding := range []string{options.EncodingBrotli, options.EncodingZstd, options.EncodingGzip} {
+		t.Run(coding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", coding)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, coding, rec.Header().Get("Content-Encoding"))
+			assert.Equal(t, page, decode(t, coding, rec.Body.String()))
+		})
+	}
+
+	t.Run("identity", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, page, rec.Body.String())
+	})
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+)
+
+// Errors of responses of Cloudflare Access, reported by newResponseRewriter
+// so that the ErrorHandler explains them.
+var (
+	errAccessDenied = errors.New("access denied by Cloudflare Access")
+	errTokenExpired = errors.New("access token expired or was rejected")
+	errTokenMissing = errors.New("no access token for the application")
+)
+
+// Largest body of a 403 response searched for the Access block page.
+const accessPageLimit = 64 << 10
+
+// errorPage describes a failed request, rendered as HTML or JSON.
+type errorPage struct {
+	Proxy     string `json:"proxy"`
+	Upstream  string `json:"upstream"`
+	Status    int    `json:"status"`
+	Class     string `json:"error"`
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	Detail    string `json:"detail,omitempty"`
+	ReauthURL string `json:"reauthenticateUrl,omitempty"`
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} · {{.Proxy}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+code { background: #f3f3f3; padding: 0 .2rem; }
+button { padding: .5rem 1rem; background: #f38020; color: #fff; font: inherit; border: 0; border-radius: 4px; cursor: pointer; }
+small { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p>Proxy <code>{{.Proxy}}</code> forwarding to <code>{{.Upstream}}</code>.</p>
+{{if .Detail}}<p><small>{{.Detail}}</small></p>{{end}}
+{{if .ReauthURL}}<form method="post" action="{{.ReauthURL}}"><button type="submit">Re-authenticate</button></form>{{end}}
+<p><small>{{.Status}} · {{.Class}} · cloudflared-proxy</small></p>
+</body>
+</html>
+`))
+
+// newErrorHandler returns the ErrorHandler of a proxy, which explains why
+// the upstream could not be reached instead of an empty 502.
+func newErrorHandler(config CFAccessProxyConfig) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, context.Canceled) {
+			// The client went away, there is no one to answer.
+			logger.Debug("proxy.Proxy", "Request %s %s of proxy %s canceled", req.Method, req.URL.Path, config.Name)
+			return
+		}
+
+		page := classifyError(err)
+		logger.Warn("proxy.Proxy", "Request %s %s of proxy %s failed (%s): %v", req.Method, req.URL.Path, config.Name, page.Class, err)
+
+		upstream := config.upstreamOf(req)
+		page.Proxy = config.Name
+		page.Upstream = upstream.String()
+		page.Detail = err.Error()
+		if upstream.Reauthenticate != nil {
+			next := "/"
+			if path, ok := localPath(config, upstream.Url, req.URL.Path); ok {
+				next = (&url.URL{Path: path, RawQuery: req.URL.RawQuery}).RequestURI()
+			}
+			query := url.Values{"next": {next}}
+			if len(config.Upstreams) > 1 {
+				query.Set("upstream", upstream.Url.Host)
+			}
+			page.ReauthURL = reauthPath + "?" + query.Encode()
+		}
+		writeErrorPage(w, req, page)
+	}
+}
+
+// Returns the page of an error, its class being one of dns, tls, timeout,
+// connection, access_denied, token_expired, token_missing or upstream.
+func classifyError(err error) errorPage {
+	var (
+		dnsErr     *net.DNSError
+		netErr     net.Error
+		verifyErr  *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		pinErr     *PinError
+	)
+
+	switch {
+	case errors.Is(err, errAccessDenied):
+		return errorPage{Status: http.StatusForbidden, Class: "access_denied", Title: "Access denied",
+			Message: "Cloudflare Access denied the request. Check that your identity is allowed by the policies of the application, or re-authenticate with another one."}
+	case errors.Is(err, errTokenExpired):
+		return errorPage{Status: http.StatusUnauthorized, Class: "token_expired", Title: "Access token expired",
+			Message: "Cloudflare Access asked for a new login, the token of the proxy has expired or was revoked. Re-authenticate to get a fresh one."}
+	case errors.Is(err, errTokenMissing):
+		return errorPage{Status: http.StatusUnauthorized, Class: "token_missing", Title: "Access token missing",
+			Message: "The application is protected by Cloudflare Access but the proxy has no token for it. Re-authenticate to log in."}
+	case errors.As(err, &dnsErr):
+		return errorPage{Status: http.StatusBadGateway, Class: "dns", Title: "Host not found",
+			Message: "The hostname of the application could not be resolved. Check the hostname and your DNS settings."}
+	case errors.As(err, &pinErr):
+		return errorPage{Status: http.StatusBadGateway, Class: "tls", Title: "Certificate pin mismatch",
+			Message: "The certificate of the application matches none of the pins of the proxy. If it was rotated, add the pin of the new certificate."}
+	case errors.As(err, &verifyErr), errors.As(err, &unknownCA), errors.As(err, &hostErr), errors.As(err, &invalidErr),
+		errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return errorPage{Status: http.StatusBadGateway, Class: "tls", Title: "TLS error",
+			Message: "A secure connection to the application could not be established. Check its certificate, or its scheme if it does not serve TLS."}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorPage{Status: http.StatusGatewayTimeout, Class: "timeout", Title: "Application timed out",
+			Message: "The application did not answer in time. It may be overloaded or unreachable."}
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorPage{Status: http.StatusBadGateway, Class: "connection", Title: "Connection failed",
+			Message: "The connection to the application was refused or closed. Check that it is running and reachable."}
+	default:
+		return errorPage{Status: http.StatusBadGateway, Class: "upstream", Title: "Bad gateway",
+			Message: "The request to the application failed."}
+	}
+}
+
+// Writes page as JSON if the client asks for it, as HTML otherwise.
+func writeErrorPage(w http.ResponseWriter, req *http.Request, page errorPage) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := errorTemplate.Execute(&body, page); err != nil {
+		logger.Error("proxy.Proxy", err, "Failed to render the error page of proxy %s", page.Proxy)
+		http.Error(w, page.Title, page.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	_, _ = w.Write(body.Bytes())
+}
+
+// Reports whether the client accepts JSON rather than HTML.
+func wantsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// Returns an error if resp comes from Cloudflare Access rather than the
+// application: a redirect to the Access login, or the Access block page.
+func checkAccess(config CFAccessProxyConfig, resp *http.Response) error {
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		location, err := resp.Location()
+		if err != nil || !isAccessLogin(location) {
+			return nil
+		}
+		if config.upstreamOf(resp.Request).currentToken() == "" {
+			return errTokenMissing
+		}
+		return errTokenExpired
+	case resp.StatusCode == http.StatusForbidden:
+		coding := resp.Header.Get("Content-Encoding")
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || (coding != "" && !isDecodable(coding)) {
+			return nil
+		}
+		// The bytes read are kept, so that the body is forwarded as received.
+		var raw bytes.Buffer
+		decoder, err := newDecoder(coding, io.TeeReader(resp.Body, &raw))
+		var head []byte
+		if err == nil {
+			head, err = io.ReadAll(io.LimitReader(decoder, accessPageLimit))
+		}
+		resp.Body = readCloser{io.MultiReader(&raw, resp.Body), resp.Body}
+		if err != nil {
+			return nil
+		}
+		if bytes.Contains(head, []byte("/cdn-cgi/access/")) || bytes.Contains(head, []byte(".cloudflareaccess.com")) {
+			return errAccessDenied
+		}
+	}
+	return nil
+}
+
+// Reports whether u is the Cloudflare Access login.
+func isAccessLogin(u *url.URL) bool {
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), ".cloudflareaccess.com") || strings.HasPrefix(u.Path, "/cdn-cgi/access/login")
+}
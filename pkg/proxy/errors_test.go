@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		expectedClass  string
+		expectedStatus int
+	}{
+		{name: "dns", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "app.example.com"}}, expectedClass: "dns", expectedStatus: http.StatusBadGateway},
+		{name: "tls verification", err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, expectedClass: "tls", expectedStatus: http.StatusBadGateway},
+		{name: "tls record", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, expectedClass: "tls", expectedStatus: http.StatusBadGateway},
+		{name: "deadline", err: fmt.Errorf("dial: %w", context.DeadlineExceeded), expectedClass: "timeout", expectedStatus: http.StatusGatewayTimeout},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, expectedClass: "connection", expectedStatus: http.StatusBadGateway},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, expectedClass: "connection", expectedStatus: http.StatusBadGateway},
+		{name: "access denied", err: errAccessDenied, expectedClass: "access_denied", expectedStatus: http.StatusForbidden},
+		{name: "token expired", err: errTokenExpired, expectedClass: "token_expired", expectedStatus: http.StatusUnauthorized},
+		{name: "token missing", err: errTokenMissing, expectedClass: "token_missing", expectedStatus: http.StatusUnauthorized},
+		{name: "other", err: errors.New("malformed HTTP response"), expectedClass: "upstream", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			page := classifyError(tc.err)
+			assert.Equal(t, tc.expectedClass, page.Class)
+			assert.Equal(t, tc.expectedStatus, page.Status)
+			assert.NotEmpty(t, page.Title)
+			assert.NotEmpty(t, page.Message)
+		})
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	targetURL, _ := url.Parse("https://app.example.com/base")
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: targetURL}}, StripPrefix: "/app"}
+
+	t.Run("html", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/base/page?q=1", nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		rec := httptest.NewRecorder()
+
+		withReauth := config
+		withReauth.Upstreams = []Upstream{{Url: targetURL, Reauthenticate: func() (string, error) { return "", nil }}}
+		newErrorHandler(withReauth)(rec, req, errTokenExpired)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+		assert.Contains(t, rec.Body.String(), "<h1>Access token expired</h1>")
+		assert.Contains(t, rec.Body.String(), "<code>app</code>")
+		assert.Contains(t, rec.Body.String(), `<form method="post" action="/__cloudflared-proxy/reauth?next=%2Fapp%2Fpage%3Fq%3D1">`)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/base/api", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+
+		newErrorHandler(config)(rec, req, &net.DNSError{Err: "no such host", Name: "app.example.com"})
+
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var page errorPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Equal(t, "app", page.Proxy)
+		assert.Equal(t, "https://app.example.com/base", page.Upstream)
+		assert.Equal(t, "dns", page.Class)
+		assert.Equal(t, "lookup app.example.com: no such host", page.Detail)
+		assert.Empty(t, page.ReauthURL)
+	})
+
+	t.Run("several upstreams", func(t *testing.T) {
+		usURL, _ := url.Parse("https://app-us.example.com/base")
+		reauth := func() (string, error) { return "", nil }
+		several := config
+		several.Upstreams = []Upstream{{Url: targetURL, Reauthenticate: reauth}, {Url: usURL, Reauthenticate: reauth}}
+		several.balancer = newBalancer(several)
+
+		req := httptest.NewRequest(http.MethodGet, "https://app-us.example.com/base/api", nil)
+		req = req.WithContext(withUpstream(req.Context(), several.balancer.upstreams[1]))
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+
+		newErrorHandler(several)(rec, req, errTokenMissing)
+
+		var page errorPage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+		assert.Equal(t, "https://app-us.example.com/base", page.Upstream)
+		assert.Equal(t, "/__cloudflared-proxy/reauth?next=%2Fapp%2Fapi&upstream=app-us.example.com", page.ReauthURL)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/base", nil)
+		rec := httptest.NewRecorder()
+
+		newErrorHandler(config)(rec, req, context.Canceled)
+
+		assert.Empty(t, rec.Body.String())
+	})
+}
+
+func TestCheckAccess(t *testing.T) {
+	testCases := []struct {
+		name        string
+		token       string
+		status      int
+		header      http.Header
+		body        string
+		expectedErr error
+	}{
+		{
+			name:        "login redirect with token",
+			token:       "token",
+			status:      http.StatusFound,
+			header:      http.Header{"Location": {"https://team.cloudflareaccess.com/cdn-cgi/access/login/app.example.com?redirect_url=%2F"}},
+			expectedErr: errTokenExpired,
+		},
+		{
+			name:        "login redirect without token",
+			status:      http.StatusFound,
+			header:      http.Header{"Location": {"/cdn-cgi/access/login/app.example.com"}},
+			expectedErr: errTokenMissing,
+		},
+		{
+			name:   "application redirect",
+			token:  "token",
+			status: http.StatusFound,
+			header: http.Header{"Location": {"https://app.example.com/login"}},
+		},
+		{
+			name:        "access block page",
+			token:       "token",
+			status:      http.StatusForbidden,
+			header:      http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			body:        `<html><a href="https://team.cloudflareaccess.com/cdn-cgi/access/logout">Sign out</a></html>`,
+			expectedErr: errAccessDenied,
+		},
+		{
+			name:        "compressed access block page",
+			token:       "token",
+			status:      http.StatusForbidden,
+			header:      http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Encoding": {"gzip"}},
+			body:        encode(options.EncodingGzip, `<html><a href="https://team.cloudflareaccess.com/cdn-cgi/access/logout">Sign out</a></html>`),
+			expectedErr: errAccessDenied,
+		},
+		{
+			name:   "application forbidden",
+			token:  "token",
+			status: http.StatusForbidden,
+			header: http.Header{"Content-Type": {"text/html"}},
+			body:   "<html>Forbidden</html>",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+			resp := &http.Response{StatusCode: tc.status, Header: tc.header, Body: io.NopCloser(strings.NewReader(tc.body)), Request: req}
+
+			err := checkAccess(CFAccessProxyConfig{Upstreams: []Upstream{{Token: tc.token}}}, resp)
+
+			assert.Equal(t, tc.expectedErr, err)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, tc.body, string(body))
+		})
+	}
+}
+
+func TestErrorHandlerUnreachableUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstreamURL, _ := url.Parse(upstream.URL)
+	upstream.Close()
+
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: upstreamURL}}}
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.Director = newDirector(config, nil)
+	proxy.ModifyResponse = newResponseRewriter(config, nil)
+	proxy.ErrorHandler = newErrorHandler(config)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8888/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	var page errorPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Equal(t, "connection", page.Class)
+}
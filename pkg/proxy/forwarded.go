@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"}
+
+// clientIPKey is the context key of the IP address of the client.
+type clientIPKey struct{}
+
+// forwarding applies a forwarding header policy.
+type forwarding struct {
+	policy  string
+	trusted []netip.Prefix
+}
+
+// Returns the forwarding of a policy, which may be empty, and trusted
+// proxies, given as IP addresses or CIDR ranges.
+func newForwarding(policy string, trustedProxies []string) (*forwarding, error) {
+	policy, err := options.ForwardingPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := options.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &forwarding{policy: policy, trusted: trusted}, nil
+}
+
+// Reports whether ip is a trusted proxy.
+func (f *forwarding) trusts(ip netip.Addr) bool {
+	for _, prefix := range f.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withForwarding applies the forwarding header policy to the requests of
+// the client, before the reverse proxy copies them, and records the IP
+// address of the client. Behind trusted proxies, it is the last untrusted
+// address of X-Forwarded-For.
+func withForwarding(f *forwarding, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote := remoteAddr(r)
+		trustedPeer := remote.IsValid() && f.trusts(remote)
+
+		clientIP := remote
+		if trustedPeer {
+			clientIP = f.clientIP(r.Header.Values("X-Forwarded-For"), remote)
+		}
+
+		switch f.policy {
+		case options.ForwardedSet:
+			f.set(r, trustedPeer)
+		case options.ForwardedStrip:
+			deleteForwarding(r.Header)
+			// A nil value stops the reverse proxy from adding X-Forwarded-For.
+			r.Header["X-Forwarded-For"] = nil
+		case options.ForwardedRFC7239:
+			f.setRFC7239(r, remote, trustedPeer)
+		}
+
+		if clientIP.IsValid() {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP.String()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the last address of the X-Forwarded-For chain that is not a
+// trusted proxy, or the first one if all of them are trusted.
+func (f *forwarding) clientIP(xff []string, remote netip.Addr) netip.Addr {
+	chain := splitList(xff)
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(chain[i])
+		if err != nil {
+			break
+		}
+		client = ip.Unmap()
+		if !f.trusts(client) {
+			break
+		}
+	}
+	return client
+}
+
+// Replaces the X-Forwarded-* headers. Those of trusted proxies are extended,
+// the reverse proxy appending the address of the peer to X-Forwarded-For.
+func (f *forwarding) set(r *http.Request, trustedPeer bool) {
+	prior, host, proto := "", r.Host, "http"
+	if trustedPeer {
+		prior = strings.Join(splitList(r.Header.Values("X-Forwarded-For")), ", ")
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+		if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	}
+
+	deleteForwarding(r.Header)
+	if prior != "" {
+		r.Header.Set("X-Forwarded-For", prior)
+	}
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// Replaces the forwarding headers with an RFC 7239 Forwarded header, which
+// extends that of trusted proxies.
+func (f *forwarding) setRFC7239(r *http.Request, remote netip.Addr, trustedPeer bool) {
+	var elements []string
+	if trustedPeer {
+		elements = splitList(r.Header.Values("Forwarded"))
+	}
+
+	node := "unknown"
+	if remote.IsValid() {
+		node = remote.String()
+		if remote.Is6() {
+			node = `"[` + node + `]"`
+		}
+	}
+	elements = append(elements, fmt.Sprintf("for=%s;host=%s;proto=http", node, forwardedValue(r.Host)))
+
+	deleteForwarding(r.Header)
+	r.Header["X-Forwarded-For"] = nil
+	r.Header.Set("Forwarded", strings.Join(elements, ", "))
+}
+
+// Returns v as an RFC 7239 value, quoted unless it is a token.
+func forwardedValue(v string) string {
+	if v != "" && options.ValidHeaderName(v) {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// Returns the IP address of the peer of r.
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+// Returns the elements of comma-separated header values.
+func splitList(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+func deleteForwarding(h http.Header) {
+	for _, name := range forwardingHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithForwarding(t *testing.T) {
+	testCases := []struct {
+		name             string
+		policy           string
+		trustedProxies   []string
+		remoteAddr       string
+		header           http.Header
+		expectedHeader   http.Header
+		expectedClientIP string
+	}{
+		{
+			name:             "preserve appends the client",
+			remoteAddr:       "192.0.2.10:5000",
+			header:           http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Host": {"public.example.com"}},
+			expectedHeader:   http.Header{"X-Forwarded-For": {"198.51.100.1, 192.0.2.10"}, "X-Forwarded-Host": {"public.example.com"}},
+			expectedClientIP: "192.0.2.10",
+		},
+		{
+			name:             "set drops untrusted headers",
+			policy:           options.ForwardedSet,
+			remoteAddr:       "192.0.2.10:5000",
+			header:           http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=198.51.100.1"}},
+			expectedHeader:   http.Header{"X-Forwarded-For": {"192.0.2.10"}, "X-Forwarded-Host": {"localhost:8888"}, "X-Forwarded-Proto": {"http"}},
+			expectedClientIP: "192.0.2.10",
+		},
+		{
+			name:             "set extends trusted headers",
+			policy:           options.ForwardedSet,
+			trustedProxies:   []string{"10.0.0.0/8"},
+			remoteAddr:       "10.0.0.2:5000",
+			header:           http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3"}, "X-Forwarded-Host": {"public.example.com"}, "X-Forwarded-Proto": {"https"}},
+			expectedHeader:   http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3, 10.0.0.2"}, "X-Forwarded-Host": {"public.example.com"}, "X-Forwarded-Proto": {"https"}},
+			expectedClientIP: "198.51.100.1",
+		},
+		{
+			name:             "strip",
+			policy:           options.ForwardedStrip,
+			trustedProxies:   []string{"10.0.0.0/8"},
+			remoteAddr:       "10.0.0.2:5000",
+			header:           http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Host": {"public.example.com"}, "Forwarded": {"for=198.51.100.1"}},
+			expectedHeader:   http.Header{},
+			expectedClientIP: "198.51.100.1",
+		},
+		{
+			name:             "rfc7239 drops untrusted headers",
+			policy:           options.ForwardedRFC7239,
+			remoteAddr:       "[2001:db8::1]:5000",
+			header:           http.Header{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.1"}},
+			expectedHeader:   http.Header{"Forwarded": {`for="[2001:db8::1]";host="localhost:8888";proto=http`}},
+			expectedClientIP: "2001:db8::1",
+		},
+		{
+			name:             "rfc7239 extends trusted headers",
+			policy:           options.ForwardedRFC7239,
+			trustedProxies:   []string{"10.0.0.2"},
+			remoteAddr:       "10.0.0.2:5000",
+			header:           http.Header{"Forwarded": {"for=198.51.100.1;proto=https"}},
+			expectedHeader:   http.Header{"Forwarded": {`for=198.51.100.1;proto=https, for=10.0.0.2;host="localhost:8888";proto=http`}},
+			expectedClientIP: "10.0.0.2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var received http.Header
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header
+			}))
+			defer upstream.Close()
+			upstreamURL, _ := url.Parse(upstream.URL)
+
+			forwarding, err := newForwarding(tc.policy, tc.trustedProxies)
+			require.NoError(t, err)
+
+			var clientIP string
+			proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+			director := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				director(req)
+				clientIP = headerVars(CFAccessProxyConfig{}, req).ClientIP
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8888/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header = tc.header
+			withForwarding(forwarding, proxy).ServeHTTP(httptest.NewRecorder(), req)
+
+			for _, name := range forwardingHeaders {
+				assert.Equal(t, tc.expectedHeader.Values(name), received.Values(name), name)
+			}
+			assert.Equal(t, tc.expectedClientIP, clientIP)
+		})
+	}
+}
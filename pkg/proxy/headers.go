@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// HeaderRules are the headers changed in a request or response.
+type HeaderRules = options.HeaderRules
+
+// HeaderVars are the variables available to the header templates.
+type HeaderVars = options.HeaderVars
+
+// headerRewriter applies compiled HeaderRules. A nil headerRewriter changes
+// nothing.
+type headerRewriter struct {
+	set    map[string]*template.Template
+	add    map[string]*template.Template
+	remove []string
+}
+
+// Returns the headerRewriter of the rules, or nil if there are none.
+func compileHeaderRules(r HeaderRules) (*headerRewriter, error) {
+	if len(r.Set) == 0 && len(r.Add) == 0 && len(r.Remove) == 0 {
+		return nil, nil
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return &headerRewriter{set: compileTemplates(r.Set), add: compileTemplates(r.Add), remove: r.Remove}, nil
+}
+
+// Returns the templates of headers, which the rules validated.
+func compileTemplates(headers map[string]string) map[string]*template.Template {
+	templates := make(map[string]*template.Template, len(headers))
+	for name, value := range headers {
+		templates[name] = template.Must(options.ParseHeaderTemplate(name, value))
+	}
+	return templates
+}
+
+// Applies the rules to the headers h.
+func (r *headerRewriter) apply(h http.Header, vars HeaderVars) {
+	if r == nil {
+		return
+	}
+
+	for _, name := range r.remove {
+		h.Del(name)
+	}
+	for name, tmpl := range r.set {
+		if value, ok := executeTemplate(tmpl, vars); ok {
+			h.Set(name, value)
+		}
+	}
+	for name, tmpl := range r.add {
+		if value, ok := executeTemplate(tmpl, vars); ok {
+			h.Add(name, value)
+		}
+	}
+}
+
+// Returns the value of a header template, or false if it cannot be used.
+func executeTemplate(tmpl *template.Template, vars HeaderVars) (string, bool) {
+	var value strings.Builder
+	if err := tmpl.Execute(&value, vars); err != nil {
+		logger.Warn("proxy.Proxy", "Skipping header %s of proxy %s: %v", tmpl.Name(), vars.Name, err)
+		return "", false
+	}
+	if strings.ContainsAny(value.String(), "\r\n") {
+		logger.Warn("proxy.Proxy", "Skipping header %s of proxy %s: value contains a line break", tmpl.Name(), vars.Name)
+		return "", false
+	}
+	return value.String(), true
+}
+
+// Returns the template variables of a request to the proxy. The client IP
+// is the one resolved by withForwarding, or the peer address.
+func headerVars(config CFAccessProxyConfig, req *http.Request) HeaderVars {
+	vars := HeaderVars{Name: config.Name}
+	if req != nil {
+		if clientIP, ok := req.Context().Value(clientIPKey{}).(string); ok {
+			vars.ClientIP = clientIP
+		} else if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			vars.ClientIP = host
+		} else {
+			vars.ClientIP = req.RemoteAddr
+		}
+	}
+	vars.TokenSubject, vars.TokenEmail = tokenClaims(config.upstreamOf(req).currentToken())
+	return vars
+}
+
+// Returns the subject and email claims of a JWT, for the header templates.
+func tokenClaims(token string) (subject, email string) {
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if !decodeClaims(token, &claims) {
+		return "", ""
+	}
+	return claims.Subject, claims.Email
+}
+
+// Returns the expiry of a JWT, if it has one.
+func tokenExpiry(token string) (time.Time, bool) {
+	var claims struct {
+		Expiry float64 `json:"exp"`
+	}
+	if !decodeClaims(token, &claims) || claims.Expiry == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Expiry), 0), true
+}
+
+// Decodes the claims of a JWT into v. The token is not verified, it was
+// issued by cloudflared and is only read.
+func decodeClaims(token string, v any) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
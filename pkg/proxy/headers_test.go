@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns an unsigned JWT with the given payload.
+func testToken(payload string) string {
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestHeaderRewriterApply(t *testing.T) {
+	rewriter, err := compileHeaderRules(HeaderRules{
+		Set:    map[string]string{"X-Forwarded-User": "{{ .TokenEmail }}", "X-Client": "{{ .ClientIP }} via {{ .Name }}"},
+		Add:    map[string]string{"X-Tag": "{{ .TokenSubject }}"},
+		Remove: []string{"X-Debug", "x-forwarded-user"},
+	})
+	require.NoError(t, err)
+
+	h := http.Header{}
+	h.Set("X-Debug", "1")
+	h.Set("X-Forwarded-User", "spoofed@example.com")
+	h.Set("X-Tag", "existing")
+
+	rewriter.apply(h, HeaderVars{Name: "grafana", ClientIP: "10.0.0.2", TokenSubject: "1234", TokenEmail: "user@example.com"})
+
+	assert.Equal(t, http.Header{
+		"X-Forwarded-User": {"user@example.com"},
+		"X-Client":         {"10.0.0.2 via grafana"},
+		"X-Tag":            {"existing", "1234"},
+	}, h)
+}
+
+func TestHeaderRewriterNil(t *testing.T) {
+	rewriter, err := compileHeaderRules(HeaderRules{})
+	require.NoError(t, err)
+	assert.Nil(t, rewriter)
+
+	h := http.Header{"X-Debug": {"1"}}
+	rewriter.apply(h, HeaderVars{})
+	assert.Equal(t, http.Header{"X-Debug": {"1"}}, h)
+}
+
+func TestTokenClaims(t *testing.T) {
+	subject, email := tokenClaims(testToken(`{"sub":"1234","email":"user@example.com"}`))
+	assert.Equal(t, "1234", subject)
+	assert.Equal(t, "user@example.com", email)
+
+	subject, email = tokenClaims("not-a-jwt")
+	assert.Empty(t, subject)
+	assert.Empty(t, email)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expiry, ok := tokenExpiry(testToken(`{"sub":"1234","exp":1700000000}`))
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1700000000, 0), expiry)
+
+	_, ok = tokenExpiry(testToken(`{"sub":"1234"}`))
+	assert.False(t, ok)
+	_, ok = tokenExpiry("not-a-jwt")
+	assert.False(t, ok)
+}
+
+func TestDirectorRequestHeaders(t *testing.T) {
+	targetURL, err := url.Parse("https://app.example.com")
+	require.NoError(t, err)
+	token := testToken(`{"email":"user@example.com"}`)
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: targetURL, Token: token}}}
+	rewriter, err := compileHeaderRules(HeaderRules{Set: map[string]string{"X-Forwarded-User": "{{ .TokenEmail }}", "X-Client-IP": "{{ .ClientIP }}"}})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	req.RemoteAddr = "192.0.2.1:54321"
+	newDirector(config, rewriter)(req)
+
+	assert.Equal(t, "user@example.com", req.Header.Get("X-Forwarded-User"))
+	assert.Equal(t, "192.0.2.1", req.Header.Get("X-Client-IP"))
+	assert.Equal(t, token, req.Header.Get("cf-access-token"))
+}
+
+func TestResponseRewriterHeaders(t *testing.T) {
+	targetURL, err := url.Parse("https://app.example.com")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: targetURL}}}
+	rewriter, err := compileHeaderRules(HeaderRules{Remove: []string{"Server", "X-Powered-By"}, Set: map[string]string{"X-Proxy": "{{ .Name }}"}})
+	require.NoError(t, err)
+
+	resp := &http.Response{
+		Header:  http.Header{"Server": {"nginx"}, "X-Powered-By": {"PHP"}, "Content-Type": {"text/html"}},
+		Request: httptest.NewRequest("GET", "https://app.example.com/", nil),
+	}
+	require.NoError(t, newResponseRewriter(config, rewriter)(resp))
+
+	assert.Equal(t, http.Header{"Content-Type": {"text/html"}, "X-Proxy": {"app"}}, resp.Header)
+}
+
+func TestStartMultipleProxiesInvalidHeaders(t *testing.T) {
+	targetURL, err := url.Parse("https://app.example.com")
+	require.NoError(t, err)
+
+	err = StartMultipleProxies(t.Context(), []CFAccessProxyConfig{
+		{Name: "app", Upstreams: []Upstream{{Url: targetURL}}, LocalPort: 8080, RequestHeaders: HeaderRules{Set: map[string]string{"X-User": "{{ .User }}"}}},
+	}, ProbeOptions{})
+	assert.ErrorContains(t, err, "invalid request headers of proxy app")
+}
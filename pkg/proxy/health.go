@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// States of an upstream reported by the health checks.
+const (
+	HealthUnknown = "unknown" // Not checked yet, or health checks are disabled
+	HealthUp      = "up"
+	HealthDown    = "down"
+	// HealthTokenExpired means Cloudflare Access asks for a login: the
+	// application may be up, but the token of the proxy is expired or missing.
+	HealthTokenExpired = "token_expired"
+)
+
+// statusPath serves the health of the upstreams of the proxy as JSON.
+const statusPath = reservedPrefix + "status"
+
+// healthCheckUserAgent identifies the health checks in the logs of the
+// application.
+const healthCheckUserAgent = "cloudflared-proxy-health-check"
+
+// HealthCheckOptions configure the checks of the upstreams of a proxy.
+type HealthCheckOptions = options.HealthCheck
+
+// HealthStatus is the outcome of the health checks of an upstream.
+type HealthStatus struct {
+	Upstream string        `json:"upstream"`
+	State    string        `json:"state"`            // One of the Health constants
+	Class    string        `json:"class,omitempty"`  // Class of the failure, as on error pages
+	Detail   string        `json:"detail,omitempty"` // Failure of the last check
+	Since    time.Time     `json:"since,omitzero"`   // Start of the current state
+	Checked  time.Time     `json:"checked,omitzero"` // Time of the last check
+	Latency  time.Duration `json:"latency"`          // Duration of the last check
+	Checks   int           `json:"checks"`           // Checks run
+	Failures int           `json:"failures"`         // Checks that failed
+}
+
+// health holds the HealthStatus of an upstream.
+type health struct {
+	mu     sync.Mutex
+	status HealthStatus
+}
+
+// Returns the state of the upstream, HealthUnknown until it is checked.
+func (h *health) state() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status.State == "" {
+		return HealthUnknown
+	}
+	return h.status.State
+}
+
+// Records the outcome of a check and returns the previous state.
+func (h *health) record(state, class, detail string, checked time.Time, latency time.Duration) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	previous := h.status.State
+	if previous == "" {
+		previous = HealthUnknown
+	}
+	if state != previous {
+		h.status.Since = checked
+	}
+	h.status.State, h.status.Class, h.status.Detail = state, class, detail
+	h.status.Checked, h.status.Latency = checked, latency
+	h.status.Checks++
+	if state != HealthUp {
+		h.status.Failures++
+	}
+	return previous
+}
+
+// Forgets a token_expired state once the token is renewed, until the next
+// check.
+func (h *health) tokenRenewed(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status.State == HealthTokenExpired {
+		h.status.State, h.status.Class, h.status.Detail, h.status.Since = HealthUnknown, "", "", now
+	}
+}
+
+// Returns the status of the upstream.
+func (u *upstream) healthStatus() HealthStatus {
+	u.health.mu.Lock()
+	status := u.health.status
+	u.health.mu.Unlock()
+
+	status.Upstream = u.String()
+	if status.State == "" {
+		status.State = HealthUnknown
+	}
+	return status
+}
+
+// healthStates are the states of an upstream reported by the state metric.
+var healthStates = []string{HealthUnknown, HealthUp, HealthDown, HealthTokenExpired}
+
+// healthMetrics record the outcome of the health checks.
+type healthMetrics struct {
+	checks   metric.Int64Counter
+	failures metric.Int64Counter
+	latency  metric.Float64Histogram
+	state    metric.Int64Gauge // 1 for the state of the upstream, 0 for the others
+}
+
+// Returns the health check instruments of the meter of the tool.
+func newHealthMetrics() healthMetrics {
+	meter := tracing.Meter()
+	var m healthMetrics
+	var errs [4]error
+	m.checks, errs[0] = meter.Int64Counter("cloudflared_proxy.health_check.checks",
+		metric.WithDescription("Health checks run"), metric.WithUnit("{check}"))
+	m.failures, errs[1] = meter.Int64Counter("cloudflared_proxy.health_check.failures",
+		metric.WithDescription("Health checks that failed"), metric.WithUnit("{check}"))
+	m.latency, errs[2] = meter.Float64Histogram("cloudflared_proxy.health_check.latency",
+		metric.WithDescription("Duration of the health checks"), metric.WithUnit("s"))
+	m.state, errs[3] = meter.Int64Gauge("cloudflared_proxy.health_check.state",
+		metric.WithDescription("State of the upstream as of its last health check"))
+	if err := errors.Join(errs[:]...); err != nil {
+		// The instruments are still usable, they record nothing.
+		logger.Debug("proxy.Proxy", "Failed to create the health check metrics: %v", err)
+	}
+	return m
+}
+
+// Records a check of upstream of proxy ending in state after latency.
+func (m healthMetrics) record(ctx context.Context, proxy, upstream, state string, latency time.Duration) {
+	attrs := attribute.NewSet(attribute.String("proxy", proxy), attribute.String("upstream", upstream))
+	m.checks.Add(ctx, 1, metric.WithAttributeSet(attrs))
+	if state != HealthUp {
+		m.failures.Add(ctx, 1, metric.WithAttributeSet(attrs))
+	}
+	m.latency.Record(ctx, latency.Seconds(), metric.WithAttributeSet(attrs))
+	for _, s := range healthStates {
+		var value int64
+		if s == state {
+			value = 1
+		}
+		m.state.Record(ctx, value, metric.WithAttributes(append(attrs.ToSlice(), attribute.String("state", s))...))
+	}
+}
+
+// healthChecker checks the upstreams of a proxy.
+type healthChecker struct {
+	config  CFAccessProxyConfig
+	options HealthCheckOptions
+	client  *http.Client
+	metrics healthMetrics
+	now     func() time.Time // Replaced in tests
+}
+
+// Returns the health checker of a proxy, or nil if health checks are
+// disabled.
+func newHealthChecker(config CFAccessProxyConfig, transport http.RoundTripper) *healthChecker {
+	o := config.HealthCheck
+	if o.Path == "" {
+		return nil
+	}
+	o.Interval = orDefault(o.Interval, options.DefaultHealthCheckInterval)
+	o.Timeout = min(orDefault(o.Timeout, options.DefaultHealthCheckTimeout), o.Interval)
+
+	return &healthChecker{
+		config:  config,
+		options: o,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   o.Timeout,
+			// A redirect to the Access login is a failure of its own.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		metrics: newHealthMetrics(),
+		now:     time.Now,
+	}
+}
+
+// Checks every upstream each interval until ctx is done.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.options.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range h.config.balancer.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.check(ctx, u)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks u, records the outcome in its status and the metrics, and logs any
+// change of its state.
+func (h *healthChecker) check(ctx context.Context, u *upstream) {
+	start := h.now()
+	err := h.probe(ctx, u)
+	if ctx.Err() != nil {
+		// Stopped while checking, the outcome means nothing.
+		return
+	}
+
+	state, class, detail := HealthUp, "", ""
+	if err != nil {
+		page := classifyError(err)
+		state, class, detail = HealthDown, page.Class, err.Error()
+		if errors.Is(err, errTokenExpired) || errors.Is(err, errTokenMissing) {
+			state = HealthTokenExpired
+		}
+	}
+
+	latency := h.now().Sub(start)
+	previous := u.health.record(state, class, detail, start, latency)
+	h.metrics.record(ctx, h.config.Name, u.String(), state, latency)
+	if state == previous {
+		return
+	}
+	switch state {
+	case HealthUp:
+		if previous == HealthUnknown {
+			logger.Debug("proxy.Proxy", "Upstream %s of proxy %s is healthy", u, h.config.Name)
+		} else {
+			logger.Info("proxy.Proxy", "Upstream %s of proxy %s is healthy again", u, h.config.Name)
+		}
+	case HealthTokenExpired:
+		logger.Warn("proxy.Proxy", "Access token of upstream %s of proxy %s is no longer accepted, re-authenticate from an error page at %s", u, h.config.Name, h.config.localURL())
+	default:
+		logger.Warn("proxy.Proxy", "Health check of upstream %s of proxy %s failed (%s): %s", u, h.config.Name, class, detail)
+	}
+}
+
+// Requests the health check path of u with its token. Responses of
+// Cloudflare Access and unexpected statuses are errors.
+func (h *healthChecker) probe(ctx context.Context, u *upstream) error {
+	target := u.Url
+	path, rawPath := joinURLPath(target, &url.URL{Path: h.options.Path})
+	checkURL := &url.URL{Scheme: target.Scheme, Host: target.Host, Path: path, RawPath: rawPath}
+
+	req, err := http.NewRequestWithContext(withUpstream(ctx, u), http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", healthCheckUserAgent)
+	setToken(req, h.config, u.currentToken())
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		// Unwrap the *url.Error of the client, so that the cause is classified.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkAccess(h.config, resp); err != nil {
+		return err
+	}
+	// Drain a little of the body so that the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, accessPageLimit))
+
+	if expected := h.options.ExpectedStatus; expected != 0 {
+		if resp.StatusCode != expected {
+			return fmt.Errorf("health check answered %s, expected %d", resp.Status, expected)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check answered %s, expected a 2xx status", resp.Status)
+	}
+	return nil
+}
+
+// proxyStatus is the document served at statusPath.
+type proxyStatus struct {
+	Proxy     string         `json:"proxy"`
+	Upstreams []HealthStatus `json:"upstreams"`
+}
+
+// Writes the health of the upstreams of the proxy as JSON.
+func writeStatus(w http.ResponseWriter, config CFAccessProxyConfig) {
+	status := proxyStatus{Proxy: config.Name}
+	for _, u := range config.reauthUpstreams("") {
+		status.Upstreams = append(status.Upstreams, u.healthStatus())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logger.Debug("proxy.Proxy", "Failed to write the status of proxy %s: %v", config.Name, err)
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestNewHealthCheckerDisabled(t *testing.T) {
+	assert.Nil(t, newHealthChecker(CFAccessProxyConfig{HealthCheck: HealthCheckOptions{Interval: time.Minute}}, http.DefaultTransport))
+}
+
+// Returns a checker of a proxy forwarding to server under /app with token,
+// along with its only upstream.
+func newTestHealthChecker(t *testing.T, server *httptest.Server, options HealthCheckOptions, token string) (*healthChecker, *upstream) {
+	t.Helper()
+	target, err := url.Parse(server.URL + "/app")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: target, Token: token}}, HealthCheck: options}
+	config.balancer = newBalancer(config)
+	checker := newHealthChecker(config, server.Client().Transport)
+	require.NotNil(t, checker)
+	return checker, config.balancer.upstreams[0]
+}
+
+func TestHealthCheck(t *testing.T) {
+	var path, token, userAgent string
+	status := http.StatusOK
+	location := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, token, userAgent = r.URL.Path, r.Header.Get(options.DefaultTokenHeader), r.UserAgent()
+		if location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	checker, u := newTestHealthChecker(t, server, HealthCheckOptions{Path: "/healthz"}, "token")
+	assert.Equal(t, HealthUnknown, u.healthStatus().State)
+
+	checker.check(context.Background(), u)
+	assert.Equal(t, "/app/healthz", path)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, healthCheckUserAgent, userAgent)
+	assert.Equal(t, HealthUp, u.healthStatus().State)
+
+	status = http.StatusServiceUnavailable
+	checker.check(context.Background(), u)
+	got := u.healthStatus()
+	assert.Equal(t, HealthDown, got.State)
+	assert.Equal(t, "upstream", got.Class)
+	assert.Equal(t, "health check answered 503 Service Unavailable, expected a 2xx status", got.Detail)
+	assert.False(t, u.available(time.Now()), "upstreams failing their health checks are skipped")
+
+	status, location = http.StatusFound, "https://team.cloudflareaccess.com/cdn-cgi/access/login/app"
+	checker.check(context.Background(), u)
+	got = u.healthStatus()
+	assert.Equal(t, HealthTokenExpired, got.State, "a login page is not an outage")
+	assert.Equal(t, "token_expired", got.Class)
+	assert.Equal(t, 3, got.Checks)
+	assert.Equal(t, 2, got.Failures)
+
+	u.health.tokenRenewed(time.Now())
+	assert.Equal(t, HealthUnknown, u.healthStatus().State)
+	assert.True(t, u.available(time.Now()))
+}
+
+func TestHealthCheckExpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	checker, u := newTestHealthChecker(t, server, HealthCheckOptions{Path: "/", ExpectedStatus: http.StatusNoContent}, "token")
+	checker.check(context.Background(), u)
+	assert.Equal(t, HealthDown, u.healthStatus().State)
+	assert.Equal(t, "health check answered 200 OK, expected 204", u.healthStatus().Detail)
+}
+
+func TestHealthCheckUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	checker, u := newTestHealthChecker(t, server, HealthCheckOptions{Path: "/"}, "token")
+	server.Close()
+
+	checker.check(context.Background(), u)
+	assert.Equal(t, HealthDown, u.healthStatus().State)
+	assert.Equal(t, "connection", u.healthStatus().Class)
+}
+
+func TestHealthCheckMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	t.Cleanup(func() { otel.SetMeterProvider(metricnoop.NewMeterProvider()) })
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	checker, u := newTestHealthChecker(t, server, HealthCheckOptions{Path: "/healthz"}, "token")
+	checker.check(context.Background(), u)
+	status = http.StatusServiceUnavailable
+	checker.check(context.Background(), u)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	metrics := map[string]metricdata.Aggregation{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m.Data
+	}
+
+	upstream := attribute.NewSet(attribute.String("proxy", "app"), attribute.String("upstream", u.String()))
+	counts := func(name string) map[attribute.Set]int64 {
+		sum, ok := metrics[name].(metricdata.Sum[int64])
+		require.True(t, ok, name)
+		counts := map[attribute.Set]int64{}
+		for _, p := range sum.DataPoints {
+			counts[p.Attributes] = p.Value
+		}
+		return counts
+	}
+	assert.Equal(t, map[attribute.Set]int64{upstream: 2}, counts("cloudflared_proxy.health_check.checks"))
+	assert.Equal(t, map[attribute.Set]int64{upstream: 1}, counts("cloudflared_proxy.health_check.failures"))
+
+	latency, ok := metrics["cloudflared_proxy.health_check.latency"].(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, latency.DataPoints, 1)
+	assert.Equal(t, uint64(2), latency.DataPoints[0].Count)
+
+	gauge, ok := metrics["cloudflared_proxy.health_check.state"].(metricdata.Gauge[int64])
+	require.True(t, ok)
+	states := map[string]int64{}
+	for _, p := range gauge.DataPoints {
+		state, _ := p.Attributes.Value("state")
+		states[state.AsString()] = p.Value
+	}
+	assert.Equal(t, map[string]int64{HealthUnknown: 0, HealthUp: 0, HealthDown: 1, HealthTokenExpired: 0}, states)
+}
+
+func TestHealthCheckerRun(t *testing.T) {
+	checks := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks <- struct{}{}
+	}))
+	defer server.Close()
+
+	checker, u := newTestHealthChecker(t, server, HealthCheckOptions{Path: "/", Interval: 10 * time.Millisecond}, "token")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		checker.run(ctx)
+		close(done)
+	}()
+
+	for range 2 {
+		select {
+		case <-checks:
+		case <-time.After(5 * time.Second):
+			t.Fatal("upstream not checked")
+		}
+	}
+	cancel()
+	<-done
+	assert.Equal(t, HealthUp, u.healthStatus().State)
+}
+
+func TestStatusPage(t *testing.T) {
+	target, _ := url.Parse("https://app.example.com")
+	config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: target}}}
+	config.balancer = newBalancer(config)
+	config.balancer.upstreams[0].health.record(HealthDown, "dns", "no such host", time.Now(), time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	withReauth(config, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, statusPath, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var status proxyStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, "app", status.Proxy)
+	require.Len(t, status.Upstreams, 1)
+	assert.Equal(t, "https://app.example.com", status.Upstreams[0].Upstream)
+	assert.Equal(t, HealthDown, status.Upstreams[0].State)
+	assert.Equal(t, "dns", status.Upstreams[0].Class)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// PinError reports an upstream certificate matching none of the pins.
+type PinError struct {
+	Host   string
+	Pins   int
+	SPKI   string // Pin of the public key of the leaf
+	Cert   string // Pin of the leaf certificate
+	Reason string
+}
+
+func (e *PinError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("certificate pinning of %s failed: %s", e.Host, e.Reason)
+	}
+	return fmt.Sprintf("certificate of %s matches none of the %d pins, its pins are %s and %s", e.Host, e.Pins, e.SPKI, e.Cert)
+}
+
+// Returns the VerifyConnection function checking the certificates of an
+// upstream against pins. It is called on every connection, resumed ones
+// included. The upstream is named by its SNI, or host if it sent none.
+func verifyPins(host string, pins []options.Pin) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		host := host
+		if cs.ServerName != "" {
+			host = cs.ServerName
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return &PinError{Host: host, Reason: "no certificate presented"}
+		}
+		leaf := cs.PeerCertificates[0]
+
+		// Without verification, only the leaf is known to belong to the server.
+		candidates := []*x509.Certificate{leaf}
+		for _, chain := range cs.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+
+		leafCert := sha256.Sum256(leaf.Raw)
+		for _, pin := range pins {
+			if !pin.SPKI {
+				if bytes.Equal(pin.Hash, leafCert[:]) {
+					return nil
+				}
+				continue
+			}
+			for _, cert := range candidates {
+				if spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo); bytes.Equal(pin.Hash, spki[:]) {
+					return nil
+				}
+			}
+		}
+
+		leafSPKI := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		return &PinError{
+			Host: host,
+			Pins: len(pins),
+			SPKI: options.PinSPKI + base64.StdEncoding.EncodeToString(leafSPKI[:]),
+			Cert: options.PinCert + hex.EncodeToString(leafCert[:]),
+		}
+	}
+}
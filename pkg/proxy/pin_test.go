@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return options.PinSPKI + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func certPinOf(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return options.PinCert + hex.EncodeToString(hash[:])
+}
+
+func TestPinnedUpstream(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue(t, "app.internal", x509.ExtKeyUsageServerAuth)
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	require.NoError(t, err)
+	other := newTestCA(t)
+
+	upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	colonPin := options.PinCert
+	for i, b := range sha256.Sum256(leaf.Raw) {
+		if i > 0 {
+			colonPin += ":"
+		}
+		colonPin += strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+
+	testCases := []struct {
+		name        string
+		skipTLS     bool
+		pins        []string
+		expectedErr bool
+	}{
+		{name: "leaf key", pins: []string{spkiPin(leaf)}},
+		{name: "ca key of the verified chain", pins: []string{spkiPin(ca.cert)}},
+		{name: "leaf certificate with colons", pins: []string{colonPin}},
+		{name: "rotation", pins: []string{spkiPin(other.cert), certPinOf(leaf)}},
+		{name: "leaf key without verification", skipTLS: true, pins: []string{spkiPin(leaf)}},
+		{name: "ca key without verification", skipTLS: true, pins: []string{spkiPin(ca.cert)}, expectedErr: true},
+		{name: "mismatch", pins: []string{spkiPin(other.cert)}, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := TLSOptions{ServerName: "app.internal", Pins: tc.pins}
+			if !tc.skipTLS {
+				options.CAFile = ca.file
+			}
+			transport, err := newTransport(CFAccessProxyConfig{SkipTLS: tc.skipTLS, TLS: options})
+			require.NoError(t, err)
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+			if !tc.expectedErr {
+				require.NoError(t, err)
+				resp.Body.Close()
+				return
+			}
+
+			var pinErr *PinError
+			require.True(t, errors.As(err, &pinErr), "%v", err)
+			assert.Equal(t, "app.internal", pinErr.Host)
+			assert.Equal(t, spkiPin(leaf), pinErr.SPKI)
+			assert.Equal(t, certPinOf(leaf), pinErr.Cert)
+			assert.Contains(t, err.Error(), "certificate of app.internal matches none of the 1 pins")
+			assert.Equal(t, "tls", classifyError(err).Class)
+		})
+	}
+}
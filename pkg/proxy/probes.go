@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+)
+
+// Paths of the probes on their dedicated listener.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// Paths of the probes on the listener of each proxy.
+const (
+	listenerHealthzPath = reservedPrefix + "healthz"
+	listenerReadyzPath  = reservedPrefix + "readyz"
+)
+
+// States of the token of an upstream reported by the probes.
+const (
+	TokenValid   = "valid"
+	TokenExpired = "expired"
+	TokenNone    = "none" // The application is not behind Cloudflare Access
+)
+
+// ProbeOptions configure the liveness and readiness probes of the tool.
+// /healthz answers as long as the tool runs, and /readyz once every proxy
+// that is not Optional listens and holds unexpired tokens.
+type ProbeOptions struct {
+	Port        uint16 // Port of a dedicated listener, none if unset
+	BindAddress string // Address of the dedicated listener, all interfaces if unset
+	OnListeners bool   // Serve the probes under /__cloudflared-proxy/ on the listener of each proxy
+}
+
+// Returns the address of the dedicated listener.
+func (o ProbeOptions) address() string {
+	return net.JoinHostPort(o.BindAddress, strconv.Itoa(int(o.Port)))
+}
+
+// proxyState is a proxy tracked by the probes.
+type proxyState struct {
+	config  CFAccessProxyConfig
+	address atomic.Pointer[string] // Address the proxy listens on, nil until bound
+}
+
+// Has server record its address in s once it listens, as BaseContext is
+// called by Serve with the listener.
+func (s *proxyState) track(server *http.Server) {
+	server.BaseContext = func(l net.Listener) context.Context {
+		address := l.Addr().String()
+		s.address.Store(&address)
+		return context.Background()
+	}
+}
+
+// Records that the proxy stopped listening.
+func (s *proxyState) unbound() {
+	s.address.Store(nil)
+}
+
+// registry holds the state of the proxies started together, reported by
+// the probes. Every proxy is added before any listener starts, so that the
+// probes never read the list while it grows nor report ready before the
+// last required proxy is known.
+type registry struct {
+	proxies []*proxyState
+	now     func() time.Time // Replaced in tests
+}
+
+func newRegistry() *registry {
+	return &registry{now: time.Now}
+}
+
+// Tracks the proxy of config, whose balancer must be set.
+func (r *registry) add(config CFAccessProxyConfig) *proxyState {
+	s := &proxyState{config: config}
+	r.proxies = append(r.proxies, s)
+	return s
+}
+
+// probeReport is the document served by the probes.
+type probeReport struct {
+	Status  string        `json:"status"` // ok for /healthz, ready or not_ready for /readyz
+	Proxies []proxyReport `json:"proxies"`
+}
+
+type proxyReport struct {
+	Name      string           `json:"name"`
+	Address   string           `json:"address,omitempty"`
+	Bound     bool             `json:"bound"`
+	Required  bool             `json:"required"`
+	Ready     bool             `json:"ready"`
+	Reason    string           `json:"reason,omitempty"` // Why the proxy is not ready
+	Upstreams []upstreamReport `json:"upstreams"`
+}
+
+type upstreamReport struct {
+	Upstream     string    `json:"upstream"`
+	Token        string    `json:"token"` // One of the Token constants
+	TokenExpires time.Time `json:"tokenExpires,omitzero"`
+	Health       string    `json:"health"` // One of the Health constants
+}
+
+// Returns the state of every proxy, and whether all the required ones are
+// ready.
+func (r *registry) report() (probeReport, bool) {
+	now := r.now()
+	report := probeReport{Proxies: []proxyReport{}}
+	ready := true
+	for _, s := range r.proxies {
+		proxy := s.report(now)
+		if proxy.Required && !proxy.Ready {
+			ready = false
+		}
+		report.Proxies = append(report.Proxies, proxy)
+	}
+	return report, ready
+}
+
+// Returns the state of the proxy at now. A proxy is ready once it listens,
+// as long as none of its tokens is expired.
+func (s *proxyState) report(now time.Time) proxyReport {
+	report := proxyReport{Name: s.config.Name, Required: !s.config.Optional, Upstreams: []upstreamReport{}}
+	if address := s.address.Load(); address != nil {
+		report.Address, report.Bound = *address, true
+	} else {
+		report.Reason = "not listening"
+	}
+
+	for _, u := range s.config.balancer.upstreams {
+		upstream := upstreamReport{Upstream: u.String(), Token: TokenValid, Health: u.health.state()}
+		token := u.currentToken()
+		expiry, ok := tokenExpiry(token)
+		if ok {
+			upstream.TokenExpires = expiry
+		}
+		switch {
+		case token == "":
+			upstream.Token = TokenNone
+		case upstream.Health == HealthTokenExpired, ok && !now.Before(expiry):
+			upstream.Token = TokenExpired
+			if report.Reason == "" {
+				report.Reason = fmt.Sprintf("token of upstream %s expired", u)
+			}
+		}
+		report.Upstreams = append(report.Upstreams, upstream)
+	}
+
+	report.Ready = report.Reason == ""
+	return report
+}
+
+// Returns the handler of the probes at the given paths. /healthz always
+// answers 200, /readyz 503 until the tool is ready.
+func (r *registry) handler(healthz, readyz string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != healthz && req.URL.Path != readyz {
+			http.NotFound(w, req)
+			return
+		}
+
+		report, ready := r.report()
+		status := http.StatusOK
+		switch {
+		case req.URL.Path == healthz:
+			report.Status = "ok"
+		case ready:
+			report.Status = "ready"
+		default:
+			report.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logger.Debug("proxy.Proxy", "Failed to write probe %s: %v", req.URL.Path, err)
+		}
+	})
+}
+
+// Returns the server of the probes on their dedicated listener.
+func newProbeServer(options ProbeOptions, r *registry) *http.Server {
+	return &http.Server{
+		Addr:              options.address(),
+		Handler:           r.handler(healthzPath, readyzPath),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a registry with a proxy per config, its balancer set, and sets
+// the clock to now.
+func newTestRegistry(now time.Time, configs ...CFAccessProxyConfig) (*registry, []*proxyState) {
+	r := newRegistry()
+	r.now = func() time.Time { return now }
+	var states []*proxyState
+	for _, config := range configs {
+		config.balancer = newBalancer(config)
+		states = append(states, r.add(config))
+	}
+	return r, states
+}
+
+// Marks s as listening on address.
+func bind(s *proxyState, address string) {
+	s.address.Store(&address)
+}
+
+func TestRegistryReport(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	app, _ := url.Parse("https://app.example.com")
+	public, _ := url.Parse("https://public.example.com")
+	valid := testToken(`{"sub":"1234","exp":1700003600}`)
+	expired := testToken(`{"sub":"1234","exp":1699996400}`)
+
+	t.Run("ready", func(t *testing.T) {
+		r, states := newTestRegistry(now,
+			CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app, Token: valid}}},
+			CFAccessProxyConfig{Name: "public", Upstreams: []Upstream{{Url: public}}},
+		)
+		bind(states[0], "127.0.0.1:8080")
+		bind(states[1], "127.0.0.1:8081")
+
+		report, ready := r.report()
+		assert.True(t, ready)
+		require.Len(t, report.Proxies, 2)
+		assert.Equal(t, proxyReport{
+			Name: "app", Address: "127.0.0.1:8080", Bound: true, Required: true, Ready: true,
+			Upstreams: []upstreamReport{{Upstream: "https://app.example.com", Token: TokenValid, TokenExpires: time.Unix(1700003600, 0), Health: HealthUnknown}},
+		}, report.Proxies[0])
+		assert.Equal(t, TokenNone, report.Proxies[1].Upstreams[0].Token, "applications outside of Access need no token")
+	})
+
+	t.Run("not listening", func(t *testing.T) {
+		r, _ := newTestRegistry(now, CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app, Token: valid}}})
+		report, ready := r.report()
+		assert.False(t, ready)
+		assert.False(t, report.Proxies[0].Bound)
+		assert.Equal(t, "not listening", report.Proxies[0].Reason)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		r, states := newTestRegistry(now, CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app, Token: expired}}})
+		bind(states[0], "127.0.0.1:8080")
+		report, ready := r.report()
+		assert.False(t, ready)
+		assert.Equal(t, TokenExpired, report.Proxies[0].Upstreams[0].Token)
+		assert.Equal(t, "token of upstream https://app.example.com expired", report.Proxies[0].Reason)
+	})
+
+	t.Run("token rejected by the health check", func(t *testing.T) {
+		r, states := newTestRegistry(now, CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app, Token: valid}}})
+		bind(states[0], "127.0.0.1:8080")
+		states[0].config.balancer.upstreams[0].health.record(HealthTokenExpired, "token_expired", "", now, 0)
+		report, ready := r.report()
+		assert.False(t, ready)
+		assert.Equal(t, TokenExpired, report.Proxies[0].Upstreams[0].Token)
+	})
+
+	t.Run("optional proxy", func(t *testing.T) {
+		r, states := newTestRegistry(now,
+			CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app, Token: valid}}},
+			CFAccessProxyConfig{Name: "public", Upstreams: []Upstream{{Url: public}}, Optional: true},
+		)
+		bind(states[0], "127.0.0.1:8080")
+		report, ready := r.report()
+		assert.True(t, ready)
+		assert.False(t, report.Proxies[1].Ready)
+		assert.False(t, report.Proxies[1].Required)
+	})
+}
+
+func TestProbeHandler(t *testing.T) {
+	app, _ := url.Parse("https://app.example.com")
+	r, states := newTestRegistry(time.Now(), CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app}}})
+	handler := r.handler(healthzPath, readyzPath)
+
+	probe := func(path string) (int, probeReport) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var report probeReport
+		if rec.Code != http.StatusNotFound {
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		}
+		return rec.Code, report
+	}
+
+	code, report := probe(healthzPath)
+	assert.Equal(t, http.StatusOK, code, "alive even when not ready")
+	assert.Equal(t, "ok", report.Status)
+	assert.Len(t, report.Proxies, 1)
+
+	code, report = probe(readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not_ready", report.Status)
+
+	bind(states[0], "127.0.0.1:8080")
+	code, report = probe(readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", report.Status)
+
+	code, _ = probe("/other")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestProxyStateTrack(t *testing.T) {
+	app, _ := url.Parse("https://app.example.com")
+	_, states := newTestRegistry(time.Now(), CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app}}})
+	s := states[0]
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	s.track(server)
+	done := make(chan struct{})
+	go func() {
+		_ = server.Serve(listener)
+		close(done)
+	}()
+
+	// Serve records the address before accepting connections.
+	resp, err := http.Get("http://" + listener.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, listener.Addr().String(), *s.address.Load())
+
+	require.NoError(t, server.Close())
+	<-done
+	s.unbound()
+	assert.False(t, s.report(time.Now()).Bound)
+}
+
+func TestListenerProbes(t *testing.T) {
+	app, _ := url.Parse("https://app.example.com")
+	r, states := newTestRegistry(time.Now(), CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: app}}})
+	bind(states[0], "127.0.0.1:8080")
+
+	config := states[0].config
+	forwarded := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded = true })
+
+	rec := httptest.NewRecorder()
+	withReauth(config, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, listenerReadyzPath, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "not served unless enabled")
+
+	config.probes = r.handler(listenerHealthzPath, listenerReadyzPath)
+	rec = httptest.NewRecorder()
+	withReauth(config, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, listenerReadyzPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"ready"`)
+
+	rec = httptest.NewRecorder()
+	withReauth(config, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.True(t, forwarded, "paths outside of the reserved prefix are forwarded")
+}
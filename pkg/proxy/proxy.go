@@ -2,18 +2,21 @@ package proxy
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
 )
 
 // Server defines the behavior of a server that can be started and shut down.
@@ -34,13 +37,8 @@ func (s *httpServer) HTTPServer() *http.Server {
 }
 
 // newServer is a constructor that can be replaced in tests.
-var newServer = func(addr string, handler http.Handler) Server {
-	return &httpServer{
-		&http.Server{
-			Addr:    addr,
-			Handler: handler,
-		},
-	}
+var newServer = func(server *http.Server) Server {
+	return &httpServer{server}
 }
 
 const (
@@ -48,63 +46,249 @@ const (
 	randomPortStart = 8000
 )
 
-func newDirector(config CFAccessProxyConfig) func(*http.Request) {
+func newDirector(config CFAccessProxyConfig, headers *headerRewriter) func(*http.Request) {
 	return func(req *http.Request) {
-		req.URL.Scheme = config.Url.Scheme
-		req.URL.Host = config.Url.Host
-		req.Host = config.Url.Host
-		req.Header.Add("cf-access-token", config.Token)
+		stripPrefix(config.StripPrefix, req.URL)
+		// The route travels with the request to the transport and back.
+		r := &route{path: req.URL.Path, rawPath: req.URL.RawPath}
+		*req = *req.WithContext(context.WithValue(req.Context(), upstreamKey{}, r))
+
+		upstream := config.upstreamOf(nil)
+		if config.balancer != nil {
+			upstream = config.balancer.pick()
+		}
+		config.sendTo(req, r, upstream)
+		headers.apply(req.Header, headerVars(config, req))
 
 		// Debug requests through the proxy
-		logger.Debug("proxy.Proxy", "Request to localhost:%d, URL: %s, Headers: %v", config.LocalPort, req.URL, req.Header)
+		logger.Debug("proxy.Proxy", "Request to %s on localhost:%d, URL: %s, Headers: %v", config.Name, config.LocalPort, req.URL, req.Header)
+	}
+}
+
+// Returns the path of req prefixed with the base path of target, along with
+// its escaped form when it differs from the default encoding.
+func joinURLPath(target, req *url.URL) (path, rawPath string) {
+	if target.Path == "" {
+		return req.Path, req.RawPath
 	}
+	path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(req.Path, "/")
+	if target.RawPath == "" && req.RawPath == "" {
+		return path, ""
+	}
+	return path, strings.TrimSuffix(target.EscapedPath(), "/") + "/" + strings.TrimPrefix(req.EscapedPath(), "/")
 }
 
 type CFAccessProxyConfig struct {
-	Url       *url.URL
-	Token     string
-	LocalPort uint16 // change to local port
-	SkipTLS   bool
+	Name string
+	// Upstreams are the applications requests are forwarded to, chosen as
+	// set by LoadBalancing.
+	Upstreams     []Upstream
+	LoadBalancing LoadBalancingOptions
+	HealthCheck   HealthCheckOptions // Background checks of the upstreams
+	Optional      bool               // Not required for the readiness of the tool
+	// TokenTransport is how the token is passed to the origin, one of the
+	// TokenTransport constants, and TokenHeader the header carrying it.
+	TokenTransport string
+	TokenHeader    string
+	BindAddress    string
+	LocalPort      uint16 // change to local port
+	SkipTLS        bool
+	StripPrefix    string // Local path prefix removed before the path of the upstream is prepended
+	// ForwardedHeaders is the forwarding header policy, one of the Forwarded
+	// constants, and TrustedProxies the addresses whose headers are trusted.
+	ForwardedHeaders string
+	TrustedProxies   []string
+
+	// UpstreamProxy is the outbound proxy to the upstream, see
+	// ValidateUpstreamProxy.
+	UpstreamProxy string
+	// Resolve overrides the addresses of hosts, and DNSServer resolves the
+	// others, see ValidateDNSServer. Neither applies through UpstreamProxy.
+	Resolve   []HostOverride
+	DNSServer string
+
+	Transport   TransportOptions   // Connections to the upstream
+	TLS         TLSOptions         // TLS connections to the upstream
+	Retry       RetryOptions       // Retries of failed idempotent requests
+	Cache       CacheOptions       // Cache of the responses
+	Compression CompressionOptions // Compression negotiated with the local clients
+	Server      ServerOptions      // Timeouts of the local listener
+
+	balancer *balancer
+	probes   http.Handler // Probes served on the listener, if enabled
+
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+}
+
+// Returns the address to listen on for the given port.
+func (c CFAccessProxyConfig) listenAddress(port int) string {
+	return net.JoinHostPort(c.BindAddress, strconv.Itoa(port))
+}
+
+// Returns the URL the proxy can be reached at, for logs.
+func (c CFAccessProxyConfig) localURL() string {
+	host := c.BindAddress
+	if host == "" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(int(c.LocalPort)))
 }
 
-func StartMultipleProxies(ctx context.Context, configs []CFAccessProxyConfig) error {
+// proxyServer is a proxy built from its config, ready to be started.
+type proxyServer struct {
+	config  CFAccessProxyConfig
+	state   *proxyState
+	server  Server
+	checker *healthChecker // Nil unless health checks are enabled
+}
+
+// Validates config and builds its proxy, registered in registry, without
+// starting anything.
+func newProxyServer(config CFAccessProxyConfig, registry *registry, probes ProbeOptions) (*proxyServer, error) {
+	if err := validateUpstreams(config.Upstreams); err != nil {
+		return nil, fmt.Errorf("invalid upstreams of proxy %s, %v", config.Name, err)
+	}
+	if err := config.LoadBalancing.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid load balancing of proxy %s, %v", config.Name, err)
+	}
+	if err := config.HealthCheck.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid health check of proxy %s, %v", config.Name, err)
+	}
+	if err := options.ValidateTokenTransport(config.TokenTransport, config.TokenHeader); err != nil {
+		return nil, fmt.Errorf("invalid token transport of proxy %s, %v", config.Name, err)
+	}
+	requestHeaders, err := compileHeaderRules(config.RequestHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request headers of proxy %s, %v", config.Name, err)
+	}
+	responseHeaders, err := compileHeaderRules(config.ResponseHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response headers of proxy %s, %v", config.Name, err)
+	}
+	forwarding, err := newForwarding(config.ForwardedHeaders, config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarded headers of proxy %s, %v", config.Name, err)
+	}
+
+	if err := config.Transport.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid transport of proxy %s, %v", config.Name, err)
+	}
+	if err := config.Server.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid server of proxy %s, %v", config.Name, err)
+	}
+	if err := config.Retry.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry of proxy %s, %v", config.Name, err)
+	}
+	if err := config.Cache.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cache of proxy %s, %v", config.Name, err)
+	}
+	if err := config.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression of proxy %s, %v", config.Name, err)
+	}
+
+	config.balancer = newBalancer(config)
+	if probes.OnListeners {
+		config.probes = registry.handler(listenerHealthzPath, listenerReadyzPath)
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport of proxy %s, %v", config.Name, err)
+	}
+
+	cache, err := newCacheTransport(config, newRetryTransport(config, newBalancerTransport(config.balancer, newTracingTransport(config, transport))))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache of proxy %s, %v", config.Name, err)
+	}
+
+	proxy := &httputil.ReverseProxy{}
+	proxy.Transport = newDecodingTransport(config, cache)
+	proxy.Director = newDirector(config, requestHeaders)
+	proxy.ModifyResponse = newResponseRewriter(config, responseHeaders)
+	proxy.ErrorHandler = newErrorHandler(config)
+
+	handler := withLocalHost(withForwarding(forwarding, withReauth(config, withCompression(config, proxy))))
+	httpServer := newHTTPServer(config, config.listenAddress(int(config.LocalPort)), handler)
+	state := registry.add(config)
+	state.track(httpServer)
+
+	return &proxyServer{
+		config:  config,
+		state:   state,
+		server:  newServer(httpServer),
+		checker: newHealthChecker(config, transport),
+	}, nil
+}
+
+// Serves the proxy until its server is shut down, on a random port if its
+// own is in use.
+func (p *proxyServer) serve() {
+	logger.Info("proxy.Proxy", "Starting proxy %s on %s, forwarding to %s", p.config.Name, p.config.localURL(), p.config.upstreamURLs())
+
+	err := p.server.ListenAndServe()
+
+	// If the error is that the port is in use, try again with a random port.
+	if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+		randomPort := getRandomPort()
+		logger.Warn("proxy.Proxy", "Port %d for proxy %s (%s) is in use. Retrying on port %d", p.config.LocalPort, p.config.Name, p.config.upstreamURLs(), randomPort)
+		p.server.HTTPServer().Addr = p.config.listenAddress(randomPort)
+		err = p.server.ListenAndServe() // Retry
+	}
+	p.state.unbound()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("proxy.Proxy", err, "Proxy %s for %s failed to start", p.config.Name, p.config.upstreamURLs())
+	}
+}
+
+// StartMultipleProxies starts a proxy for each config, along with the probes
+// if enabled, and serves them until ctx is done. Every config is validated
+// before any proxy starts, so that an invalid one leaves nothing running.
+func StartMultipleProxies(ctx context.Context, configs []CFAccessProxyConfig, probes ProbeOptions) error {
 	if len(configs) == 0 {
 		return errors.New("no proxy configurations provided")
 	}
 
+	registry := newRegistry()
+	proxies := make([]*proxyServer, 0, len(configs))
+	for _, config := range configs {
+		p, err := newProxyServer(config, registry, probes)
+		if err != nil {
+			return err
+		}
+		proxies = append(proxies, p)
+	}
+
 	var servers []Server
 	var wg sync.WaitGroup
 
-	for _, proxyConfig := range configs {
-
-		transport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: proxyConfig.SkipTLS, MinVersion: tls.VersionTLS12},
+	for _, p := range proxies {
+		if p.checker != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.checker.run(ctx)
+			}()
 		}
 
-		proxy := httputil.NewSingleHostReverseProxy(proxyConfig.Url)
-		proxy.Transport = transport
-		proxy.Director = newDirector(proxyConfig)
+		servers = append(servers, p.server)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.serve()
+		}()
+	}
 
-		server := newServer(fmt.Sprintf(":%d", proxyConfig.LocalPort), proxy)
+	if probes.Port != 0 {
+		server := newServer(newProbeServer(probes, registry))
 		servers = append(servers, server)
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			logger.Info("proxy.Proxy", "Starting proxy server on http://localhost:%d, forwarding to %s", proxyConfig.LocalPort, proxyConfig.Url.String())
-
-			err := server.ListenAndServe()
-
-			// If the error is that the port is in use, try again with a random port.
-			if err != nil && errors.Is(err, syscall.EADDRINUSE) {
-				randomPort := getRandomPort()
-				logger.Warn("proxy.Proxy", "Port %d for target %s is in use. Retrying on port %d", proxyConfig.LocalPort, proxyConfig.Url.String(), randomPort)
-				server.HTTPServer().Addr = fmt.Sprintf(":%d", randomPort)
-				err = server.ListenAndServe() // Retry
-			}
-
-			if err != nil && !errors.Is(err, http.ErrServerClosed) {
-				logger.Error("proxy.Proxy", err, "Proxy for %s failed to start", proxyConfig.Url.String())
+			logger.Info("proxy.Proxy", "Serving probes on http://%s%s and %s", probes.address(), healthzPath, readyzPath)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("proxy.Proxy", err, "Probes failed to start on %s", probes.address())
 			}
 		}()
 	}
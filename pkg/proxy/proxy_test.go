@@ -42,11 +42,10 @@ func (m *MockServer) HTTPServer() *http.Server {
 func TestNewDirector(t *testing.T) {
 	targetURL, _ := url.Parse("https://app.example.com")
 	config := CFAccessProxyConfig{
-		Url:   targetURL,
-		Token: "test-token",
+		Upstreams: []Upstream{{Url: targetURL, Token: "test-token"}},
 	}
 
-	director := newDirector(config)
+	director := newDirector(config, nil)
 
 	// Create a sample request to test the director
 	req := httptest.NewRequest("GET", "http://localhost:8080/", nil)
@@ -58,6 +57,32 @@ func TestNewDirector(t *testing.T) {
 	assert.Equal(t, "test-token", req.Header.Get("cf-access-token"))
 }
 
+func TestNewDirectorBasePath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		target   string
+		request  string
+		expected string
+	}{
+		{name: "no base path", target: "https://app.example.com", request: "/api/users", expected: "https://app.example.com/api/users"},
+		{name: "base path", target: "https://app.example.com/base", request: "/api/users?page=2", expected: "https://app.example.com/base/api/users?page=2"},
+		{name: "base path with trailing slash", target: "https://app.example.com/base/", request: "/", expected: "https://app.example.com/base/"},
+		{name: "escaped path", target: "https://app.example.com/my%2Fbase", request: "/a%2Fb", expected: "https://app.example.com/my%2Fbase/a%2Fb"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetURL, err := url.Parse(tc.target)
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest("GET", "http://localhost:8080"+tc.request, nil)
+			newDirector(CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}}, nil)(req)
+
+			assert.Equal(t, tc.expected, req.URL.String())
+		})
+	}
+}
+
 func TestStartMultipleProxies(t *testing.T) {
 	// Backup and restore original functions
 	originalNewServer := newServer
@@ -68,18 +93,18 @@ func TestStartMultipleProxies(t *testing.T) {
 	})
 
 	t.Run("no proxy configs", func(t *testing.T) {
-		err := StartMultipleProxies(context.Background(), []CFAccessProxyConfig{})
+		err := StartMultipleProxies(context.Background(), []CFAccessProxyConfig{}, ProbeOptions{})
 		assert.EqualError(t, err, "no proxy configurations provided")
 	})
 
 	t.Run("invalid hostname with other valid hostnames", func(t *testing.T) {
 		var serverCreationCount int
-		newServer = func(addr string, handler http.Handler) Server {
+		newServer = func(server *http.Server) Server {
 			serverCreationCount++
 			mockSrvr := new(MockServer)
 			mockSrvr.On("ListenAndServe").Return(http.ErrServerClosed)
 			mockSrvr.On("Shutdown", mock.Anything).Return(nil)
-			mockSrvr.On("HTTPServer").Return(&http.Server{Addr: addr})
+			mockSrvr.On("HTTPServer").Return(server)
 			return mockSrvr
 		}
 
@@ -87,15 +112,15 @@ func TestStartMultipleProxies(t *testing.T) {
 		u1, _ := url.Parse("https://app.example.com")
 		u2, _ := url.Parse("https://app2.example.com")
 		configs := []CFAccessProxyConfig{
-			{Url: u1, LocalPort: 8080},
-			{Url: u2, LocalPort: 8082},
+			{Upstreams: []Upstream{{Url: u1}}, LocalPort: 8080},
+			{Upstreams: []Upstream{{Url: u2}}, LocalPort: 8082},
 		}
 
 		var wg sync.WaitGroup
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			StartMultipleProxies(ctx, configs)
+			StartMultipleProxies(ctx, configs, ProbeOptions{})
 		}()
 
 		time.Sleep(100 * time.Millisecond)
@@ -105,16 +130,106 @@ func TestStartMultipleProxies(t *testing.T) {
 		assert.Equal(t, 2, serverCreationCount, "should create two servers for the valid hostnames")
 	})
 
+	t.Run("invalid config starts nothing", func(t *testing.T) {
+		mockSrvr := new(MockServer)
+		newServer = func(server *http.Server) Server {
+			return mockSrvr
+		}
+
+		u, _ := url.Parse("https://app.example.com")
+		configs := []CFAccessProxyConfig{
+			{Name: "app", Upstreams: []Upstream{{Url: u}}, LocalPort: 8080, HealthCheck: HealthCheckOptions{Path: "/"}},
+			{Name: "broken", Upstreams: []Upstream{{Url: u}}, LocalPort: 8081, Retry: RetryOptions{MaxRetries: -1}},
+		}
+
+		err := StartMultipleProxies(context.Background(), configs, ProbeOptions{})
+		assert.ErrorContains(t, err, "invalid retry of proxy broken")
+
+		// Goroutines started before the error would call the server late.
+		time.Sleep(50 * time.Millisecond)
+		mockSrvr.AssertNotCalled(t, "ListenAndServe")
+	})
+
+	t.Run("probes on the listeners report every proxy", func(t *testing.T) {
+		reports := make(chan string, 2)
+		newServer = func(server *http.Server) Server {
+			mockSrvr := new(MockServer)
+			mockSrvr.On("ListenAndServe").Return(http.ErrServerClosed).Run(func(mock.Arguments) {
+				rec := httptest.NewRecorder()
+				server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, listenerReadyzPath, nil))
+				reports <- rec.Body.String()
+			})
+			mockSrvr.On("Shutdown", mock.Anything).Return(nil)
+			return mockSrvr
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		u, _ := url.Parse("https://app.example.com")
+		configs := []CFAccessProxyConfig{
+			{Name: "first", Upstreams: []Upstream{{Url: u}}, LocalPort: 8080},
+			{Name: "second", Upstreams: []Upstream{{Url: u}}, LocalPort: 8081},
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, StartMultipleProxies(ctx, configs, ProbeOptions{OnListeners: true}))
+		}()
+
+		for range configs {
+			report := <-reports
+			assert.Contains(t, report, `"name":"first"`)
+			assert.Contains(t, report, `"name":"second"`, "registered before the first listener serves")
+		}
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("probes on a dedicated port", func(t *testing.T) {
+		var mu sync.Mutex
+		var addresses []string
+		newServer = func(server *http.Server) Server {
+			mu.Lock()
+			addresses = append(addresses, server.Addr)
+			mu.Unlock()
+			mockSrvr := new(MockServer)
+			mockSrvr.On("ListenAndServe").Return(http.ErrServerClosed)
+			mockSrvr.On("Shutdown", mock.Anything).Return(nil)
+			return mockSrvr
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		u, _ := url.Parse("https://app.example.com")
+		configs := []CFAccessProxyConfig{
+			{Upstreams: []Upstream{{Url: u}}, LocalPort: 8080},
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := StartMultipleProxies(ctx, configs, ProbeOptions{Port: 9000, BindAddress: "127.0.0.1"})
+			assert.NoError(t, err)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		wg.Wait()
+
+		assert.Equal(t, []string{":8080", "127.0.0.1:9000"}, addresses)
+	})
+
 	t.Run("successful startup and shutdown", func(t *testing.T) {
 		mockSrvr := new(MockServer)
-		newServer = func(addr string, handler http.Handler) Server {
+		newServer = func(server *http.Server) Server {
 			return mockSrvr
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		u, _ := url.Parse("https://app.example.com")
 		configs := []CFAccessProxyConfig{
-			{Url: u, LocalPort: 8080},
+			{Upstreams: []Upstream{{Url: u}}, LocalPort: 8080},
 		}
 
 		mockSrvr.On("ListenAndServe").Return(http.ErrServerClosed).Once()
@@ -125,7 +240,7 @@ func TestStartMultipleProxies(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := StartMultipleProxies(ctx, configs)
+			err := StartMultipleProxies(ctx, configs, ProbeOptions{})
 			assert.NoError(t, err)
 		}()
 
@@ -138,7 +253,7 @@ func TestStartMultipleProxies(t *testing.T) {
 
 	t.Run("port in use with successful retry", func(t *testing.T) {
 		mockSrvr := new(MockServer)
-		newServer = func(addr string, handler http.Handler) Server {
+		newServer = func(server *http.Server) Server {
 			return mockSrvr
 		}
 		getRandomPort = func() int { return 9090 }
@@ -146,7 +261,7 @@ func TestStartMultipleProxies(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		u, _ := url.Parse("https://app.example.com")
 		configs := []CFAccessProxyConfig{
-			{Url: u, LocalPort: 8080},
+			{Upstreams: []Upstream{{Url: u}}, LocalPort: 8080},
 		}
 
 		mockSrvr.On("ListenAndServe").Return(syscall.EADDRINUSE).Once()
@@ -158,7 +273,7 @@ func TestStartMultipleProxies(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := StartMultipleProxies(ctx, configs)
+			err := StartMultipleProxies(ctx, configs, ProbeOptions{})
 			assert.NoError(t, err)
 		}()
 
@@ -171,14 +286,14 @@ func TestStartMultipleProxies(t *testing.T) {
 
 	t.Run("listen and serve fails with generic error", func(t *testing.T) {
 		mockSrvr := new(MockServer)
-		newServer = func(addr string, handler http.Handler) Server {
+		newServer = func(server *http.Server) Server {
 			return mockSrvr
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		u, _ := url.Parse("https://app.example.com")
 		configs := []CFAccessProxyConfig{
-			{Url: u, LocalPort: 8080},
+			{Upstreams: []Upstream{{Url: u}}, LocalPort: 8080},
 		}
 
 		genericError := errors.New("a generic error")
@@ -189,7 +304,7 @@ func TestStartMultipleProxies(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := StartMultipleProxies(ctx, configs)
+			err := StartMultipleProxies(ctx, configs, ProbeOptions{})
 			assert.NoError(t, err)
 		}()
 
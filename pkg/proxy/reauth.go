@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+)
+
+// reservedPrefix is the path prefix of the pages served by the proxy itself,
+// which are never forwarded.
+const reservedPrefix = "/__cloudflared-proxy/"
+
+// reauthPath triggers a fresh login on a POST from a page of the proxy, then
+// redirects to the path in its next parameter.
+const reauthPath = reservedPrefix + "reauth"
+
+// tokenStore holds the token of an upstream, replaced on re-authentication.
+type tokenStore struct {
+	mu    sync.Mutex // Serializes re-authentications
+	token atomic.Pointer[string]
+}
+
+func newTokenStore(token string) *tokenStore {
+	s := &tokenStore{}
+	s.token.Store(&token)
+	return s
+}
+
+// Logs in again to u with its Reauthenticate function and stores the new
+// token.
+func (c CFAccessProxyConfig) reauthenticate(u *upstream) error {
+	if u.Reauthenticate == nil {
+		return errors.New("re-authentication is not available for this upstream")
+	}
+	u.tokens.mu.Lock()
+	defer u.tokens.mu.Unlock()
+
+	token, err := u.Reauthenticate()
+	if err != nil {
+		return err
+	}
+	u.tokens.token.Store(&token)
+	u.health.tokenRenewed(time.Now())
+	logger.Info("proxy.Proxy", "Re-authenticated upstream %s of proxy %s", u, c.Name)
+	return nil
+}
+
+// Returns the upstreams to re-authenticate: the one whose host is given, or
+// all of them.
+func (c CFAccessProxyConfig) reauthUpstreams(host string) []*upstream {
+	all := []*upstream{c.upstreamOf(nil)}
+	if c.balancer != nil {
+		all = c.balancer.upstreams
+	}
+	if host == "" {
+		return all
+	}
+	for _, u := range all {
+		if u.Url != nil && strings.EqualFold(u.Url.Host, host) {
+			return []*upstream{u}
+		}
+	}
+	return nil
+}
+
+// withReauth serves the pages under reservedPrefix and forwards the other
+// requests to next.
+func withReauth(config CFAccessProxyConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, reservedPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if config.probes != nil && (r.URL.Path == listenerHealthzPath || r.URL.Path == listenerReadyzPath) {
+			config.probes.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == statusPath {
+			writeStatus(w, config)
+			return
+		}
+		upstreams := config.reauthUpstreams(r.URL.Query().Get("upstream"))
+		if r.URL.Path != reauthPath || len(upstreams) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		// A login runs cloudflared on this machine, so neither a link nor
+		// another site may trigger it.
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Re-authentication requires a POST from a page of the proxy", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			logger.Warn("proxy.Proxy", "Refused cross-site re-authentication of proxy %s from %s", config.Name, r.RemoteAddr)
+			http.Error(w, "Cross-site re-authentication refused", http.StatusForbidden)
+			return
+		}
+
+		for _, u := range upstreams {
+			if err := config.reauthenticate(u); err != nil {
+				logger.Error("proxy.Proxy", err, "Failed to re-authenticate upstream %s of proxy %s", u, config.Name)
+				writeErrorPage(w, r, errorPage{
+					Proxy:    config.Name,
+					Upstream: u.String(),
+					Status:   http.StatusBadGateway,
+					Class:    "reauthentication_failed",
+					Title:    "Re-authentication failed",
+					Message:  "A new Cloudflare Access token could not be obtained. Check the output of cloudflared-proxy.",
+					Detail:   err.Error(),
+				})
+				return
+			}
+		}
+		http.Redirect(w, r, localRedirect(r.URL.Query().Get("next")), http.StatusSeeOther)
+	})
+}
+
+// Reports whether r was sent by a page of the proxy itself. Browsers send
+// Sec-Fetch-Site, or at least Origin, with every POST; a request with
+// neither cannot be told apart from a cross-site one and is refused.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	return strings.EqualFold(origin.Host, r.Host)
+}
+
+// Returns target if it is a path of the proxy, or the root path otherwise,
+// so that the redirect cannot lead to another site.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") || strings.HasPrefix(target, reservedPrefix) {
+		return "/"
+	}
+	return target
+}
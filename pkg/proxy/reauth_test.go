@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithReauth(t *testing.T) {
+	targetURL, _ := url.Parse("https://app.example.com")
+	forwarded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	testCases := []struct {
+		name             string
+		method           string
+		path             string
+		header           http.Header
+		reauthenticate   func() (string, error)
+		expectedStatus   int
+		expectedLocation string
+		expectedToken    string
+	}{
+		{
+			name:           "other paths are forwarded",
+			path:           "/page",
+			expectedStatus: http.StatusTeapot,
+			expectedToken:  "old",
+		},
+		{
+			name:           "unknown reserved path",
+			path:           "/__cloudflared-proxy/unknown",
+			expectedStatus: http.StatusNotFound,
+			expectedToken:  "old",
+		},
+		{
+			name:             "reauthenticate",
+			path:             "/__cloudflared-proxy/reauth?next=%2Fpage%3Fq%3D1",
+			reauthenticate:   func() (string, error) { return "new", nil },
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/page?q=1",
+			expectedToken:    "new",
+		},
+		{
+			name:             "redirect to another site",
+			path:             "/__cloudflared-proxy/reauth?next=%2F%2Fevil.example.com",
+			reauthenticate:   func() (string, error) { return "new", nil },
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/",
+			expectedToken:    "new",
+		},
+		{
+			name:             "reauthenticate an upstream",
+			path:             "/__cloudflared-proxy/reauth?upstream=app.example.com",
+			reauthenticate:   func() (string, error) { return "new", nil },
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/",
+			expectedToken:    "new",
+		},
+		{
+			name:           "unknown upstream",
+			path:           "/__cloudflared-proxy/reauth?upstream=other.example.com",
+			reauthenticate: func() (string, error) { return "new", nil },
+			expectedStatus: http.StatusNotFound,
+			expectedToken:  "old",
+		},
+		{
+			name:           "failure",
+			path:           "/__cloudflared-proxy/reauth",
+			reauthenticate: func() (string, error) { return "", errors.New("cloudflared login failed") },
+			expectedStatus: http.StatusBadGateway,
+			expectedToken:  "old",
+		},
+		{
+			name:           "get",
+			method:         http.MethodGet,
+			path:           "/__cloudflared-proxy/reauth",
+			reauthenticate: func() (string, error) { return "new", nil },
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedToken:  "old",
+		},
+		{
+			name:           "cross-site",
+			path:           "/__cloudflared-proxy/reauth",
+			header:         http.Header{"Sec-Fetch-Site": {"cross-site"}, "Origin": {"http://localhost:8888"}},
+			reauthenticate: func() (string, error) { return "new", nil },
+			expectedStatus: http.StatusForbidden,
+			expectedToken:  "old",
+		},
+		{
+			name:           "other origin",
+			path:           "/__cloudflared-proxy/reauth",
+			header:         http.Header{"Origin": {"https://evil.example.com"}},
+			reauthenticate: func() (string, error) { return "new", nil },
+			expectedStatus: http.StatusForbidden,
+			expectedToken:  "old",
+		},
+		{
+			name:           "no origin",
+			path:           "/__cloudflared-proxy/reauth",
+			header:         http.Header{},
+			reauthenticate: func() (string, error) { return "new", nil },
+			expectedStatus: http.StatusForbidden,
+			expectedToken:  "old",
+		},
+		{
+			name:             "same origin without fetch metadata",
+			path:             "/__cloudflared-proxy/reauth",
+			header:           http.Header{"Origin": {"http://localhost:8888"}},
+			reauthenticate:   func() (string, error) { return "new", nil },
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/",
+			expectedToken:    "new",
+		},
+		{
+			name:           "not available",
+			path:           "/__cloudflared-proxy/reauth",
+			expectedStatus: http.StatusBadGateway,
+			expectedToken:  "old",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := CFAccessProxyConfig{Name: "app", Upstreams: []Upstream{{Url: targetURL, Token: "old", Reauthenticate: tc.reauthenticate}}}
+			config.balancer = newBalancer(config)
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "http://localhost:8888"+tc.path, nil)
+			req.Header = tc.header
+			if req.Header == nil {
+				// As sent by the form of an error page.
+				req.Header = http.Header{"Sec-Fetch-Site": {"same-origin"}, "Origin": {"http://localhost:8888"}}
+			}
+
+			rec := httptest.NewRecorder()
+			withReauth(config, forwarded).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatus, rec.Code)
+			assert.Equal(t, tc.expectedLocation, rec.Header().Get("Location"))
+			assert.Equal(t, tc.expectedToken, config.upstreamOf(nil).currentToken())
+		})
+	}
+}
+
+func TestReauthenticatedTokenIsSent(t *testing.T) {
+	targetURL, _ := url.Parse("https://app.example.com")
+	config := CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL, Token: "old", Reauthenticate: func() (string, error) { return "new", nil }}}}
+	config.balancer = newBalancer(config)
+	director := newDirector(config, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8888/", nil)
+	director(req)
+	assert.Equal(t, "old", req.Header.Get(options.DefaultTokenHeader))
+
+	assert.NoError(t, config.reauthenticate(config.upstreamOf(nil)))
+	req = httptest.NewRequest(http.MethodGet, "http://localhost:8888/", nil)
+	director(req)
+	assert.Equal(t, "new", req.Header.Get(options.DefaultTokenHeader))
+}
+
+func TestLocalRedirect(t *testing.T) {
+	for target, expected := range map[string]string{
+		"":                            "/",
+		"/page?q=1":                   "/page?q=1",
+		"https://evil.example.com":    "/",
+		"//evil.example.com":          "/",
+		`/\evil.example.com`:          "/",
+		"/__cloudflared-proxy/reauth": "/",
+		"page":                        "/",
+	} {
+		assert.Equal(t, expected, localRedirect(target), target)
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// HostOverride dials Addresses instead of resolving Host.
+type HostOverride = options.HostOverride
+
+// Largest DNS over HTTPS response read.
+const dohResponseLimit = 64 << 10
+
+// lookupFunc returns the IP addresses of a host.
+type lookupFunc func(ctx context.Context, host string) ([]netip.Addr, error)
+
+// upstreamDialer dials the upstream, replacing the addresses of overridden
+// hosts and resolving the others with lookup, or the system resolver if nil.
+// The hostname still names the upstream in the SNI and Host header.
+type upstreamDialer struct {
+	net.Dialer
+	overrides map[string][]netip.Addr
+	lookup    lookupFunc
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, ok := d.overrides[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		if _, err := netip.ParseAddr(host); err == nil || d.lookup == nil {
+			return d.Dialer.DialContext(ctx, network, address)
+		}
+		if addrs, err = d.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// Returns the dialer of a proxy. Requests to a DNS over HTTPS server go
+// through the transport options of the proxy, overrides included.
+func newUpstreamDialer(config CFAccessProxyConfig, proxy func(*http.Request) (*url.URL, error)) (*upstreamDialer, error) {
+	overrides, err := options.ParseOverrides(config.Resolve)
+	if err != nil {
+		return nil, err
+	}
+	server, err := options.ParseDNSServer(config.DNSServer)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &upstreamDialer{
+		Dialer: net.Dialer{
+			Timeout:   orDefault(config.Transport.DialTimeout, options.DefaultDialTimeout),
+			KeepAlive: orDefault(config.Transport.KeepAlive, options.DefaultKeepAlive),
+		},
+		overrides: overrides,
+	}
+
+	switch {
+	case server == nil:
+	case server.Scheme == "https":
+		client := &http.Client{
+			Timeout: d.Timeout,
+			Transport: &http.Transport{
+				Proxy:               proxy,
+				DialContext:         (&upstreamDialer{Dialer: d.Dialer, overrides: overrides}).DialContext,
+				TLSHandshakeTimeout: orDefault(config.Transport.TLSHandshakeTimeout, options.DefaultTLSHandshakeTimeout),
+				IdleConnTimeout:     options.DefaultIdleConnTimeout,
+				ForceAttemptHTTP2:   true,
+			},
+		}
+		d.lookup = (&dohResolver{url: server.String(), client: client}).lookup
+	default:
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				if server.Scheme == "tcp" {
+					network = "tcp"
+				}
+				return d.Dialer.DialContext(ctx, network, server.Host)
+			},
+		}
+		d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return resolver.LookupNetIP(ctx, "ip", host)
+		}
+	}
+	return d, nil
+}
+
+// dohResolver resolves hosts with a DNS over HTTPS server, as of RFC 8484.
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// Returns the IPv4 and IPv6 addresses of host, failing with a *net.DNSError.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func() {
+			addrs, err := r.query(ctx, host, qtype)
+			results <- result{addrs, err}
+		}()
+	}
+
+	var addrs []netip.Addr
+	var errs []error
+	for range 2 {
+		res := <-results
+		addrs = append(addrs, res.addrs...)
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+	}
+
+	switch {
+	case len(addrs) > 0:
+		return addrs, nil
+	case len(errs) > 0:
+		return nil, &net.DNSError{Err: errors.Join(errs...).Error(), Name: host, Server: r.url}
+	default:
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+	}
+}
+
+// Returns the addresses of host of type qtype, none if it does not exist.
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostname, %v", err)
+	}
+	// The ID is zero so that responses can be cached, as RFC 8484 advises.
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohResponseLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid DNS response, %v", err)
+	}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("DNS server answered %s", answer.RCode)
+	}
+
+	var addrs []netip.Addr
+	for _, rr := range answer.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolveOverride(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _, _ := ca.issue(t, "app.example.com", x509.ExtKeyUsageServerAuth)
+
+	var host, serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, serverName = r.Host, r.TLS.ServerName
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	upstream, err := url.Parse("https://app.example.com:" + port)
+	require.NoError(t, err)
+	transport, err := newTransport(CFAccessProxyConfig{
+		Upstreams:     []Upstream{{Url: upstream}},
+		UpstreamProxy: options.UpstreamProxyDirect,
+		TLS:           TLSOptions{CAFile: ca.file},
+		Resolve:       []HostOverride{{Host: "APP.example.com", Addresses: []string{"127.0.0.1"}}},
+	})
+	require.NoError(t, err)
+
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, upstream.String(), nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "app.example.com:"+port, host)
+	assert.Equal(t, "app.example.com", serverName)
+}
+
+// Returns the answer to a packed DNS query with addrs for every name, or
+// NXDOMAIN if there is none.
+func dnsAnswer(t *testing.T, packedQuery []byte, addrs ...netip.Addr) []byte {
+	var query dnsmessage.Message
+	require.NoError(t, query.Unpack(packedQuery))
+
+	q := query.Questions[0]
+	answer := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true, RCode: dnsmessage.RCodeSuccess},
+		Questions: query.Questions,
+	}
+	if len(addrs) == 0 {
+		answer.RCode = dnsmessage.RCodeNameError
+	}
+	for _, addr := range addrs {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	packed, err := answer.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+// Returns a DNS over HTTPS handler answering with addrs.
+func dohHandler(t *testing.T, addrs ...netip.Addr) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsAnswer(t, body, addrs...))
+	})
+}
+
+func TestDoHResolver(t *testing.T) {
+	t.Run("addresses", func(t *testing.T) {
+		server := httptest.NewTLSServer(dohHandler(t, netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")))
+		defer server.Close()
+
+		r := &dohResolver{url: server.URL + "/dns-query", client: server.Client()}
+		addrs, err := r.lookup(context.Background(), "app.example.com")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")}, addrs)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		server := httptest.NewTLSServer(dohHandler(t))
+		defer server.Close()
+
+		r := &dohResolver{url: server.URL, client: server.Client()}
+		_, err := r.lookup(context.Background(), "missing.example.com")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		assert.True(t, dnsErr.IsNotFound)
+		assert.Equal(t, "dns", classifyError(err).Class)
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		r := &dohResolver{url: server.URL, client: server.Client()}
+		_, err := r.lookup(context.Background(), "app.example.com")
+		assert.ErrorContains(t, err, "DNS server answered 503 Service Unavailable")
+	})
+}
+
+func TestUpstreamDialerLookup(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	var looked []string
+	d := &upstreamDialer{lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+		looked = append(looked, host)
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}}
+
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("app.example.com", port))
+	require.NoError(t, err)
+	conn.Close()
+	conn, err = d.DialContext(context.Background(), "tcp", listener.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	// IP addresses are dialed without a lookup.
+	assert.Equal(t, []string{"app.example.com"}, looked)
+}
+
+func TestUpstreamDialerDNSServer(t *testing.T) {
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = dns.WriteTo(dnsAnswer(t, buf[:n], netip.MustParseAddr("192.0.2.10")), addr)
+		}
+	}()
+
+	d, err := newUpstreamDialer(CFAccessProxyConfig{DNSServer: dns.LocalAddr().String()}, nil)
+	require.NoError(t, err)
+	addrs, err := d.lookup(context.Background(), "app.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.10")}, addrs)
+}
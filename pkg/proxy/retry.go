@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// retryBudgetWindow is the period over which the retry budget is counted.
+const retryBudgetWindow = 10 * time.Second
+
+// RetryOptions configure the retries of idempotent requests.
+type RetryOptions = options.Retry
+
+// retryTransport retries idempotent requests that failed, within a budget
+// shared by all requests of a proxy.
+type retryTransport struct {
+	name    string
+	options RetryOptions
+	budget  *retryBudget
+	reroute func(*http.Request) *http.Request // Moves a retry to another upstream
+	next    http.RoundTripper
+}
+
+// Returns next wrapped in a retryTransport, or next if retries are disabled.
+func newRetryTransport(config CFAccessProxyConfig, next http.RoundTripper) http.RoundTripper {
+	o := config.Retry
+	if o.MaxRetries == 0 {
+		return next
+	}
+	o.InitialBackoff = orDefault(o.InitialBackoff, options.DefaultRetryInitialBackoff)
+	o.MaxBackoff = max(orDefault(o.MaxBackoff, options.DefaultRetryMaxBackoff), o.InitialBackoff)
+	o.MaxBodySize = orDefault(o.MaxBodySize, options.DefaultRetryMaxBodySize)
+	o.BudgetRatio = orDefault(o.BudgetRatio, options.DefaultRetryBudgetRatio)
+	o.BudgetMinRetries = orDefault(o.BudgetMinRetries, options.DefaultRetryBudgetMinRetries)
+
+	return &retryTransport{
+		name:    config.Name,
+		options: o,
+		budget:  &retryBudget{ratio: o.BudgetRatio, minRetries: o.BudgetMinRetries},
+		reroute: config.reroute,
+		next:    next,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.request()
+	if !isRetryable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	body, replayable, err := bufferBody(req, t.options.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := withBody(req, body)
+		if attempt > 0 {
+			// The balancer has heard of the failure and may pick another upstream.
+			attemptReq = t.reroute(attemptReq)
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if !shouldRetry(req.Context(), resp, err) || attempt == t.options.MaxRetries {
+			return resp, err
+		}
+		if !t.budget.retry() {
+			logger.Debug("proxy.Proxy", "Not retrying %s %s of proxy %s, retry budget exhausted", req.Method, req.URL.Path, t.name)
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+			// Drain the body so that the connection can be reused.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		delay := t.backoff(attempt)
+		logger.Debug("proxy.Proxy", "Retrying %s %s of proxy %s in %v (retry %d of %d): %s", req.Method, req.URL.Path, t.name, delay, attempt+1, t.options.MaxRetries, reason)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Returns the delay before a retry, growing exponentially from the initial
+// backoff up to the max backoff, with half of it randomized.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.options.MaxBackoff
+	if attempt < 30 {
+		d = min(t.options.InitialBackoff<<attempt, t.options.MaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Reports whether req may be sent more than once: GET, HEAD and OPTIONS
+// requests, and those marked with an Idempotency-Key header.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// Reports whether a failed attempt should be retried: on errors other than
+// the cancellation of the request, and on 502, 503 and 504 responses.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Reads the body of req so that it can be resent, if it is at most maxSize
+// bytes. Larger bodies are left to be streamed once, req.Body being replaced
+// so that the bytes already read are not lost.
+func bufferBody(req *http.Request, maxSize int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > maxSize {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, fmt.Errorf("unable to read request body, %v", err)
+	}
+	if int64(len(body)) > maxSize {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+// Returns a copy of req with a fresh reader of body, as the request of an
+// attempt. Requests without a body are returned as they are.
+func withBody(req *http.Request, body []byte) *http.Request {
+	if body == nil {
+		return req
+	}
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	r.ContentLength = int64(len(body))
+	return r
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// retryBudget limits the retries to a ratio of the requests of the current
+// window, while always allowing a minimum number of them.
+type retryBudget struct {
+	ratio      float64
+	minRetries int
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// Counts a request.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	b.requests++
+}
+
+// Reports whether a retry is within the budget, counting it if so.
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	if b.retries >= max(b.minRetries, int(b.ratio*float64(b.requests))) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// Starts a new window once the current one is over.
+func (b *retryBudget) advance() {
+	if now := time.Now(); now.Sub(b.start) >= retryBudgetWindow {
+		b.start, b.requests, b.retries = now, 0, 0
+	}
+}
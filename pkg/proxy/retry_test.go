@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryTransport(t *testing.T) {
+	errConnection := errors.New("connection refused")
+
+	testCases := []struct {
+		name             string
+		method           string
+		header           http.Header
+		body             string
+		options          RetryOptions
+		results          []int // Status codes, 0 for a connection error
+		expectedAttempts int
+		expectedStatus   int
+	}{
+		{
+			name:             "get retried on connection errors",
+			method:           http.MethodGet,
+			options:          RetryOptions{MaxRetries: 2},
+			results:          []int{0, 0, http.StatusOK},
+			expectedAttempts: 3,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "retried on gateway statuses",
+			method:           http.MethodHead,
+			options:          RetryOptions{MaxRetries: 3},
+			results:          []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusOK},
+			expectedAttempts: 4,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "last failure returned",
+			method:           http.MethodGet,
+			options:          RetryOptions{MaxRetries: 1},
+			results:          []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			expectedAttempts: 2,
+			expectedStatus:   http.StatusServiceUnavailable,
+		},
+		{
+			name:             "other statuses not retried",
+			method:           http.MethodGet,
+			options:          RetryOptions{MaxRetries: 2},
+			results:          []int{http.StatusInternalServerError},
+			expectedAttempts: 1,
+			expectedStatus:   http.StatusInternalServerError,
+		},
+		{
+			name:             "post not retried",
+			method:           http.MethodPost,
+			body:             "payload",
+			options:          RetryOptions{MaxRetries: 2},
+			results:          []int{http.StatusBadGateway},
+			expectedAttempts: 1,
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name:             "post with idempotency key retried with its body",
+			method:           http.MethodPost,
+			header:           http.Header{"Idempotency-Key": {"abc"}},
+			body:             "payload",
+			options:          RetryOptions{MaxRetries: 2},
+			results:          []int{0, http.StatusOK},
+			expectedAttempts: 2,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "body over the limit not retried",
+			method:           http.MethodPut,
+			header:           http.Header{"X-Idempotency-Key": {"abc"}},
+			body:             "payload",
+			options:          RetryOptions{MaxRetries: 2, MaxBodySize: 4},
+			results:          []int{http.StatusBadGateway},
+			expectedAttempts: 1,
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name:             "budget exhausted",
+			method:           http.MethodGet,
+			options:          RetryOptions{MaxRetries: 3, BudgetRatio: 0.1, BudgetMinRetries: 1},
+			results:          []int{0, 0, http.StatusOK},
+			expectedAttempts: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.InitialBackoff = time.Millisecond
+			attempts := 0
+			next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Body != nil {
+					body, err := io.ReadAll(req.Body)
+					require.NoError(t, err)
+					assert.Equal(t, tc.body, string(body))
+				}
+				status := tc.results[attempts]
+				attempts++
+				if status == 0 {
+					return nil, errConnection
+				}
+				return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+			})
+
+			req := httptest.NewRequest(tc.method, "http://app.example.com/", strings.NewReader(tc.body))
+			if tc.body == "" {
+				req.Body = http.NoBody
+			}
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+
+			transport := newRetryTransport(CFAccessProxyConfig{Name: "app", Retry: tc.options}, next)
+			resp, err := transport.RoundTrip(req)
+
+			assert.Equal(t, tc.expectedAttempts, attempts)
+			if tc.expectedStatus == 0 {
+				assert.ErrorIs(t, err, errConnection)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestRetryTransportDisabled(t *testing.T) {
+	next := roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, nil })
+	_, ok := newRetryTransport(CFAccessProxyConfig{}, next).(*retryTransport)
+	assert.False(t, ok)
+}
+
+func TestRetryTransportCancelled(t *testing.T) {
+	next := roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, errors.New("connection refused") })
+	transport := newRetryTransport(CFAccessProxyConfig{Retry: RetryOptions{MaxRetries: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}}, next)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := transport.RoundTrip(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	transport := newRetryTransport(CFAccessProxyConfig{Retry: RetryOptions{MaxRetries: 1, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}, nil).(*retryTransport)
+
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		d := transport.backoff(attempt)
+		assert.GreaterOrEqual(t, d, expected/2)
+		assert.LessOrEqual(t, d, expected)
+	}
+	assert.LessOrEqual(t, transport.backoff(100), time.Second)
+}
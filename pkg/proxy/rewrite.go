@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+)
+
+// localHostKey is the context key of the Host the client sent to the proxy.
+type localHostKey struct{}
+
+// withLocalHost records the Host requested by the client, which the director
+// replaces with the upstream one, so that responses can point back at it.
+func withLocalHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localHostKey{}, r.Host)))
+	})
+}
+
+// Returns the host of the proxy as requested by the client, falling back to
+// the listen address.
+func localHost(req *http.Request, config CFAccessProxyConfig) string {
+	if host, ok := req.Context().Value(localHostKey{}).(string); ok && host != "" {
+		return host
+	}
+	return strings.TrimPrefix(config.localURL(), "http://")
+}
+
+// Removes prefix from the path of u if it starts with it as whole segments.
+func stripPrefix(prefix string, u *url.URL) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return
+	}
+	path, ok := cutPathPrefix(u.Path, prefix)
+	if !ok {
+		return
+	}
+	u.Path = path
+	if u.RawPath != "" {
+		// Drop the escaped form if the prefix is encoded differently in it.
+		if rawPath, ok := cutPathPrefix(u.RawPath, prefix); ok {
+			u.RawPath = rawPath
+		} else {
+			u.RawPath = ""
+		}
+	}
+}
+
+// Returns path without prefix, which must match whole segments. The result
+// always starts with a slash.
+func cutPathPrefix(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return path, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// Returns the local path of a path of the upstream target, undoing the
+// mapping of the director. Paths outside of the base path of target cannot
+// be mapped.
+func localPath(config CFAccessProxyConfig, target *url.URL, path string) (string, bool) {
+	if base := strings.TrimSuffix(target.Path, "/"); base != "" {
+		var ok bool
+		if path, ok = cutPathPrefix(path, base); !ok {
+			return path, false
+		}
+	}
+	if prefix := strings.TrimSuffix(config.StripPrefix, "/"); prefix != "" {
+		path = prefix + path
+	}
+	return path, true
+}
+
+// Response headers holding a URL rewritten by newResponseRewriter.
+var urlHeaders = []string{"Location", "Content-Location"}
+
+// newResponseRewriter returns the ModifyResponse function of a proxy.
+// Responses of Cloudflare Access are turned into errors for the
+// ErrorHandler. The Location, Content-Location and Refresh URLs and the
+// Set-Cookie attributes pointing at the upstream are rewritten to the proxy,
+// so that the browser stays on it, then the header rules are applied.
+func newResponseRewriter(config CFAccessProxyConfig, headers *headerRewriter) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if err := checkAccess(config, resp); err != nil {
+			return err
+		}
+
+		local := localHost(resp.Request, config)
+		target := config.upstreamOf(resp.Request).Url
+
+		for _, header := range urlHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				if rewritten := rewriteURL(config, target, value, local); rewritten != value {
+					logger.Debug("proxy.Proxy", "Rewriting %s of %s from %s to %s", header, config.Name, value, rewritten)
+					resp.Header.Set(header, rewritten)
+				}
+			}
+		}
+
+		if refresh := resp.Header.Get("Refresh"); refresh != "" {
+			if rewritten := rewriteRefresh(config, target, refresh, local); rewritten != refresh {
+				logger.Debug("proxy.Proxy", "Rewriting Refresh of %s from %s to %s", config.Name, refresh, rewritten)
+				resp.Header.Set("Refresh", rewritten)
+			}
+		}
+
+		if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+			resp.Header.Del("Set-Cookie")
+			for _, cookie := range cookies {
+				resp.Header.Add("Set-Cookie", rewriteCookie(config, target, cookie))
+			}
+		}
+
+		headers.apply(resp.Header, headerVars(config, resp.Request))
+		return nil
+	}
+}
+
+// Returns ref pointing at the proxy if it points at an upstream, its path
+// mapped from that of target. Relative references are left untouched, as
+// they resolve against the proxy already, and so are the paths outside of
+// the base path of target, which the proxy cannot reach.
+func rewriteURL(config CFAccessProxyConfig, target *url.URL, ref, local string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+
+	switch {
+	case u.Host != "":
+		if !config.isUpstreamURL(u) {
+			return ref
+		}
+	case !strings.HasPrefix(u.Path, "/"):
+		return ref
+	}
+
+	path, ok := localPath(config, target, u.Path)
+	if !ok {
+		return ref
+	}
+	if u.Host != "" {
+		if u.Scheme != "" {
+			u.Scheme = "http"
+		}
+		u.Host = local
+	}
+	u.Path, u.RawPath = path, ""
+	return u.String()
+}
+
+// Returns the Refresh header, "SECONDS; url=URL", with its URL rewritten by
+// rewriteURL.
+func rewriteRefresh(config CFAccessProxyConfig, target *url.URL, refresh, local string) string {
+	delay, value, ok := strings.Cut(refresh, ";")
+	if !ok {
+		delay, value, ok = strings.Cut(refresh, ",")
+	}
+	if !ok {
+		return refresh
+	}
+
+	value = strings.TrimSpace(value)
+	if len(value) < 4 || !strings.EqualFold(value[:4], "url=") {
+		return refresh
+	}
+	ref := strings.TrimSpace(value[4:])
+	quote := ""
+	if len(ref) >= 2 && (ref[0] == '\'' || ref[0] == '"') && ref[len(ref)-1] == ref[0] {
+		quote, ref = ref[:1], ref[1:len(ref)-1]
+	}
+
+	rewritten := rewriteURL(config, target, ref, local)
+	if rewritten == ref {
+		return refresh
+	}
+	return delay + "; " + value[:4] + quote + rewritten + quote
+}
+
+// Returns the Set-Cookie header of an upstream cookie made a cookie of the
+// proxy. Its Domain is removed if it covers an upstream and its Path is
+// mapped to the proxy. As the proxy is served over plain HTTP, the Secure
+// attribute is removed, along with SameSite=None which requires it. Cookies
+// with a __Host- or __Secure- prefix keep it, as browsers reject them without
+// it and treat localhost as a secure context anyway.
+func rewriteCookie(config CFAccessProxyConfig, target *url.URL, raw string) string {
+	cookie, err := http.ParseSetCookie(raw)
+	if err != nil {
+		return raw
+	}
+
+	changed := false
+	if cookie.Domain != "" {
+		if !config.isUpstreamDomain(cookie.Domain) {
+			// Not a cookie of the upstream, the browser ignores it anyway.
+			return raw
+		}
+		cookie.Domain = ""
+		changed = true
+	}
+	if cookie.Secure && !hasSecurePrefix(cookie.Name) {
+		cookie.Secure = false
+		changed = true
+		if cookie.SameSite == http.SameSiteNoneMode {
+			cookie.SameSite = http.SameSiteDefaultMode
+		}
+	}
+	if cookie.Path != "" {
+		if path, ok := localPath(config, target, cookie.Path); ok && path != cookie.Path {
+			cookie.Path = path
+			changed = true
+		}
+	}
+
+	if !changed {
+		return raw
+	}
+	if rewritten := cookie.String(); rewritten != "" {
+		return rewritten
+	}
+	return raw
+}
+
+// Returns whether a cookie name has a prefix which requires the Secure
+// attribute.
+func hasSecurePrefix(name string) bool {
+	return strings.HasPrefix(name, "__Host-") || strings.HasPrefix(name, "__Secure-")
+}
+
+// Returns whether u is on the host and port of one of the upstreams.
+func (c CFAccessProxyConfig) isUpstreamURL(u *url.URL) bool {
+	for _, upstream := range c.Upstreams {
+		if isUpstreamHost(upstream.Url, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a cookie domain covers one of the upstreams.
+func (c CFAccessProxyConfig) isUpstreamDomain(domain string) bool {
+	for _, upstream := range c.Upstreams {
+		if domainMatches(upstream.Url.Hostname(), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether u is on the same host and port as target.
+func isUpstreamHost(target, u *url.URL) bool {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = target.Scheme
+	}
+	return strings.EqualFold(u.Hostname(), target.Hostname()) && urlPort(scheme, u) == urlPort(target.Scheme, target)
+}
+
+// Returns the port of u, or the default port of scheme.
+func urlPort(scheme string, u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+// Returns whether a cookie domain covers host.
+func domainMatches(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripPrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		prefix   string
+		path     string
+		expected string
+	}{
+		{name: "no prefix", prefix: "", path: "/jenkins/job", expected: "/jenkins/job"},
+		{name: "prefix", prefix: "/jenkins", path: "/jenkins/job", expected: "/job"},
+		{name: "prefix with trailing slash", prefix: "/jenkins/", path: "/jenkins/job", expected: "/job"},
+		{name: "whole path", prefix: "/jenkins", path: "/jenkins", expected: "/"},
+		{name: "partial segment", prefix: "/jenkins", path: "/jenkinsfile", expected: "/jenkinsfile"},
+		{name: "other path", prefix: "/jenkins", path: "/grafana/", expected: "/grafana/"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &url.URL{Path: tc.path}
+			stripPrefix(tc.prefix, u)
+			assert.Equal(t, tc.expected, u.Path)
+		})
+	}
+}
+
+func TestNewDirectorStripPrefix(t *testing.T) {
+	targetURL, err := url.Parse("https://tools.example.com/jenkins")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/ci/job/build?x=1", nil)
+	newDirector(CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}, StripPrefix: "/ci"}, nil)(req)
+
+	assert.Equal(t, "https://tools.example.com/jenkins/job/build?x=1", req.URL.String())
+}
+
+func TestRewriteURL(t *testing.T) {
+	targetURL, err := url.Parse("https://tools.example.com:443/jenkins")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}}
+
+	testCases := []struct {
+		name     string
+		config   CFAccessProxyConfig
+		ref      string
+		expected string
+	}{
+		{name: "absolute URL of the upstream", config: config, ref: "https://tools.example.com/jenkins/login?from=%2F", expected: "http://localhost:8080/login?from=%2F"},
+		{name: "explicit default port", config: config, ref: "https://tools.example.com:443/jenkins/", expected: "http://localhost:8080/"},
+		{name: "scheme-relative URL", config: config, ref: "//tools.example.com/jenkins/login", expected: "//localhost:8080/login"},
+		{name: "absolute path", config: config, ref: "/jenkins/login", expected: "/login"},
+		{name: "path outside of the base path", config: config, ref: "https://tools.example.com/grafana/", expected: "https://tools.example.com/grafana/"},
+		{name: "absolute path outside of the base path", config: config, ref: "/grafana/", expected: "/grafana/"},
+		{name: "relative path", config: config, ref: "login", expected: "login"},
+		{name: "other host", config: config, ref: "https://example.cloudflareaccess.com/cdn-cgi/access/login", expected: "https://example.cloudflareaccess.com/cdn-cgi/access/login"},
+		{name: "other port", config: config, ref: "https://tools.example.com:8443/jenkins/", expected: "https://tools.example.com:8443/jenkins/"},
+		{name: "strip prefix", config: CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}, StripPrefix: "/ci"}, ref: "https://tools.example.com/jenkins/login", expected: "http://localhost:8080/ci/login"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rewriteURL(tc.config, tc.config.Upstreams[0].Url, tc.ref, "localhost:8080"))
+		})
+	}
+}
+
+func TestRewriteCookie(t *testing.T) {
+	targetURL, err := url.Parse("https://tools.example.com/jenkins")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}}
+
+	testCases := []struct {
+		name     string
+		cookie   string
+		expected string
+	}{
+		{name: "upstream domain", cookie: "session=abc; Domain=tools.example.com; Path=/jenkins; HttpOnly", expected: "session=abc; Path=/; HttpOnly"},
+		{name: "parent domain", cookie: "session=abc; Domain=.example.com", expected: "session=abc"},
+		{name: "base path", cookie: "session=abc; Path=/jenkins/job", expected: "session=abc; Path=/job"},
+		{name: "root path", cookie: "session=abc; Path=/", expected: "session=abc; Path=/"},
+		{name: "other domain", cookie: "session=abc; Domain=other.com; Secure", expected: "session=abc; Domain=other.com; Secure"},
+		{name: "secure", cookie: "session=abc; Path=/jenkins; Secure; SameSite=Lax", expected: "session=abc; Path=/; SameSite=Lax"},
+		{name: "secure with SameSite=None", cookie: "session=abc; Secure; SameSite=None", expected: "session=abc"},
+		{name: "host prefix", cookie: "__Host-session=abc; Path=/; Secure; SameSite=None", expected: "__Host-session=abc; Path=/; Secure; SameSite=None"},
+		{name: "secure prefix", cookie: "__Secure-session=abc; Domain=tools.example.com; Path=/jenkins; Secure", expected: "__Secure-session=abc; Path=/; Secure"},
+		{name: "invalid cookie", cookie: "invalid", expected: "invalid"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rewriteCookie(config, targetURL, tc.cookie))
+		})
+	}
+}
+
+func TestRewriteRefresh(t *testing.T) {
+	targetURL, err := url.Parse("https://tools.example.com/jenkins")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Upstreams: []Upstream{{Url: targetURL}}}
+
+	testCases := []struct {
+		name     string
+		refresh  string
+		expected string
+	}{
+		{name: "upstream URL", refresh: "5; url=https://tools.example.com/jenkins/login", expected: "5; url=http://localhost:8080/login"},
+		{name: "quoted URL", refresh: "0;URL='https://tools.example.com/jenkins/'", expected: "0; URL='http://localhost:8080/'"},
+		{name: "comma separator", refresh: "0, url=/jenkins/", expected: "0; url=/"},
+		{name: "delay only", refresh: "30", expected: "30"},
+		{name: "other host", refresh: "5; url=https://example.com/", expected: "5; url=https://example.com/"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rewriteRefresh(config, targetURL, tc.refresh, "localhost:8080"))
+		})
+	}
+}
+
+func TestResponseRewriter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://"+r.Host+"/jenkins/login")
+		w.Header().Set("Content-Location", "http://"+r.Host+"/jenkins/index.html")
+		w.Header().Set("Refresh", "1; url=http://"+r.Host+"/jenkins/")
+		w.Header().Add("Set-Cookie", "a=1; Path=/jenkins")
+		w.Header().Add("Set-Cookie", "b=2; Domain=127.0.0.1; Secure")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	targetURL, err := url.Parse(upstream.URL + "/jenkins")
+	require.NoError(t, err)
+	config := CFAccessProxyConfig{Name: "jenkins", Upstreams: []Upstream{{Url: targetURL}}, LocalPort: 8080}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), localHostKey{}, "localhost:8080"))
+	newDirector(config, nil)(req)
+	req.RequestURI = ""
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.NoError(t, newResponseRewriter(config, nil)(resp))
+	assert.Equal(t, "http://localhost:8080/login", resp.Header.Get("Location"))
+	assert.Equal(t, "http://localhost:8080/index.html", resp.Header.Get("Content-Location"))
+	assert.Equal(t, "1; url=http://localhost:8080/", resp.Header.Get("Refresh"))
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, resp.Header.Values("Set-Cookie"))
+}
+
+func TestWithLocalHost(t *testing.T) {
+	var host string
+	handler := withLocalHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = localHost(r, CFAccessProxyConfig{LocalPort: 8888})
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://127.0.0.1:9000/", nil))
+	assert.Equal(t, "127.0.0.1:9000", host)
+
+	assert.Equal(t, "localhost:8888", localHost(httptest.NewRequest("GET", "/", nil).WithContext(context.Background()), CFAccessProxyConfig{LocalPort: 8888}))
+}
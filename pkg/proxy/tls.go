@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// TLSOptions configure the TLS connections of a proxy to its upstream.
+type TLSOptions = options.TLS
+
+// Returns the tls.Config of a proxy. With skipTLS, certificates are not
+// verified, which a CA bundle would contradict, but pins are still checked.
+func newTLSConfig(config CFAccessProxyConfig) (*tls.Config, error) {
+	host := config.TLS.ServerName
+	if host == "" {
+		hosts := make([]string, 0, len(config.Upstreams))
+		for _, u := range config.Upstreams {
+			if u.Url != nil {
+				hosts = append(hosts, u.Url.Hostname())
+			}
+		}
+		host = strings.Join(hosts, ", ")
+	}
+	return tlsConfig(config.TLS, host, config.SkipTLS)
+}
+
+// Returns the tls.Config of the options, host naming the upstream in the
+// errors of pinning if it sends no SNI.
+func tlsConfig(o TLSOptions, host string, skipTLS bool) (*tls.Config, error) {
+	if o.CAFile != "" && skipTLS {
+		return nil, fmt.Errorf("CA file '%s' conflicts with skipTLS", o.CAFile)
+	}
+	cfg, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	cfg.InsecureSkipVerify = skipTLS
+
+	if len(o.Pins) > 0 {
+		pins, err := options.ParsePins(o.Pins)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = verifyPins(host, pins)
+	}
+
+	return cfg, nil
+}
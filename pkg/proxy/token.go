@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+)
+
+// TokenCookie is the cookie Cloudflare Access sets in browsers.
+const TokenCookie = "CF_Authorization"
+
+// Sets token on req as configured, as the cf-access-token header by default,
+// replacing any token sent by the client.
+func setToken(req *http.Request, config CFAccessProxyConfig, token string) {
+	transport := config.TokenTransport
+	if transport == "" {
+		transport = options.TokenTransportHeader
+	}
+
+	if transport == options.TokenTransportHeader || transport == options.TokenTransportBoth {
+		header := config.TokenHeader
+		if header == "" {
+			header = options.DefaultTokenHeader
+		}
+		req.Header.Set(header, token)
+	}
+	if (transport == options.TokenTransportCookie || transport == options.TokenTransportBoth) && token != "" {
+		setTokenCookie(req.Header, token)
+	}
+}
+
+// Sets the CF_Authorization cookie, replacing any sent by the client and
+// keeping the other cookies as they were sent.
+func setTokenCookie(h http.Header, token string) {
+	var cookies []string
+	for _, line := range h.Values("Cookie") {
+		for _, cookie := range strings.Split(line, ";") {
+			cookie = strings.TrimSpace(cookie)
+			name, _, _ := strings.Cut(cookie, "=")
+			if cookie == "" || name == TokenCookie {
+				continue
+			}
+			cookies = append(cookies, cookie)
+		}
+	}
+	cookies = append(cookies, (&http.Cookie{Name: TokenCookie, Value: token}).String())
+	h.Set("Cookie", strings.Join(cookies, "; "))
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetToken(t *testing.T) {
+	testCases := []struct {
+		name           string
+		token          string
+		config         CFAccessProxyConfig
+		header         http.Header // Sent by the client
+		cookies        []string
+		expectedHeader map[string]string
+		expectedCookie string
+	}{
+		{
+			name:           "default header",
+			token:          "token",
+			config:         CFAccessProxyConfig{},
+			cookies:        []string{"session=abc"},
+			expectedHeader: map[string]string{"cf-access-token": "token"},
+			expectedCookie: "session=abc",
+		},
+		{
+			name:           "header replaces the client one",
+			token:          "token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportHeader, TokenHeader: "X-Access-Token"},
+			header:         http.Header{"X-Access-Token": {"forged"}},
+			expectedHeader: map[string]string{"X-Access-Token": "token"},
+		},
+		{
+			name:           "custom header",
+			token:          "token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportHeader, TokenHeader: "X-Access-Token"},
+			expectedHeader: map[string]string{"X-Access-Token": "token", "cf-access-token": ""},
+		},
+		{
+			name:           "cookie",
+			token:          "token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportCookie},
+			cookies:        []string{"session=abc; theme=dark"},
+			expectedHeader: map[string]string{"cf-access-token": ""},
+			expectedCookie: "session=abc; theme=dark; CF_Authorization=token",
+		},
+		{
+			name:           "cookie replaces the client one",
+			token:          "token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportCookie},
+			cookies:        []string{"CF_Authorization=stale; session=abc", "theme=dark"},
+			expectedCookie: "session=abc; theme=dark; CF_Authorization=token",
+		},
+		{
+			name:           "cookie without token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportCookie},
+			cookies:        []string{"session=abc"},
+			expectedCookie: "session=abc",
+		},
+		{
+			name:           "both",
+			token:          "token",
+			config:         CFAccessProxyConfig{TokenTransport: options.TokenTransportBoth, TokenHeader: "X-Access-Token"},
+			expectedHeader: map[string]string{"X-Access-Token": "token"},
+			expectedCookie: "CF_Authorization=token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+			for _, cookie := range tc.cookies {
+				req.Header.Add("Cookie", cookie)
+			}
+
+			setToken(req, tc.config, tc.token)
+
+			for header, value := range tc.expectedHeader {
+				assert.Equal(t, value, req.Header.Get(header), header)
+				assert.LessOrEqual(t, len(req.Header.Values(header)), 1, header)
+			}
+			assert.Equal(t, tc.expectedCookie, req.Header.Get("Cookie"))
+			assert.LessOrEqual(t, len(req.Header.Values("Cookie")), 1)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingTransport records a span for every proxied request and propagates
+// the trace context to the origin.
+type tracingTransport struct {
+	config CFAccessProxyConfig
+	next   http.RoundTripper
+}
+
+func newTracingTransport(config CFAccessProxyConfig, next http.RoundTripper) *tracingTransport {
+	return &tracingTransport{config: config, next: next}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	propagator := otel.GetTextMapPropagator()
+
+	// The outgoing request carries the client headers, so a client that is
+	// already tracing becomes the parent of the proxy span.
+	ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracing.Tracer().Start(ctx, fmt.Sprintf("proxy %s", req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("cloudflared_proxy.name", t.config.Name),
+			attribute.Int("cloudflared_proxy.local_port", int(t.config.LocalPort)),
+		),
+	)
+
+	// A RoundTripper must not modify the caller's request.
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	// The request lasts until its body is closed.
+	body := &doneBody{ReadCloser: resp.Body, done: func() { span.End() }}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// The body of a protocol upgrade is the connection itself.
+		resp.Body = doneReadWriteBody{body, rw}
+	} else {
+		resp.Body = tracingBody{body, span}
+	}
+	return resp, nil
+}
+
+// tracingBody records the errors reading a response body on its span.
+type tracingBody struct {
+	*doneBody
+	span trace.Span
+}
+
+func (b tracingBody) Read(p []byte) (int, error) {
+	n, err := b.doneBody.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.span.RecordError(err)
+		b.span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}
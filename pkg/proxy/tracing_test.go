@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func setupTestTracer(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return recorder
+}
+
+func TestTracingTransport(t *testing.T) {
+	t.Run("records span and propagates trace context", func(t *testing.T) {
+		recorder := setupTestTracer(t)
+
+		var traceparent string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparent = r.Header.Get("traceparent")
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		defer upstream.Close()
+
+		transport := newTracingTransport(CFAccessProxyConfig{LocalPort: 8080}, http.DefaultTransport)
+		req := httptest.NewRequest("GET", upstream.URL+"/path", nil)
+		req.RequestURI = ""
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Empty(t, recorder.Ended(), "span must last until the body is closed")
+		resp.Body.Close()
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		span := spans[0]
+		assert.Equal(t, "proxy GET", span.Name())
+		assert.Contains(t, span.Attributes(), attribute.Int("http.response.status_code", http.StatusTeapot))
+		assert.Contains(t, span.Attributes(), attribute.String("server.address", req.URL.Host))
+		assert.Contains(t, span.Attributes(), attribute.Int("cloudflared_proxy.local_port", 8080))
+
+		assert.Contains(t, traceparent, span.SpanContext().TraceID().String())
+		assert.Contains(t, traceparent, span.SpanContext().SpanID().String())
+		assert.Empty(t, req.Header.Get("traceparent"), "caller request must not be modified")
+	})
+
+	t.Run("continues incoming trace", func(t *testing.T) {
+		recorder := setupTestTracer(t)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer upstream.Close()
+
+		transport := newTracingTransport(CFAccessProxyConfig{}, http.DefaultTransport)
+		req := httptest.NewRequest("GET", upstream.URL, nil)
+		req.RequestURI = ""
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	})
+
+	t.Run("records transport errors", func(t *testing.T) {
+		recorder := setupTestTracer(t)
+
+		failing := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("dial failed")
+		})
+		transport := newTracingTransport(CFAccessProxyConfig{}, failing)
+		u, _ := url.Parse("https://app.example.com")
+		_, err := transport.RoundTrip(&http.Request{Method: "GET", URL: u, Header: http.Header{}})
+		require.Error(t, err)
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+		assert.Equal(t, "dial failed", spans[0].Status().Description)
+	})
+
+	t.Run("records body read errors", func(t *testing.T) {
+		recorder := setupTestTracer(t)
+
+		truncated := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			body := io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}, nil
+		})
+		transport := newTracingTransport(CFAccessProxyConfig{}, truncated)
+		u, _ := url.Parse("https://app.example.com")
+		resp, err := transport.RoundTrip(&http.Request{Method: "GET", URL: u, Header: http.Header{}})
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.Equal(t, "partial", string(body))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		resp.Body.Close()
+		resp.Body.Close()
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+		assert.Equal(t, io.ErrUnexpectedEOF.Error(), spans[0].Status().Description)
+		require.Len(t, spans[0].Events(), 1)
+		assert.Equal(t, "exception", spans[0].Events()[0].Name)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
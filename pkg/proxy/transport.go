@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+	"github.com/sbldevnet/cloudflared-proxy/pkg/options"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// TransportOptions tune the connections of a proxy to its upstream.
+type TransportOptions = options.Transport
+
+// ServerOptions are the timeouts of the local listener of a proxy.
+type ServerOptions = options.Server
+
+// Returns the Proxy function of a transport going through upstreamProxy.
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are honored unless a proxy is set.
+func upstreamProxyFunc(upstreamProxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch upstreamProxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case options.UpstreamProxyDirect:
+		return nil, nil
+	}
+
+	u, err := options.ParseUpstreamProxy(upstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// Returns the first upstream of config reached through the outbound proxy
+// given by proxyFunc, along with that proxy, or nils if none is. The outbound
+// proxy resolves the hostname, so resolve and dnsServer do not apply to it.
+func resolvedByProxy(config CFAccessProxyConfig, proxyFunc func(*url.URL) (*url.URL, error)) (*url.URL, *url.URL) {
+	for _, upstream := range config.Upstreams {
+		if through, err := proxyFunc(upstream.Url); err == nil && through != nil {
+			return upstream.Url, through
+		}
+	}
+	return nil, nil
+}
+
+// Returns the transport of a proxy to its upstream.
+func newTransport(config CFAccessProxyConfig) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := upstreamProxyFunc(config.UpstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	if config.UpstreamProxy == "" && (len(config.Resolve) > 0 || config.DNSServer != "") {
+		if upstream, through := resolvedByProxy(config, httpproxy.FromEnvironment().ProxyFunc()); upstream != nil {
+			logger.Warn("proxy.Proxy", "Upstream %s of proxy %s goes through the proxy %s of the environment, which ignores resolve and dnsServer. Set upstreamProxy to direct to apply them", upstream, config.Name, through.Redacted())
+		}
+	}
+
+	dialer, err := newUpstreamDialer(config, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	o := config.Transport
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   orDefault(o.TLSHandshakeTimeout, options.DefaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		IdleConnTimeout:       orDefault(o.IdleConnTimeout, options.DefaultIdleConnTimeout),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          orDefault(o.MaxIdleConns, options.DefaultMaxIdleConns),
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       o.MaxConnsPerHost,
+		ForceAttemptHTTP2:     o.HTTP2,
+		DisableKeepAlives:     o.DisableKeepAlives,
+	}
+	return transport, nil
+}
+
+// Returns the local server of a proxy, serving handler on addr.
+func newHTTPServer(config CFAccessProxyConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       config.Server.ReadTimeout,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+	}
+}
+
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
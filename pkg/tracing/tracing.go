@@ -0,0 +1,181 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sbldevnet/cloudflared-proxy/pkg/logger"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TracerName is the instrumentation scope used by every span and metric
+	// of the tool.
+	TracerName         = "github.com/sbldevnet/cloudflared-proxy"
+	DefaultServiceName = "cloudflared-proxy"
+	// MetricsInterval is the interval at which metrics are exported.
+	MetricsInterval = 30 * time.Second
+)
+
+// Config configures the OTLP/HTTP trace and metric exporters.
+type Config struct {
+	// Endpoint of the collector, either HOST:PORT or a full URL such as
+	// http://localhost:4318/v1/traces, metrics going to /v1/metrics instead.
+	// If empty, the standard OTEL_EXPORTER_OTLP_* environment variables are
+	// used, if set.
+	Endpoint string
+	// Insecure disables TLS when Endpoint is given as HOST:PORT.
+	Insecure    bool
+	ServiceName string
+}
+
+// Enabled reports whether a trace exporter endpoint is configured, either
+// explicitly or through the environment.
+func (c Config) Enabled() bool {
+	return c.Endpoint != "" || anyEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+}
+
+// MetricsEnabled reports whether a metric exporter endpoint is configured,
+// either explicitly or through the environment.
+func (c Config) MetricsEnabled() bool {
+	return c.Endpoint != "" || anyEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+}
+
+// Reports whether any of the environment variables envs is set.
+func anyEnv(envs ...string) bool {
+	for _, env := range envs {
+		if os.Getenv(env) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracer returns the tracer used across the tool.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// Meter returns the meter used across the tool.
+func Meter() metric.Meter {
+	return otel.Meter(TracerName)
+}
+
+// Setup installs the global tracer and meter providers and the W3C trace
+// context propagator. The returned function flushes pending spans and metrics
+// and must be called before exiting. When no exporter is enabled, Setup only
+// installs the propagator and returns a no-op shutdown function.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", serviceName))
+
+	var shutdowns []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, f := range shutdowns {
+			errs = append(errs, f(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	if cfg.Enabled() {
+		tracerProvider, err := newTracerProvider(ctx, cfg, res)
+		if err != nil {
+			return nil, err
+		}
+		otel.SetTracerProvider(tracerProvider)
+		shutdowns = append(shutdowns, tracerProvider.Shutdown)
+		logger.Debug("tracing.Setup", "Exporting traces to %s", cfg.Endpoint)
+	} else {
+		logger.Debug("tracing.Setup", "No OTLP endpoint configured, tracing disabled")
+	}
+
+	if cfg.MetricsEnabled() {
+		meterProvider, err := newMeterProvider(ctx, cfg, res)
+		if err != nil {
+			_ = shutdown(ctx)
+			return nil, err
+		}
+		otel.SetMeterProvider(meterProvider)
+		shutdowns = append(shutdowns, meterProvider.Shutdown)
+		logger.Debug("tracing.Setup", "Exporting metrics to %s", cfg.Endpoint)
+	} else {
+		logger.Debug("tracing.Setup", "No OTLP endpoint configured, metrics disabled")
+	}
+
+	return shutdown, nil
+}
+
+// Returns a tracer provider exporting spans to the endpoint of cfg.
+func newTracerProvider(ctx context.Context, cfg Config, res *resource.Resource) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	switch {
+	case strings.Contains(cfg.Endpoint, "://"):
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	case cfg.Endpoint != "":
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// Returns a meter provider exporting metrics to the endpoint of cfg every
+// MetricsInterval.
+func newMeterProvider(ctx context.Context, cfg Config, res *resource.Resource) (*sdkmetric.MeterProvider, error) {
+	var opts []otlpmetrichttp.Option
+	switch {
+	case strings.Contains(cfg.Endpoint, "://"):
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(metricsURL(cfg.Endpoint)))
+	case cfg.Endpoint != "":
+		opts = append(opts, otlpmetrichttp.WithEndpoint(cfg.Endpoint))
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+	}
+
+	exporter, err := otlpmetrichttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(MetricsInterval))
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res)), nil
+}
+
+// Returns the URL of the metrics of the collector whose traces are sent to
+// tracesURL, replacing its /v1/traces path by /v1/metrics.
+func metricsURL(tracesURL string) string {
+	u, err := url.Parse(tracesURL)
+	if err != nil {
+		// Left to the exporter to report.
+		return tracesURL
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/v1/traces") + "/v1/metrics"
+	u.RawPath = ""
+	return u.String()
+}
@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// collector is a minimal in-process stand-in for an OTLP/HTTP collector.
+type collector struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	c.requests = append(c.requests, r)
+	c.bodies = append(c.bodies, body)
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns the body of the first request received at path, or nil.
+func (c *collector) body(path string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.requests {
+		if r.URL.Path == path {
+			return c.bodies[i]
+		}
+	}
+	return nil
+}
+
+func TestSetup(t *testing.T) {
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetMeterProvider(metricnoop.NewMeterProvider())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "")
+
+		shutdown, err := Setup(context.Background(), Config{})
+		require.NoError(t, err)
+		assert.NoError(t, shutdown(context.Background()))
+	})
+
+	t.Run("exports spans to collector", func(t *testing.T) {
+		c := &collector{}
+		srv := httptest.NewServer(c)
+		defer srv.Close()
+
+		shutdown, err := Setup(context.Background(), Config{Endpoint: srv.URL + "/v1/traces", ServiceName: "test"})
+		require.NoError(t, err)
+
+		_, span := Tracer().Start(context.Background(), "test-span")
+		span.End()
+
+		require.NoError(t, shutdown(context.Background()))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		require.NotEmpty(t, c.requests)
+		assert.Equal(t, "/v1/traces", c.requests[0].URL.Path)
+		assert.Equal(t, "application/x-protobuf", c.requests[0].Header.Get("Content-Type"))
+		assert.Contains(t, string(c.bodies[0]), "test-span")
+	})
+
+	t.Run("exports metrics to collector", func(t *testing.T) {
+		c := &collector{}
+		srv := httptest.NewServer(c)
+		defer srv.Close()
+
+		shutdown, err := Setup(context.Background(), Config{Endpoint: srv.URL + "/v1/traces", ServiceName: "test"})
+		require.NoError(t, err)
+
+		counter, err := Meter().Int64Counter("test.counter")
+		require.NoError(t, err)
+		counter.Add(context.Background(), 1)
+
+		require.NoError(t, shutdown(context.Background()))
+
+		body := c.body("/v1/metrics")
+		require.NotNil(t, body)
+		assert.Contains(t, string(body), "test.counter")
+	})
+}
+
+func TestMetricsURL(t *testing.T) {
+	tests := []struct {
+		tracesURL string
+		expected  string
+	}{
+		{"http://localhost:4318/v1/traces", "http://localhost:4318/v1/metrics"},
+		{"http://localhost:4318", "http://localhost:4318/v1/metrics"},
+		{"http://localhost:4318/", "http://localhost:4318/v1/metrics"},
+		{"https://collector.example.com/otlp/v1/traces", "https://collector.example.com/otlp/v1/metrics"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, metricsURL(tc.tracesURL), tc.tracesURL)
+	}
+}
+
+func TestConfigEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	assert.False(t, Config{}.Enabled())
+	assert.True(t, Config{Endpoint: "localhost:4318"}.Enabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	assert.True(t, Config{}.Enabled())
+}
+
+func TestConfigMetricsEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://localhost:4318/v1/traces")
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "")
+	assert.False(t, Config{}.MetricsEnabled())
+	assert.True(t, Config{Endpoint: "localhost:4318"}.MetricsEnabled())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "http://localhost:4318/v1/metrics")
+	assert.True(t, Config{}.MetricsEnabled())
+}